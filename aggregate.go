@@ -0,0 +1,259 @@
+package almacen
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Stage is a step of an aggregation pipeline, with only one of its fields set. Match selects
+// the documents, Group puts them together, Sort orders them, ties by ID, and Limit keeps
+// the first ones
+type Stage struct {
+	Match *Filter
+	Group *Group
+	Sort  []string
+	Limit int
+}
+
+// Group makes a document for every distinct value of By, a field path, or for every
+// document if By is empty. The value is the ID of the new document, whose fields are
+// computed by Fields
+type Group struct {
+	By     string
+	Fields map[string]Accumulator
+}
+
+// Accumulator computes a field of a Group, the count of its documents or the sum, average,
+// minimum or maximum of Field. Sum and average take only numbers, minimum and maximum
+// compare anything but nulls as sorting does. Without values the sum is 0 and the rest null
+type Accumulator struct {
+	Op    string
+	Field string
+}
+
+// Operators of an Accumulator
+const (
+	AccumulatorCount = "count"
+	AccumulatorSum   = "sum"
+	AccumulatorAvg   = "avg"
+	AccumulatorMin   = "min"
+	AccumulatorMax   = "max"
+)
+
+func pipelineErr(msg string) error {
+	return &Error{statusCode: http.StatusBadRequest, message: "invalid pipeline: " + msg}
+}
+
+// parsePipeline reads a pipeline such as
+//
+//	[{"match": "temperature>0"},
+//	 {"group": {"by": "city", "fields": {"n": "count()", "avg": "avg(temperature)"}}},
+//	 {"sort": "-avg"},
+//	 {"limit": 10}]
+//
+// Filters are those of ParseFilter and sort fields are as in the sort parameter of a listing
+func parsePipeline(input interface{}) ([]Stage, error) {
+	list, isArray := input.([]interface{})
+	if !isArray {
+		return nil, ErrArrayExpected
+	}
+	stages := make([]Stage, len(list))
+	for i, e := range list {
+		m, isObject := e.(map[string]interface{})
+		if !isObject || len(m) != 1 {
+			return nil, pipelineErr("stage " + strconv.Itoa(i) + " must be an object with a single key")
+		}
+		for op, arg := range m {
+			if err := stages[i].parse(op, arg); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return stages, nil
+}
+
+func (st *Stage) parse(op string, arg interface{}) error {
+	var err error
+	switch op {
+	case "match":
+		s, _ := arg.(string)
+		if st.Match, err = ParseFilter(s); err == nil && st.Match == nil {
+			err = pipelineErr("empty match")
+		}
+	case "group":
+		st.Group, err = parseGroup(arg)
+	case "sort":
+		s, _ := arg.(string)
+		if st.Sort, err = parseSort(s); err == nil && len(st.Sort) == 0 {
+			err = ErrInvalidSort
+		}
+	case "limit":
+		n, isNumber := arg.(float64)
+		if !isNumber || n < 1 || n != math.Trunc(n) {
+			return ErrInvalidLimit
+		}
+		st.Limit = int(n)
+	default:
+		err = pipelineErr("unknown stage " + strconv.Quote(op))
+	}
+	return err
+}
+
+func parseGroup(arg interface{}) (*Group, error) {
+	m, isObject := arg.(map[string]interface{})
+	if !isObject {
+		return nil, pipelineErr("group must be an object")
+	}
+	g := &Group{Fields: map[string]Accumulator{}}
+	for k, v := range m {
+		switch k {
+		case "by":
+			by, isString := v.(string)
+			if !isString || !validPath(by) {
+				return nil, pipelineErr("invalid group by")
+			}
+			g.By = by
+		case "fields":
+			fields, isObject := v.(map[string]interface{})
+			if !isObject {
+				return nil, pipelineErr("group fields must be an object")
+			}
+			for name, v := range fields {
+				if name == "_id" || !validPath(name) || strings.Contains(name, ".") {
+					return nil, ErrInvalidFieldName
+				}
+				s, _ := v.(string)
+				acc, err := parseAccumulator(s)
+				if err != nil {
+					return nil, err
+				}
+				g.Fields[name] = acc
+			}
+		default:
+			return nil, pipelineErr("unknown group key " + strconv.Quote(k))
+		}
+	}
+	return g, nil
+}
+
+// parseAccumulator reads "count()", or an operator with a field, as "avg(temperature)"
+func parseAccumulator(s string) (Accumulator, error) {
+	open := strings.IndexByte(s, '(')
+	if open < 0 || !strings.HasSuffix(s, ")") {
+		return Accumulator{}, pipelineErr("invalid accumulator " + strconv.Quote(s))
+	}
+	acc := Accumulator{Op: s[:open], Field: strings.TrimSpace(s[open+1 : len(s)-1])}
+	switch acc.Op {
+	case AccumulatorCount:
+		if acc.Field == "" {
+			return acc, nil
+		}
+	case AccumulatorSum, AccumulatorAvg, AccumulatorMin, AccumulatorMax:
+		if validPath(acc.Field) {
+			return acc, nil
+		}
+	}
+	return Accumulator{}, pipelineErr("invalid accumulator " + strconv.Quote(s))
+}
+
+// aggregate runs the pipeline over docs, as MongoDB would
+func aggregate(docs []map[string]interface{}, pipeline []Stage) []map[string]interface{} {
+	for i := range pipeline {
+		st := &pipeline[i]
+		switch {
+		case st.Match != nil:
+			var matched []map[string]interface{}
+			for _, doc := range docs {
+				if st.Match.match(doc) {
+					matched = append(matched, doc)
+				}
+			}
+			docs = matched
+		case st.Group != nil:
+			docs = st.Group.apply(docs)
+		case len(st.Sort) > 0:
+			sortEntities(docs, mongoSort(st.Sort))
+		case st.Limit > 0 && len(docs) > st.Limit:
+			docs = docs[:st.Limit]
+		}
+	}
+	return docs
+}
+
+// apply returns the groups in the order their first documents come
+func (g *Group) apply(docs []map[string]interface{}) []map[string]interface{} {
+	var (
+		index   = map[string]int{} // by the key in JSON, so 1 and 1.0 are the same
+		keys    []interface{}
+		members [][]map[string]interface{}
+	)
+	for _, doc := range docs {
+		var key interface{}
+		if g.By != "" {
+			key, _ = lookupField(doc, g.By)
+		}
+		b, _ := json.Marshal(key)
+		i, found := index[string(b)]
+		if !found {
+			i = len(keys)
+			index[string(b)] = i
+			keys = append(keys, key)
+			members = append(members, nil)
+		}
+		members[i] = append(members[i], doc)
+	}
+	groups := make([]map[string]interface{}, len(keys))
+	for i, key := range keys {
+		group := map[string]interface{}{"_id": key}
+		for name, acc := range g.Fields {
+			group[name] = acc.compute(members[i])
+		}
+		groups[i] = group
+	}
+	return groups
+}
+
+func (acc *Accumulator) compute(docs []map[string]interface{}) interface{} {
+	if acc.Op == AccumulatorCount {
+		return float64(len(docs))
+	}
+	var (
+		sum  float64
+		n    int
+		best interface{}
+	)
+	for _, doc := range docs {
+		v, err := lookupField(doc, acc.Field)
+		if err != nil || v == nil {
+			continue
+		}
+		switch acc.Op {
+		case AccumulatorMin:
+			if best == nil || compareSortValues(v, best) < 0 {
+				best = v
+			}
+		case AccumulatorMax:
+			if best == nil || compareSortValues(v, best) > 0 {
+				best = v
+			}
+		default:
+			if x, isNumber := toFloat(v); isNumber {
+				sum += x
+				n++
+			}
+		}
+	}
+	switch acc.Op {
+	case AccumulatorSum:
+		return sum
+	case AccumulatorAvg:
+		if n == 0 {
+			return nil
+		}
+		return sum / float64(n)
+	}
+	return best
+}
@@ -0,0 +1,107 @@
+package almacen
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParsePipeline(t *testing.T) {
+	var input interface{}
+	err := json.Unmarshal([]byte(`[
+		{"match": "temperature>0"},
+		{"group": {"by": "city", "fields": {"n": "count()", "avg": "avg(temperature)"}}},
+		{"sort": "-avg"},
+		{"limit": 10}
+	]`), &input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := parsePipeline(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := []Stage{
+		{Match: &Filter{Op: FilterGt, Field: "temperature", Value: 0.0}},
+		{Group: &Group{By: "city", Fields: map[string]Accumulator{
+			"n":   {Op: AccumulatorCount},
+			"avg": {Op: AccumulatorAvg, Field: "temperature"},
+		}}},
+		{Sort: []string{"-avg"}},
+		{Limit: 10},
+	}
+	if !reflect.DeepEqual(pipeline, wanted) {
+		t.Errorf("wanted %+v, got %+v", wanted, pipeline)
+	}
+}
+
+func TestParsePipelineErr(t *testing.T) {
+	for _, c := range []struct {
+		input string
+		err   error
+	}{
+		{`{"limit": 1}`, ErrArrayExpected},
+		{`[{"limit": 0}]`, ErrInvalidLimit},
+		{`[{"limit": 1.5}]`, ErrInvalidLimit},
+		{`[{"sort": ""}]`, ErrInvalidSort},
+		{`[{"group": {"fields": {"_id": "count()"}}}]`, ErrInvalidFieldName},
+		{`[{"group": {"fields": {"a.b": "count()"}}}]`, ErrInvalidFieldName},
+		{`[{"group": {"fields": {"$a": "count()"}}}]`, ErrInvalidFieldName},
+	} {
+		var input interface{}
+		if err := json.Unmarshal([]byte(c.input), &input); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parsePipeline(input); err != c.err {
+			t.Errorf("%s: wanted %v, got %v", c.input, c.err, err)
+		}
+	}
+	for _, input := range []string{
+		`[{}]`,
+		`[{"limit": 1, "sort": "a"}]`,
+		`[{"unknown": 1}]`,
+		`[{"match": ""}]`,
+		`[{"group": {"by": "$a"}}]`,
+		`[{"group": {"fields": {"n": "count(a)"}}}]`,
+		`[{"group": {"fields": {"n": "avg()"}}}]`,
+		`[{"group": {"fields": {"n": "median(a)"}}}]`,
+	} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(input), &v); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parsePipeline(v); err == nil {
+			t.Errorf("%s: wanted error", input)
+		}
+	}
+}
+
+func TestMongoStage(t *testing.T) {
+	for _, c := range []struct {
+		stage  Stage
+		wanted bson.M
+	}{
+		{
+			Stage{Group: &Group{Fields: map[string]Accumulator{
+				"n":   {Op: AccumulatorCount},
+				"max": {Op: AccumulatorMax, Field: "a.b"},
+			}}},
+			bson.M{"$group": bson.M{"_id": nil, "n": bson.M{"$sum": 1}, "max": bson.M{"$max": "$a.b"}}},
+		},
+		{
+			Stage{Group: &Group{By: "city", Fields: map[string]Accumulator{}}},
+			bson.M{"$group": bson.M{"_id": "$city"}},
+		},
+		{
+			Stage{Sort: []string{"-n"}},
+			bson.M{"$sort": bson.D{{Name: "n", Value: -1}, {Name: "_id", Value: 1}}},
+		},
+		{Stage{Limit: 3}, bson.M{"$limit": 3}},
+	} {
+		if got := mongoStage(&c.stage); !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("wanted %v, got %v", c.wanted, got)
+		}
+	}
+}
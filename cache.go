@@ -0,0 +1,331 @@
+package almacen
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CachingStore keeps the entities most recently read from its backend in a bounded
+// LRU cache, with their revisions. FindByID, FindField and their WithRevision versions
+// are served from the cache, anything else goes to the backend. Every change made through the CachingStore invalidates the entity,
+// changes made directly in the backend are only noticed when the entry expires.
+//
+// It is a Wrapper, the optional interfaces of the backend are those of the CachingStore.
+// It is also a CollectionWriter, invalidating the collections written.
+//
+// Concurrent misses for the same entity are coalesced into a single backend read.
+// As it is shared, the read does not use the context of any request, but its own one,
+// limited by LoadTimeout. A request giving up does not cancel it for the others.
+type CachingStore struct {
+	Store
+	LoadTimeout time.Duration // zero means no limit
+
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recent first
+	items   map[cacheKey]*list.Element
+	loading map[cacheKey]*cacheCall
+
+	hits, misses uint64
+}
+
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+type cacheKey struct {
+	collection, id string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	ent     map[string]interface{}
+	rev     string // of ent, read with it
+	expires time.Time
+}
+
+type cacheCall struct {
+	done  chan struct{} // closed when ent, rev and err are set
+	ent   map[string]interface{}
+	rev   string
+	err   error
+	stale bool // the entity changed while loading, so it must not be cached
+}
+
+const DefaultCacheLoadTimeout = 10 * time.Second
+
+// NewCachingStore caches up to size entities of backend. A zero ttl means entries do not expire.
+func NewCachingStore(backend Store, size int, ttl time.Duration) *CachingStore {
+	return &CachingStore{
+		Store:       backend,
+		LoadTimeout: DefaultCacheLoadTimeout,
+		size:        size,
+		ttl:         ttl,
+		lru:         list.New(),
+		items:       make(map[cacheKey]*list.Element),
+		loading:     make(map[cacheKey]*cacheCall),
+	}
+}
+
+func (cs *CachingStore) Stats() CacheStats {
+	cs.mu.Lock()
+	entries := cs.lru.Len()
+	cs.mu.Unlock()
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&cs.hits),
+		Misses:  atomic.LoadUint64(&cs.misses),
+		Entries: entries,
+	}
+}
+
+// BeginRequest lets the backend prepare the request, if it needs so
+func (cs *CachingStore) BeginRequest(ctx context.Context) (context.Context, func()) {
+	if scoper, ok := cs.Store.(RequestScoper); ok {
+		return scoper.BeginRequest(ctx)
+	}
+	return ctx, func() {}
+}
+
+// Unwrap returns the backend, which has the features of the CachingStore, as Aggregate,
+// Search, the indexes and the geo queries do not need the cache
+func (cs *CachingStore) Unwrap() Store {
+	return cs.Store
+}
+
+func (cs *CachingStore) FindByID(ctx context.Context, collection, id string) (map[string]interface{}, error) {
+	ent, _, err := cs.find(ctx, cacheKey{collection, id})
+	if err != nil {
+		return nil, err
+	}
+	return copyEntity(ent), nil
+}
+
+func (cs *CachingStore) FindWithRevision(ctx context.Context, collection, id string) (map[string]interface{}, string, error) {
+	ent, rev, err := cs.find(ctx, cacheKey{collection, id})
+	if err != nil {
+		return nil, "", err
+	}
+	return copyEntity(ent), rev, nil
+}
+
+func (cs *CachingStore) FindField(ctx context.Context, collection, id, field string) (interface{}, error) {
+	value, _, err := cs.FindFieldWithRevision(ctx, collection, id, field)
+	return value, err
+}
+
+func (cs *CachingStore) FindFieldWithRevision(ctx context.Context, collection, id, field string) (interface{}, string, error) {
+	ent, rev, err := cs.find(ctx, cacheKey{collection, id})
+	if err != nil {
+		return nil, "", err
+	}
+	if isRevPath(field) {
+		ent = map[string]interface{}{}
+		if rev != "" {
+			ent[RevField] = rev
+		}
+	}
+	value, err := lookupField(ent, field)
+	if err != nil {
+		return nil, "", err
+	}
+	return copyValue(value), rev, nil
+}
+
+func (cs *CachingStore) Save(ctx context.Context, collection string, ent map[string]interface{}) error {
+	err := cs.Store.Save(ctx, collection, ent)
+	if id, isString := ent["_id"].(string); isString {
+		cs.invalidate(cacheKey{collection, id})
+	}
+	return err
+}
+
+func (cs *CachingStore) Insert(ctx context.Context, collection string, ent map[string]interface{}) error {
+	err := cs.Store.Insert(ctx, collection, ent)
+	if id, isString := ent["_id"].(string); isString {
+		cs.invalidate(cacheKey{collection, id})
+	}
+	return err
+}
+
+func (cs *CachingStore) Replace(ctx context.Context, collection string, ent map[string]interface{}) error {
+	err := cs.Store.Replace(ctx, collection, ent)
+	if id, isString := ent["_id"].(string); isString {
+		cs.invalidate(cacheKey{collection, id})
+	}
+	return err
+}
+
+func (cs *CachingStore) Delete(ctx context.Context, collection, id string) error {
+	err := cs.Store.Delete(ctx, collection, id)
+	cs.invalidate(cacheKey{collection, id})
+	return err
+}
+
+func (cs *CachingStore) UpdateField(ctx context.Context, collection, id, field string, value interface{}) error {
+	err := cs.Store.UpdateField(ctx, collection, id, field, value)
+	cs.invalidate(cacheKey{collection, id})
+	return err
+}
+
+func (cs *CachingStore) DeleteField(ctx context.Context, collection, id, field string) error {
+	err := cs.Store.DeleteField(ctx, collection, id, field)
+	cs.invalidate(cacheKey{collection, id})
+	return err
+}
+
+func (cs *CachingStore) Update(ctx context.Context, collection, id string, u *Update) error {
+	err := cs.Store.Update(ctx, collection, id, u)
+	cs.invalidate(cacheKey{collection, id})
+	return err
+}
+
+func (cs *CachingStore) Patch(ctx context.Context, collection, id string, ops []PatchOp) error {
+	err := cs.Store.Patch(ctx, collection, id, ops)
+	cs.invalidate(cacheKey{collection, id})
+	return err
+}
+
+// ReplaceCollection and DropCollection fail with ErrNotImplemented if the backend does
+// not have them, as AsCollectionWriter tells
+
+func (cs *CachingStore) ReplaceCollection(ctx context.Context, collection string, ents []map[string]interface{}) error {
+	backend, ok := AsCollectionWriter(cs.Store)
+	if !ok {
+		return ErrNotImplemented
+	}
+	err := backend.ReplaceCollection(ctx, collection, ents)
+	cs.invalidateCollection(collection)
+	return err
+}
+
+func (cs *CachingStore) DropCollection(ctx context.Context, collection string) error {
+	backend, ok := AsCollectionWriter(cs.Store)
+	if !ok {
+		return ErrNotImplemented
+	}
+	err := backend.DropCollection(ctx, collection)
+	cs.invalidateCollection(collection)
+	return err
+}
+
+// find returns the cached entity, which must not be modified, and its revision
+func (cs *CachingStore) find(ctx context.Context, key cacheKey) (map[string]interface{}, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	cs.mu.Lock()
+	if elem, found := cs.items[key]; found {
+		entry := elem.Value.(*cacheEntry)
+		if cs.ttl == 0 || time.Now().Before(entry.expires) {
+			cs.lru.MoveToFront(elem)
+			cs.mu.Unlock()
+			atomic.AddUint64(&cs.hits, 1)
+			return entry.ent, entry.rev, nil
+		}
+		cs.remove(elem)
+	}
+	atomic.AddUint64(&cs.misses, 1)
+
+	call, found := cs.loading[key]
+	if !found {
+		call = &cacheCall{done: make(chan struct{})}
+		cs.loading[key] = call
+		go cs.load(key, call)
+	}
+	cs.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.ent, call.rev, call.err
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+}
+
+// load reads the entity for every request waiting for call
+func (cs *CachingStore) load(key cacheKey, call *cacheCall) {
+	ctx, cancel := context.Background(), func() {}
+	if cs.LoadTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cs.LoadTimeout)
+	}
+	defer cancel()
+	ent, rev, err := findWithRevision(ctx, cs.Store, key.collection, key.id)
+
+	cs.mu.Lock()
+	call.ent, call.rev, call.err = ent, rev, err
+	if cs.loading[key] == call {
+		delete(cs.loading, key)
+	}
+	if err == nil && !call.stale {
+		cs.add(key, ent, rev)
+	}
+	cs.mu.Unlock()
+	close(call.done)
+}
+
+// invalidate must be called after changing the entity
+func (cs *CachingStore) invalidate(key cacheKey) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if elem, found := cs.items[key]; found {
+		cs.remove(elem)
+	}
+	cs.forget(key)
+}
+
+func (cs *CachingStore) invalidateCollection(collection string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for key, elem := range cs.items {
+		if key.collection == collection {
+			cs.remove(elem)
+		}
+	}
+	for key := range cs.loading {
+		if key.collection == collection {
+			cs.forget(key)
+		}
+	}
+}
+
+// forget marks the read of key in progress, if any, as stale, as it may have been done
+// before the change. Later requests do not wait for it. It must be called with cs.mu held
+func (cs *CachingStore) forget(key cacheKey) {
+	if call, found := cs.loading[key]; found {
+		call.stale = true
+		delete(cs.loading, key)
+	}
+}
+
+// add must be called with cs.mu held
+func (cs *CachingStore) add(key cacheKey, ent map[string]interface{}, rev string) {
+	if cs.size <= 0 {
+		return
+	}
+	entry := &cacheEntry{key: key, ent: ent, rev: rev}
+	if cs.ttl > 0 {
+		entry.expires = time.Now().Add(cs.ttl)
+	}
+	if elem, found := cs.items[key]; found {
+		elem.Value = entry
+		cs.lru.MoveToFront(elem)
+		return
+	}
+	cs.items[key] = cs.lru.PushFront(entry)
+	for cs.lru.Len() > cs.size {
+		cs.remove(cs.lru.Back())
+	}
+}
+
+// remove must be called with cs.mu held
+func (cs *CachingStore) remove(elem *list.Element) {
+	cs.lru.Remove(elem)
+	delete(cs.items, elem.Value.(*cacheEntry).key)
+}
@@ -0,0 +1,307 @@
+package almacen
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore counts the reads reaching the backend. If release is not nil, reads wait for it
+type countingStore struct {
+	*MemStore
+	reads   int32
+	release chan struct{}
+}
+
+func (s *countingStore) FindWithRevision(ctx context.Context, collection, id string) (map[string]interface{}, string, error) {
+	atomic.AddInt32(&s.reads, 1)
+	if s.release != nil {
+		<-s.release
+	}
+	return s.MemStore.FindWithRevision(ctx, collection, id)
+}
+
+func newCachingTest(size int, ttl time.Duration, t *testing.T) (*CachingStore, *countingStore) {
+	backend := &countingStore{MemStore: NewMemStore()}
+	for _, id := range []string{"a", "b", "c"} {
+		ent := map[string]interface{}{"_id": id, "x": map[string]interface{}{"y": id}}
+		if err := backend.Save(contextTest, collectionTest, ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewCachingStore(backend, size, ttl), backend
+}
+
+func TestCachingStoreHits(t *testing.T) {
+	cs, backend := newCachingTest(10, 0, t)
+	for i := 0; i < 3; i++ {
+		if _, err := cs.FindByID(contextTest, collectionTest, "a"); err != nil {
+			t.Fatal(err)
+		}
+		v, err := cs.FindField(contextTest, collectionTest, "a", "x.y")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != "a" {
+			t.Errorf("expected %v, got %v", "a", v)
+		}
+	}
+	if backend.reads != 1 {
+		t.Errorf("expected 1 backend read, got %d", backend.reads)
+	}
+	expected := CacheStats{Hits: 5, Misses: 1, Entries: 1}
+	if stats := cs.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestCachingStoreNoAliasing(t *testing.T) {
+	cs, _ := newCachingTest(10, 0, t)
+	ent, err := cs.FindByID(contextTest, collectionTest, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ent["x"].(map[string]interface{})["y"] = "CHANGED"
+	v, err := cs.FindField(contextTest, collectionTest, "a", "x.y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "a" {
+		t.Errorf("expected %v, got %v", "a", v)
+	}
+}
+
+func TestCachingStoreInvalidation(t *testing.T) {
+	cs, backend := newCachingTest(10, 0, t)
+	changes := []func() error{
+		func() error { return cs.UpdateField(contextTest, collectionTest, "a", "x.y", "1") },
+		func() error { return cs.DeleteField(contextTest, collectionTest, "a", "x.y") },
+		func() error {
+			return cs.Save(contextTest, collectionTest, map[string]interface{}{"_id": "a", "x": "2"})
+		},
+		func() error {
+			return cs.Update(contextTest, collectionTest, "a", &Update{Set: map[string]interface{}{"x": "3"}})
+		},
+		func() error { return cs.Delete(contextTest, collectionTest, "a") },
+	}
+	expected := []interface{}{
+		map[string]interface{}{"y": "1"},
+		map[string]interface{}{},
+		"2",
+		"3",
+	}
+	for i, change := range changes {
+		if _, err := cs.FindByID(contextTest, collectionTest, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		v, err := cs.FindField(contextTest, collectionTest, "a", "x")
+		if i < len(expected) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v, expected[i]) {
+				t.Errorf("expected %v, got %v", expected[i], v)
+			}
+		} else if err != ErrNotFound {
+			t.Errorf("expected %v, got %v", ErrNotFound, err)
+		}
+	}
+	if backend.reads != 6 {
+		t.Errorf("expected 6 backend reads, got %d", backend.reads)
+	}
+}
+
+func TestCachingStoreCollectionInvalidation(t *testing.T) {
+	cs, backend := newCachingTest(10, 0, t)
+	for _, id := range []string{"a", "b"} {
+		if _, err := cs.FindByID(contextTest, collectionTest, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replacement := []map[string]interface{}{{"_id": "a", "x": "new"}}
+	if err := cs.ReplaceCollection(contextTest, collectionTest, replacement); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cs.FindField(contextTest, collectionTest, "a", "x"); err != nil || v != "new" {
+		t.Errorf("expected %v, got %v %v", "new", v, err)
+	}
+	if _, err := cs.FindByID(contextTest, collectionTest, "b"); err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	if err := cs.DropCollection(contextTest, collectionTest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.FindByID(contextTest, collectionTest, "a"); err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	if backend.reads != 5 {
+		t.Errorf("expected 5 backend reads, got %d", backend.reads)
+	}
+}
+
+func TestCachingStoreEviction(t *testing.T) {
+	cs, backend := newCachingTest(2, 0, t)
+	for _, id := range []string{"a", "b", "a", "c", "a", "b"} {
+		if _, err := cs.FindByID(contextTest, collectionTest, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a b (hit a) c evicts b, (hit a) b evicts c
+	if backend.reads != 4 {
+		t.Errorf("expected 4 backend reads, got %d", backend.reads)
+	}
+	if entries := cs.Stats().Entries; entries != 2 {
+		t.Errorf("expected 2 entries, got %d", entries)
+	}
+}
+
+func TestCachingStoreTTL(t *testing.T) {
+	cs, backend := newCachingTest(10, 10*time.Millisecond, t)
+	for i := 0; i < 2; i++ {
+		if _, err := cs.FindByID(contextTest, collectionTest, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := cs.FindByID(contextTest, collectionTest, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if backend.reads != 2 {
+		t.Errorf("expected 2 backend reads, got %d", backend.reads)
+	}
+}
+
+func TestCachingStoreCoalescing(t *testing.T) {
+	cs, backend := newCachingTest(10, 0, t)
+	backend.release = make(chan struct{})
+	const readers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := cs.FindField(contextTest, collectionTest, "a", "x.y")
+			if err != nil {
+				t.Error(err)
+			}
+			if v != "a" {
+				t.Errorf("expected %v, got %v", "a", v)
+			}
+		}()
+	}
+	// wait for every reader to be a miss before letting the backend answer
+	for cs.Stats().Misses < readers {
+		time.Sleep(time.Millisecond)
+	}
+	close(backend.release)
+	wg.Wait()
+	if backend.reads != 1 {
+		t.Errorf("expected 1 backend read, got %d", backend.reads)
+	}
+}
+
+func TestCachingStoreCanceledWaiter(t *testing.T) {
+	cs, backend := newCachingTest(10, 0, t)
+	backend.release = make(chan struct{})
+	ctx, cancel := context.WithCancel(contextTest)
+	first := make(chan error)
+	go func() {
+		_, err := cs.FindByID(ctx, collectionTest, "a")
+		first <- err
+	}()
+	for cs.Stats().Misses < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan error)
+	go func() {
+		_, err := cs.FindByID(contextTest, collectionTest, "a")
+		second <- err
+	}()
+	for cs.Stats().Misses < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the request which started the read gives up, the other one still gets the entity
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	close(backend.release)
+	if err := <-second; err != nil {
+		t.Error(err)
+	}
+	if _, err := cs.FindByID(contextTest, collectionTest, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if reads := atomic.LoadInt32(&backend.reads); reads != 1 {
+		t.Errorf("expected 1 backend read, got %d", reads)
+	}
+}
+
+func TestCachingStoreInvalidationWhileLoading(t *testing.T) {
+	cs, backend := newCachingTest(10, 0, t)
+	backend.release = make(chan struct{})
+	// load id, changing b meanwhile
+	load := func(id string) {
+		done := make(chan struct{})
+		misses := cs.Stats().Misses
+		go func() {
+			defer close(done)
+			if _, err := cs.FindByID(contextTest, collectionTest, id); err != nil {
+				t.Error(err)
+			}
+		}()
+		for cs.Stats().Misses == misses {
+			time.Sleep(time.Millisecond)
+		}
+		if err := cs.UpdateField(contextTest, collectionTest, "b", "x.y", "changed"); err != nil {
+			t.Fatal(err)
+		}
+		backend.release <- struct{}{}
+		<-done
+	}
+	// a is cached, changing b does not matter
+	load("a")
+	// b is not, it may have been read before changing
+	load("b")
+
+	close(backend.release)
+	for _, id := range []string{"a", "b"} {
+		if _, err := cs.FindByID(contextTest, collectionTest, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reads := atomic.LoadInt32(&backend.reads); reads != 3 {
+		t.Errorf("expected 3 backend reads, got %d", reads)
+	}
+}
+
+func TestCachingStoreFeatures(t *testing.T) {
+	if _, ok := Backend(NewCachingStore(NewMemStore(), 10, 0)).(Indexer); !ok {
+		t.Error("expected the indexes of the backend")
+	}
+	// a backend with only the methods of Store
+	backend := Backend(NewCachingStore(struct{ Store }{NewMemStore()}, 10, 0))
+	_, isAggregator := backend.(Aggregator)
+	_, isSearcher := backend.(Searcher)
+	_, isIndexer := backend.(Indexer)
+	_, isGeoQuerier := backend.(GeoQuerier)
+	_, isLister := backend.(CollectionLister)
+	if isAggregator || isSearcher || isIndexer || isGeoQuerier || isLister {
+		t.Error("unexpected optional interfaces")
+	}
+	// the cache writes collections, but not for this backend
+	if _, ok := AsCollectionWriter(NewCachingStore(struct{ Store }{NewMemStore()}, 10, 0)); ok {
+		t.Error("unexpected CollectionWriter")
+	}
+	cs := NewCachingStore(NewMemStore(), 10, 0)
+	if cw, ok := AsCollectionWriter(cs); !ok || cw != CollectionWriter(cs) {
+		t.Errorf("expected the cache as CollectionWriter, got %v", cw)
+	}
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/crbrox/almacen"
-	"github.com/julienschmidt/httprouter"
 
 	"github.com/crbrox/almacen/ctx"
 )
@@ -29,23 +30,49 @@ func main() {
 		os.Exit(ExitStatusConfig)
 	}
 	cB.Infof("config loaded %#v", c)
-	mes := &almacen.MongoEntityStore{}
-	err = mes.Start(c)
-	if err != nil {
-		cB.Infof("store start: %v", err)
+	var store almacen.Store
+	if c.DataDir != "" {
+		fs, err := almacen.OpenFileStore(c.DataDir)
+		if err != nil {
+			cB.Infof("store open: %v", err)
+			os.Exit(ExitStatusStore)
+		}
+		cB.Infof("file store opened at %v", c.DataDir)
+		defer fs.Close()
+		store = fs
+	} else {
+		mes := &almacen.MongoEntityStore{}
+		err = mes.Start(c)
+		if err != nil {
+			cB.Infof("store start: %v", err)
+			os.Exit(ExitStatusStore)
+		}
+		cB.Infof("store started")
+		defer mes.Stop()
+		store = mes
+	}
+	indexer, canIndex := store.(almacen.Indexer)
+	if len(c.Indexes) > 0 && !canIndex {
+		cB.Infof("the store does not have indexes")
 		os.Exit(ExitStatusStore)
 	}
-	cB.Infof("store started")
-	defer mes.Stop()
-
-	almacen.SetStore(mes)
-
-	router := httprouter.New()
+	for col, specs := range c.Indexes {
+		for _, spec := range specs {
+			if err = indexer.EnsureIndex(context.Background(), col, spec); err != nil {
+				cB.Infof("index %q of %q: %v", spec.Name, col, err)
+				os.Exit(ExitStatusStore)
+			}
+		}
+	}
+	if c.CacheSize > 0 {
+		store = almacen.NewCachingStore(store, c.CacheSize, time.Duration(c.CacheTTLSeconds)*time.Second)
+		cB.Infof("caching %d entities", c.CacheSize)
+	}
 
-	almacen.AddRoutes(router)
+	server := almacen.NewServer(store, c)
 
 	cB.Infof("starting http server %v", c.Address)
-	err = http.ListenAndServe(c.Address, router)
+	err = http.ListenAndServe(c.Address, server)
 	if err != nil {
 		cB.Infof("start server: %v", err)
 		os.Exit(ExitStatusServer)
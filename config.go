@@ -2,13 +2,19 @@ package almacen
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 )
 
 type Config struct {
-	Address  string
-	MongoURL string
+	Address         string
+	MongoURL        string
+	DataDir         string
+	CacheSize       int
+	CacheTTLSeconds int
+	IDScheme        string
+	Indexes         map[string][]IndexSpec // by collection, ensured on start
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -27,6 +33,16 @@ func Load(reader io.Reader) (*Config, error) {
 	}
 
 	// additional validation
+	if _, valid := idGenerators[c.IDScheme]; !valid {
+		return nil, fmt.Errorf("unknown IDScheme %q", c.IDScheme)
+	}
+	for col, specs := range c.Indexes {
+		for i := range specs {
+			if err := specs[i].normalize(); err != nil {
+				return nil, fmt.Errorf("index %d of %q: %v", i, col, err)
+			}
+		}
+	}
 
 	return c, nil
 }
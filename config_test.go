@@ -1,6 +1,9 @@
 package almacen
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestLoadConfig(t *testing.T) {
 	const (
@@ -31,3 +34,23 @@ func TestLoadConfigErrDecode(t *testing.T) {
 		t.Error("not valid json: wanted error, got nil")
 	}
 }
+
+func TestLoadConfigErrIDScheme(t *testing.T) {
+	_, err := Load(strings.NewReader(`{"IDScheme": "sequential"}`))
+	if err == nil {
+		t.Error("unknown id scheme: wanted error, got nil")
+	}
+}
+
+func TestLoadConfigIndexes(t *testing.T) {
+	c, err := Load(strings.NewReader(`{"Indexes": {"users": [{"fields": ["email"], "unique": true}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := c.Indexes["users"][0].Name; name != "email_1" {
+		t.Errorf("index name: wanted %q, got %q", "email_1", name)
+	}
+	if _, err = Load(strings.NewReader(`{"Indexes": {"users": [{"fields": []}]}}`)); err == nil {
+		t.Error("index without fields: wanted error, got nil")
+	}
+}
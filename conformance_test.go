@@ -0,0 +1,61 @@
+package almacen_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/crbrox/almacen"
+	"github.com/crbrox/almacen/storetest"
+	"gopkg.in/mgo.v2"
+)
+
+func TestMemStoreConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) almacen.Store {
+		return almacen.NewMemStore()
+	})
+}
+
+func TestCachingStoreConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) almacen.Store {
+		return almacen.NewCachingStore(almacen.NewMemStore(), 2, time.Minute)
+	})
+}
+
+func TestFileStoreConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) almacen.Store {
+		dir, err := ioutil.TempDir("", "almacen")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, err := almacen.OpenFileStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			fs.Close()
+			os.RemoveAll(dir)
+		})
+		return fs
+	})
+}
+
+func TestMongoStoreConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) almacen.Store {
+		const mongoURL = "localhost"
+		session, err := mgo.Dial(mongoURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.DB("").C(storetest.Collection).DropCollection()
+		session.Close()
+
+		store := &almacen.MongoEntityStore{}
+		if err := store.Start(&almacen.Config{MongoURL: mongoURL}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(store.Stop)
+		return store
+	})
+}
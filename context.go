@@ -1,6 +1,7 @@
 package almacen
 
 import (
+	"context"
 	"log"
 	"os"
 
@@ -14,16 +15,34 @@ var (
 	InfoLogger  = log.New(os.Stderr, "", log.LstdFlags)
 )
 
-type context struct {
-	params  httprouter.Params
-	session *mgo.Session
-	input   interface{}
+// requestContext is what handlers get. It is a context.Context itself, carrying
+// the request cancellation, the ctx.Ctx and the Mongo session, so it can be
+// passed directly to the Store
+type requestContext struct {
+	context.Context
+	params httprouter.Params
+	input  interface{}
 	ctx.Ctx
 }
 
-func NewContext() *context {
-	return &context{
+func (s *Server) newRequestContext(parent context.Context) *requestContext {
+	rc := &requestContext{
 		Ctx: ctx.Ctx{
-			DebugLogger: DebugLogger,
-			InfoLogger:  InfoLogger}}
+			DebugLogger: s.debugLogger,
+			InfoLogger:  s.infoLogger}}
+	rc.Context = ctx.NewContext(parent, &rc.Ctx)
+	return rc
+}
+
+type sessionKey struct{}
+
+// WithSession returns a copy of parent carrying a Mongo session,
+// used by MongoEntityStore instead of its own
+func WithSession(parent context.Context, session *mgo.Session) context.Context {
+	return context.WithValue(parent, sessionKey{}, session)
+}
+
+func sessionFromContext(c context.Context) (*mgo.Session, bool) {
+	s, ok := c.Value(sessionKey{}).(*mgo.Session)
+	return s, ok
 }
@@ -1,56 +1,521 @@
 package almacen
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
 
-func AddRoutes(router *httprouter.Router) {
+// AddRoutes adds the routes of the server to router, under its prefix
+func (s *Server) AddRoutes(router *httprouter.Router) {
+	p := s.prefix
+
+	// Collections
+	router.GET(p+"/", s.H(s.ListCollections))
 
 	//Entities
-	router.GET("/:col/", H(ListEntities))
-	// router.PUT("/:col/", ReplaceEntities)
-	// router.DELETE("/:col/", DeleteEntities)
+	router.GET(p+"/:col/", s.H(s.ListEntities))
+	router.HEAD(p+"/:col/", s.H(s.CountEntities))
+	router.POST(p+"/:col/", s.H(s.CreateEntity))
+	router.PUT(p+"/:col/", s.H(s.ReplaceEntities))
+	router.DELETE(p+"/:col/", s.H(s.DeleteEntities))
 
 	// Entity
-	router.GET("/:col/:id", H(RetrieveEntity))
-	router.PUT("/:col/:id", H(AddEntity))
-	router.DELETE("/:col/:id", H(DeleteEntity))
+	router.GET(p+"/:col/:id", s.H(s.RetrieveEntity))
+	router.HEAD(p+"/:col/:id", s.H(s.CheckEntity))
+	router.PUT(p+"/:col/:id", s.H(s.AddEntity))
+	router.DELETE(p+"/:col/:id", s.H(s.DeleteEntity))
+	router.PATCH(p+"/:col/:id", s.H(s.PatchEntity))
+	router.POST(p+"/:col/:id", s.H(s.Command))
 
 	// Fields
-	router.GET("/:col/:id/*fieldpath", H(RetrieveField))
-	router.PUT("/:col/:id/*fieldpath", H(UpdateField))
-	router.DELETE("/:col/:id/*fieldpath", H(DeleteField))
+	router.GET(p+"/:col/:id/*fieldpath", s.H(s.RetrieveField))
+	router.PUT(p+"/:col/:id/*fieldpath", s.H(s.UpdateField))
+	router.DELETE(p+"/:col/:id/*fieldpath", s.H(s.DeleteField))
+	router.POST(p+"/:col/:id/*fieldpath", s.H(s.UpdateFieldOperator))
+
+}
+
+// ListCollections returns the name, number of entities and approximate size in bytes of
+// every collection
+func (s *Server) ListCollections(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	lister, ok := Backend(s.store).(CollectionLister)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	infos, err := lister.Collections(ctx)
+	if err != nil {
+		ctx.Infof("error listing collections: %v", err)
+		return nil, err
+	}
+	if infos == nil {
+		infos = []CollectionInfo{}
+	}
+	return infos, nil
+}
+
+// CountEntities answers a HEAD on the collection with its number of entities in the
+// X-Total-Count header
+func (s *Server) CountEntities(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	col := ctx.params[0].Value
+	ctx.Debugf("col: %q", col)
+	lister, ok := Backend(s.store).(CollectionLister)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	n, err := lister.Count(ctx, col)
+	if err != nil {
+		ctx.Infof("error counting: %v", err)
+		return nil, err
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(n))
+	return nil, nil
+}
+
+// Command runs a command on the collection, named by a reserved ID, as httprouter
+// does not allow a static segment beside the ID. They are _aggregate and _indexes
+func (s *Server) Command(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	switch ctx.params[1].Value {
+	case "_aggregate":
+		return s.Aggregate(ctx, w, req)
+	case "_indexes":
+		return s.CreateIndex(ctx, w, req)
+	}
+	w.Header().Set("Allow", "GET, HEAD, PUT, DELETE, PATCH")
+	return nil, &Error{statusCode: http.StatusMethodNotAllowed, message: "method not allowed"}
+}
+
+// Aggregate runs the pipeline in the body over the collection, returning the resulting documents
+func (s *Server) Aggregate(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	col := ctx.params[0].Value
+	pipeline, err := parsePipeline(ctx.input)
+	if err != nil {
+		return nil, err
+	}
+	aggregator, ok := Backend(s.store).(Aggregator)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	ctx.Debugf("col: %q pipeline: %+v", col, pipeline)
+	docs, err := aggregator.Aggregate(ctx, col, pipeline)
+	if err != nil {
+		ctx.Infof("error aggregating: %v", err)
+		return nil, err
+	}
+	if docs == nil {
+		docs = []map[string]interface{}{}
+	}
+	return docs, nil
+}
+
+// Search returns the entities with the words of the q parameter, the most relevant first,
+// with their scores. The limit parameter is the maximum number of them
+func (s *Server) Search(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	searcher, ok := Backend(s.store).(Searcher)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	col := ctx.params[0].Value
+	values := req.URL.Query()
+	limit, err := parseLimit(values.Get("limit"))
+	if err != nil {
+		return nil, err
+	}
+	text := values.Get("q")
+	ctx.Debugf("col: %q text: %q limit: %d", col, text, limit)
+	hits, err := searcher.Search(ctx, col, text, limit)
+	if err != nil {
+		ctx.Infof("error searching: %v", err)
+		return nil, err
+	}
+	if hits == nil {
+		hits = []SearchHit{}
+	}
+	return hits, nil
+}
+
+// Near returns the entities within the radius parameter, in meters, of the point in the
+// lon and lat parameters, the nearest first, with their distances. The field parameter
+// has the geo index, the first one of the collection by default. The limit parameter is
+// the maximum number of them
+func (s *Server) Near(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	geo, ok := Backend(s.store).(GeoQuerier)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	col := ctx.params[0].Value
+	values := req.URL.Query()
+	limit, err := parseLimit(values.Get("limit"))
+	if err != nil {
+		return nil, err
+	}
+	center, radius, err := parseNear(values)
+	if err != nil {
+		return nil, err
+	}
+	field, err := s.geoField(ctx, col, values.Get("field"))
+	if err != nil {
+		return nil, err
+	}
+	ctx.Debugf("col: %q field: %q center: %v radius: %v limit: %d", col, field, center, radius, limit)
+	hits, err := geo.Near(ctx, col, field, center, radius, limit)
+	if err != nil {
+		ctx.Infof("error finding near: %v", err)
+		return nil, err
+	}
+	if hits == nil {
+		hits = []GeoHit{}
+	}
+	return hits, nil
+}
+
+// Within returns the entities in the box or polygon parameter, ordered by ID. The field
+// and limit parameters are as for Near
+func (s *Server) Within(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	geo, ok := Backend(s.store).(GeoQuerier)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	col := ctx.params[0].Value
+	values := req.URL.Query()
+	limit, err := parseLimit(values.Get("limit"))
+	if err != nil {
+		return nil, err
+	}
+	area, err := parseGeoArea(values)
+	if err != nil {
+		return nil, err
+	}
+	field, err := s.geoField(ctx, col, values.Get("field"))
+	if err != nil {
+		return nil, err
+	}
+	ctx.Debugf("col: %q field: %q area: %+v limit: %d", col, field, area, limit)
+	ents, err := geo.Within(ctx, col, field, area, limit)
+	if err != nil {
+		ctx.Infof("error finding within: %v", err)
+		return nil, err
+	}
+	if ents == nil {
+		ents = []map[string]interface{}{}
+	}
+	return ents, nil
+}
+
+// geoField returns field, or the field of the first geo index of the collection if it is
+// empty, ErrNoGeoIndex if there is none or the store does not have indexes
+func (s *Server) geoField(ctx *requestContext, col, field string) (string, error) {
+	if field != "" {
+		if !validPath(field) {
+			return "", ErrInvalidFieldName
+		}
+		return field, nil
+	}
+	indexer, ok := Backend(s.store).(Indexer)
+	if !ok {
+		return "", ErrNoGeoIndex
+	}
+	specs, err := indexer.Indexes(ctx, col)
+	if err != nil {
+		return "", err
+	}
+	for _, spec := range specs {
+		if spec.Geo {
+			return spec.Fields[0], nil
+		}
+	}
+	return "", ErrNoGeoIndex
+}
 
+// ListIndexes returns the declared indexes of the collection
+func (s *Server) ListIndexes(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	indexer, ok := Backend(s.store).(Indexer)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	col := ctx.params[0].Value
+	ctx.Debugf("col: %q", col)
+	specs, err := indexer.Indexes(ctx, col)
+	if err != nil {
+		ctx.Infof("error listing indexes: %v", err)
+		return nil, err
+	}
+	if specs == nil {
+		specs = []IndexSpec{}
+	}
+	return specs, nil
+}
+
+// CreateIndex ensures the index in the body, returning it with its name
+func (s *Server) CreateIndex(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	col := ctx.params[0].Value
+	spec, err := parseIndexSpec(ctx.input)
+	if err != nil {
+		return nil, err
+	}
+	indexer, ok := Backend(s.store).(Indexer)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	ctx.Debugf("col: %q index: %+v", col, spec)
+	if err = indexer.EnsureIndex(ctx, col, spec); err != nil {
+		ctx.Infof("error creating index: %v", err)
+		return nil, err
+	}
+	// relative to the collection, as for entities
+	w.Header().Set("Location", "_indexes/"+url.PathEscape(spec.Name))
+	w.WriteHeader(http.StatusCreated)
+	return spec, nil
 }
 
-func ListEntities(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+// DropIndex removes the index named by the path after _indexes
+func (s *Server) DropIndex(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	col := ctx.params[0].Value
+	name := strings.Trim(ctx.params[2].Value, "/")
+	indexer, ok := Backend(s.store).(Indexer)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	ctx.Debugf("col: %q index: %q", col, name)
+	if err := indexer.DropIndex(ctx, col, name); err != nil {
+		ctx.Infof("error dropping index: %v", err)
+		return nil, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil, nil
+}
 
-	// Esto debería  ser incremental ...
+// ListEntities returns the entities ordered by ID, or by the sort parameter. With a limit,
+// if there are more entities, the cursor for the next page is in the X-Next-Cursor header
+// and in a Link header with rel="next". It holds the ID of the last entity, and the values
+// it is sorted by, so the next page starts after it even if others are added or removed
+func (s *Server) ListEntities(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	col := ctx.params[0].Value
-	entities, err := store.FindAll(ctx, col)
+	q, err := parseQuery(req.URL.Query())
 	if err != nil {
-		ctx.Infof("error finding all: %v", err)
 		return nil, err
 	}
+	ctx.Debugf("col: %q query: %+v", col, q)
+	if strings.Contains(req.Header.Get("Accept"), ndjsonContentType) {
+		return s.exportEntities(ctx, w, col, q)
+	}
+	limit := q.Limit
+	if limit > 0 {
+		q.Limit++ // one more to know if there is a next page
+	}
+	entities, err := s.store.Find(ctx, col, q)
+	if err != nil {
+		ctx.Infof("error finding: %v", err)
+		return nil, err
+	}
+	if limit > 0 && len(entities) > limit {
+		entities = entities[:limit]
+		last := entities[limit-1]
+		if len(q.Sort) > 0 && len(q.Fields) > 0 {
+			// the fields to sort by may not be among those returned
+			if ent, err := s.store.FindByID(ctx, col, last["_id"].(string)); err == nil {
+				last = ent
+			}
+		}
+		q = q.Next(last)
+		next := (&cursor{After: q.After, SortAfter: q.SortAfter}).encode()
+		values := req.URL.Query()
+		values.Set("cursor", next)
+		w.Header().Set("X-Next-Cursor", next)
+		w.Header().Set("Link", "<?"+values.Encode()+`>; rel="next"`)
+	}
+	if entities == nil {
+		entities = []map[string]interface{}{}
+	}
 	return entities, nil
 }
 
-func RetrieveEntity(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+const ndjsonContentType = "application/x-ndjson"
+
+// exportEntities streams the entities as they are read, one JSON per line,
+// writing the response itself
+func (s *Server) exportEntities(ctx *requestContext, w http.ResponseWriter, col string, q *Query) (interface{}, error) {
+	var (
+		encoder    = json.NewEncoder(w)
+		flusher, _ = w.(http.Flusher)
+		written    = 0
+	)
+	err := s.store.Iterate(ctx, col, q, func(ent map[string]interface{}) error {
+		if written == 0 {
+			w.Header().Set("Content-Type", ndjsonContentType)
+		}
+		written++
+		if err := encoder.Encode(ent); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if written == 0 {
+			return nil, err
+		}
+		// too late to tell the client, it gets a truncated stream
+		ctx.Infof("error exporting after %d entities: %v", written, err)
+		return nil, nil
+	}
+	if written == 0 {
+		w.Header().Set("Content-Type", ndjsonContentType)
+	}
+	return nil, nil
+}
+
+// ReplaceEntities replaces the whole collection with the entities in the body, a JSON array
+// or NDJSON. Readers see either the old entities or the new ones
+func (s *Server) ReplaceEntities(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	col := ctx.params[0].Value
+	ctx.Debugf("col: %q", col)
+	writer, ok := AsCollectionWriter(s.store)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	var entities []map[string]interface{}
+	if isNDJSON(req) {
+		decoder := json.NewDecoder(req.Body)
+		for {
+			var entity map[string]interface{}
+			err := decoder.Decode(&entity)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, &Error{message: "json parsing: " + err.Error(), statusCode: http.StatusBadRequest}
+			}
+			if entity == nil {
+				return nil, ErrObjectExpected
+			}
+			entities = append(entities, entity)
+		}
+	} else {
+		list, isArray := ctx.input.([]interface{})
+		if !isArray {
+			return nil, ErrArrayExpected
+		}
+		for _, e := range list {
+			entity, isObject := e.(map[string]interface{})
+			if !isObject {
+				return nil, ErrObjectExpected
+			}
+			entities = append(entities, entity)
+		}
+	}
+	for _, entity := range entities {
+		if id, isString := entity["_id"].(string); isString && reservedID(id) {
+			return nil, ErrReservedID
+		}
+	}
+	err := writer.ReplaceCollection(ctx, col, entities)
+	if err != nil {
+		ctx.Infof("error replacing collection: %v", err)
+		return nil, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil, nil
+}
+
+func (s *Server) DeleteEntities(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	col := ctx.params[0].Value
+	ctx.Debugf("col: %q", col)
+	writer, ok := AsCollectionWriter(s.store)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	err := writer.DropCollection(ctx, col)
+	if err != nil {
+		ctx.Infof("error dropping collection: %v", err)
+		return nil, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil, nil
+}
+
+// isNDJSON tells whether the body is NDJSON, which the handler has to read
+func isNDJSON(req *http.Request) bool {
+	return isContentType(req, ndjsonContentType)
+}
+
+// RetrieveEntity returns the entity, only with the fields in the fields parameter, if any,
+// and its revision in the ETag header. The IDs _search, _near, _within and _indexes are
+// searches on the collection and its indexes
+func (s *Server) RetrieveEntity(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 
 	col := ctx.params[0].Value
 	id := ctx.params[1].Value
+	switch id {
+	case "_search":
+		return s.Search(ctx, w, req)
+	case "_near":
+		return s.Near(ctx, w, req)
+	case "_within":
+		return s.Within(ctx, w, req)
+	case "_indexes":
+		return s.ListIndexes(ctx, w, req)
+	}
 	ctx.Debugf("col: %q id: %q", col, id)
-	ent, err := store.FindByID(ctx, col, id)
+	fields, err := parseFields(req.URL.Query().Get("fields"))
 	if err != nil {
 		return nil, err
 	}
+	ent, rev, err := findWithRevision(ctx, s.store, col, id)
+	if err != nil {
+		return nil, err
+	}
+	if fields != nil {
+		ent = projectEntity(ent, fields)
+	}
+	setETag(w, rev)
 	return ent, nil
 }
 
-func AddEntity(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+func setETag(w http.ResponseWriter, rev string) {
+	if rev != "" {
+		w.Header().Set("ETag", etag(rev))
+	}
+}
+
+// ifMatch makes the writes of the request conditional on the entity tag in the If-Match
+// header. "*" is left to the handlers, and anything else but a single tag cannot match
+func ifMatch(ctx *requestContext, req *http.Request) error {
+	header := req.Header.Get("If-Match")
+	if header == "" || header == "*" {
+		return nil
+	}
+	rev, ok := parseETag(header)
+	if !ok {
+		return ErrPreconditionFailed
+	}
+	ctx.Context = WithIfMatch(ctx.Context, rev)
+	return nil
+}
+
+// CheckEntity answers a HEAD on the entity, with its revision in the ETag header if it exists
+func (s *Server) CheckEntity(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	col := ctx.params[0].Value
+	id := ctx.params[1].Value
+	ctx.Debugf("col: %q id: %q", col, id)
+	_, rev, err := findWithRevision(ctx, s.store, col, id)
+	if err != nil {
+		return nil, err
+	}
+	setETag(w, rev)
+	return nil, nil
+}
+
+// AddEntity creates or replaces the entity. With "If-None-Match: *" it only creates it
+// and with "If-Match" it only replaces it, at the revision given by the entity tag if not "*".
+func (s *Server) AddEntity(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	var entity map[string]interface{}
 	entity, isObject := ctx.input.(map[string]interface{})
 	if !isObject {
@@ -59,21 +524,112 @@ func AddEntity(ctx *context, w http.ResponseWriter, req *http.Request) (interfac
 	col := ctx.params[0].Value
 	id := ctx.params[1].Value
 	ctx.Debugf("col: %q id: %q", col, id)
+	if reservedID(id) {
+		return nil, ErrReservedID
+	}
 	entity["_id"] = id
-	err := store.Save(ctx, col, entity)
+	if err := ifMatch(ctx, req); err != nil {
+		return nil, err
+	}
+
+	var (
+		err    error
+		status = http.StatusCreated // ? Created or no content
+	)
+	switch {
+	case req.Header.Get("If-None-Match") == "*":
+		err = s.store.Insert(ctx, col, entity)
+	case req.Header.Get("If-Match") != "":
+		err = s.store.Replace(ctx, col, entity)
+		status = http.StatusNoContent
+	default:
+		err = s.store.Save(ctx, col, entity)
+	}
 	if err != nil {
 		ctx.Infof("error saving entity: %v", err)
 		return nil, err
 	}
-	w.WriteHeader(http.StatusCreated) // ? Created or no content
+	w.WriteHeader(status)
 	return nil, nil
 }
 
-func DeleteEntity(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+// reservedID tells whether id is taken for a search, as _search, or any other operation on
+// the collection, so an entity cannot have it
+func reservedID(id string) bool {
+	switch id {
+	case "_search", "_near", "_within", "_indexes", "_aggregate":
+		return true
+	}
+	return false
+}
+
+// CreateEntity adds an entity with an ID generated by the server, any "_id" in it is ignored
+func (s *Server) CreateEntity(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	entity, isObject := ctx.input.(map[string]interface{})
+	if !isObject {
+		return nil, ErrObjectExpected
+	}
+	col := ctx.params[0].Value
+	id := s.newID()
+	ctx.Debugf("col: %q id: %q", col, id)
+	entity["_id"] = id
+	err := s.store.Insert(ctx, col, entity)
+	if err != nil {
+		ctx.Infof("error inserting entity: %v", err)
+		return nil, err
+	}
+	// relative to the collection, whatever prefix is in front of it
+	w.Header().Set("Location", url.PathEscape(id))
+	w.WriteHeader(http.StatusCreated)
+	return map[string]interface{}{"_id": id}, nil
+}
+
+// PatchEntity changes several fields at once, with a JSON Merge Patch or a JSON Patch body.
+// A failed JSON Patch operation, as a test, leaves the entity untouched
+func (s *Server) PatchEntity(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	col := ctx.params[0].Value
 	id := ctx.params[1].Value
 	ctx.Debugf("col: %q id: %q", col, id)
-	err := store.Delete(ctx, col, id)
+	err := ifMatch(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case isContentType(req, mergePatchContentType):
+		patch, isObject := ctx.input.(map[string]interface{})
+		if !isObject {
+			return nil, ErrObjectExpected
+		}
+		var update *Update
+		if update, err = mergePatchUpdate(id, patch); err != nil {
+			return nil, err
+		}
+		err = s.store.Update(ctx, col, id, update)
+	case isContentType(req, jsonPatchContentType):
+		var ops []PatchOp
+		if ops, err = parsePatch(ctx.input); err != nil {
+			return nil, err
+		}
+		err = s.store.Patch(ctx, col, id, ops)
+	default:
+		return nil, ErrUnsupportedMediaType
+	}
+	if err != nil {
+		ctx.Infof("error patching entity: %v", err)
+		return nil, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil, nil
+}
+
+func (s *Server) DeleteEntity(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	col := ctx.params[0].Value
+	id := ctx.params[1].Value
+	ctx.Debugf("col: %q id: %q", col, id)
+	if err := ifMatch(ctx, req); err != nil {
+		return nil, err
+	}
+	err := s.store.Delete(ctx, col, id)
 	if err != nil {
 		ctx.Infof("error deleting entity: %v", err)
 		return nil, err
@@ -82,29 +638,42 @@ func DeleteEntity(ctx *context, w http.ResponseWriter, req *http.Request) (inter
 	return nil, nil
 }
 
-func RetrieveField(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+func (s *Server) RetrieveField(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	col := ctx.params[0].Value
 	id := ctx.params[1].Value
 	field := ctx.params[2].Value
 	ctx.Debugf("col: %q id: %q, field: %q", col, id, field)
 	field = cookField(field)
 
-	value, err := store.FindField(ctx, col, id, field)
+	// the revision is internal, not a field of the entity
+	if isRevPath(field) {
+		return nil, ErrNotFound
+	}
+	// the field is read with the revision, so that the ETag is of the version read
+	value, rev, err := findFieldWithRevision(ctx, s.store, col, id, field)
 	if err != nil {
 		ctx.Debugf("error finding field: %v", err)
 		return nil, err
 	}
+	setETag(w, rev)
 	return value, nil
 }
 
-func DeleteField(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+// DeleteField removes the field. Under the ID _indexes, it drops the index instead
+func (s *Server) DeleteField(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	col := ctx.params[0].Value
 	id := ctx.params[1].Value
+	if id == "_indexes" {
+		return s.DropIndex(ctx, w, req)
+	}
 	field := ctx.params[2].Value
 	ctx.Debugf("col: %q id: %q, field: %q", col, id, field)
 	field = cookField(field)
+	if err := ifMatch(ctx, req); err != nil {
+		return nil, err
+	}
 
-	err := store.DeleteField(ctx, col, id, field)
+	err := s.store.DeleteField(ctx, col, id, field)
 	if err != nil {
 		ctx.Infof("error deleting field: %v", err)
 		return nil, err
@@ -113,16 +682,50 @@ func DeleteField(ctx *context, w http.ResponseWriter, req *http.Request) (interf
 	return nil, nil
 }
 
-func UpdateField(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+// UpdateField sets the field. Its parent object must exist, unless the parents parameter
+// is "true", which creates the missing objects on the way
+func (s *Server) UpdateField(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	col := ctx.params[0].Value
 	id := ctx.params[1].Value
 	field := ctx.params[2].Value
 	ctx.Debugf("col: %q id: %q, field: %q", col, id, field)
 	field = cookField(field)
+	if err := ifMatch(ctx, req); err != nil {
+		return nil, err
+	}
 
-	err := store.UpdateField(ctx, col, id, field, ctx.input)
+	var err error
+	if req.URL.Query().Get("parents") == "true" {
+		err = s.store.Update(ctx, col, id, &Update{Set: map[string]interface{}{field: ctx.input}})
+	} else {
+		err = s.store.UpdateField(ctx, col, id, field, ctx.input)
+	}
 	if err != nil {
-		ctx.Infof("error updating field: %v")
+		ctx.Infof("error updating field: %v", err)
+		return nil, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil, nil
+}
+
+// UpdateFieldOperator changes the field atomically with an operator, as
+// {"op": "inc", "value": 1}. See fieldOperatorUpdate for the rest of operators
+func (s *Server) UpdateFieldOperator(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	col := ctx.params[0].Value
+	id := ctx.params[1].Value
+	field := ctx.params[2].Value
+	ctx.Debugf("col: %q id: %q, field: %q", col, id, field)
+	field = cookField(field)
+	if err := ifMatch(ctx, req); err != nil {
+		return nil, err
+	}
+
+	update, err := fieldOperatorUpdate(field, ctx.input)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.store.Update(ctx, col, id, update); err != nil {
+		ctx.Infof("error updating field: %v", err)
 		return nil, err
 	}
 	w.WriteHeader(http.StatusNoContent)
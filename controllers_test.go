@@ -1,6 +1,11 @@
 package almacen
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/julienschmidt/httprouter"
@@ -12,18 +17,27 @@ func TestAddRoutes(t *testing.T) {
 		path   string
 		params []string
 	}{
+		{"GET", "/", nil},
 		{"GET", "/colection/", []string{"colection"}},
+		{"HEAD", "/colection/", []string{"colection"}},
+		{"POST", "/colection/", []string{"colection"}},
+		{"PUT", "/colection/", []string{"colection"}},
+		{"DELETE", "/colection/", []string{"colection"}},
 
 		{"GET", "/colection/id", []string{"colection", "id"}},
+		{"HEAD", "/colection/id", []string{"colection", "id"}},
 		{"PUT", "/colection/id", []string{"colection", "id"}},
 		{"DELETE", "/colection/id", []string{"colection", "id"}},
+		{"PATCH", "/colection/id", []string{"colection", "id"}},
+		{"POST", "/colection/id", []string{"colection", "id"}},
 
 		{"GET", "/colection/id/x/y/z", []string{"colection", "id", "/x/y/z"}},
 		{"PUT", "/colection/id/x/y/z", []string{"colection", "id", "/x/y/z"}},
 		{"DELETE", "/colection/id/x/y/z", []string{"colection", "id", "/x/y/z"}},
+		{"POST", "/colection/id/x/y/z", []string{"colection", "id", "/x/y/z"}},
 	}
 	r := httprouter.New()
-	AddRoutes(r)
+	NewServer(NewMemStore(), nil).AddRoutes(r)
 	for _, c := range cases {
 		handler, params, redirect := r.Lookup(c.method, c.path)
 		if redirect {
@@ -39,3 +53,995 @@ func TestAddRoutes(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateEntity(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, &Config{IDScheme: IDSchemeObjectID})
+	recorder := doRequest(s, "POST", "/col/", map[string]interface{}{"_id": "ignored", "x": "X"}, t)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusCreated, recorder.Code)
+	}
+	var res map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res["_id"].(string)
+	if len(id) != 24 {
+		t.Errorf("id: wanted an ObjectId, got %q", id)
+	}
+	if location := recorder.Header().Get("Location"); location != id {
+		t.Errorf("location: wanted %q, got %q", id, location)
+	}
+	ent, err := store.FindByID(contextTest, "col", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"_id": id, "x": "X"}
+	if !reflect.DeepEqual(ent, expected) {
+		t.Errorf("entity: wanted %v, got %v", expected, ent)
+	}
+}
+
+func TestAddEntityConditional(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	createOnly := http.Header{"If-None-Match": {"*"}}
+	replaceOnly := http.Header{"If-Match": {"*"}}
+	cases := []struct {
+		header http.Header
+		value  string
+		status int
+	}{
+		{replaceOnly, "1", http.StatusNotFound},
+		{createOnly, "2", http.StatusCreated},
+		{createOnly, "3", http.StatusConflict},
+		{replaceOnly, "4", http.StatusNoContent},
+		{http.Header{"If-Match": {`"xyz"`}}, "5", http.StatusPreconditionFailed},
+		{nil, "6", http.StatusCreated},
+	}
+	current := ""
+	for _, c := range cases {
+		recorder := doRequestHeader(s, "PUT", "/col/ID", c.header, map[string]interface{}{"v": c.value}, t)
+		if recorder.Code != c.status {
+			t.Errorf("%v: status code: wanted %d, got %d", c.header, c.status, recorder.Code)
+		}
+		if recorder.Code < 300 {
+			current = c.value
+		}
+		v, err := store.FindField(contextTest, "col", "ID", "v")
+		if current == "" {
+			if err != ErrNotFound {
+				t.Errorf("%v: wanted %v, got %v", c.header, ErrNotFound, err)
+			}
+		} else if v != current {
+			t.Errorf("%v: wanted %v, got %v", c.header, current, v)
+		}
+	}
+}
+
+func TestListEntitiesPages(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	var expected []interface{}
+	for _, id := range []string{"e", "b", "d", "a", "c"} {
+		if err := store.Save(contextTest, "col", map[string]interface{}{"_id": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		expected = append(expected, map[string]interface{}{"_id": id})
+	}
+
+	var all []interface{}
+	path := "/col/?limit=2"
+	for pages := 1; ; pages++ {
+		recorder := doRequest(s, "GET", path, nil, t)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code: wanted %d, got %d", http.StatusOK, recorder.Code)
+		}
+		var page []interface{}
+		if err := json.NewDecoder(recorder.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, page...)
+		next := recorder.Header().Get("X-Next-Cursor")
+		link := recorder.Header().Get("Link")
+		if next == "" {
+			if link != "" {
+				t.Errorf("link: wanted none in last page, got %q", link)
+			}
+			if pages != 3 {
+				t.Errorf("pages: wanted 3, got %d", pages)
+			}
+			break
+		}
+		if wanted := "<?cursor=" + next + `&limit=2>; rel="next"`; link != wanted {
+			t.Errorf("link: wanted %q, got %q", wanted, link)
+		}
+		path = "/col/?limit=2&cursor=" + next
+	}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("entities: wanted %v, got %v", expected, all)
+	}
+}
+
+func TestListEntitiesSortedPages(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	for id, n := range map[string]float64{"a": 3, "b": 1, "c": 2, "d": 1} {
+		if err := store.Save(contextTest, "col", map[string]interface{}{"_id": id, "n": n, "x": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page := func(path string) (ids []string, next string) {
+		t.Helper()
+		recorder := doRequest(s, "GET", path, nil, t)
+		var ents []map[string]interface{}
+		if err := json.NewDecoder(recorder.Body).Decode(&ents); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range ents {
+			ids = append(ids, e["_id"].(string))
+		}
+		return ids, recorder.Header().Get("X-Next-Cursor")
+	}
+	// the sort field is not returned
+	ids, next := page("/col/?sort=n&fields=x&limit=2")
+	if wanted := []string{"b", "d"}; !reflect.DeepEqual(ids, wanted) {
+		t.Errorf("first page: wanted %v, got %v", wanted, ids)
+	}
+	// an entity before the cursor moves nothing after it
+	if err := store.Save(contextTest, "col", map[string]interface{}{"_id": "e", "n": 0.0}); err != nil {
+		t.Fatal(err)
+	}
+	ids, next = page("/col/?sort=n&fields=x&limit=2&cursor=" + next)
+	if wanted := []string{"c", "a"}; !reflect.DeepEqual(ids, wanted) || next != "" {
+		t.Errorf("second page: wanted %v and no cursor, got %v %q", wanted, ids, next)
+	}
+	// a cursor for another sort
+	c := (&cursor{After: "b", SortAfter: []interface{}{1.0}}).encode()
+	if code := doRequest(s, "GET", "/col/?limit=2&cursor="+c, nil, t).Code; code != http.StatusBadRequest {
+		t.Errorf("status code: wanted %d, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestListEntitiesFilter(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	for i, id := range []string{"a", "b", "c", "d"} {
+		if err := store.Save(contextTest, "col", map[string]interface{}{"_id": id, "n": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder := doRequest(s, "GET", "/col/?limit=1&filter="+url.QueryEscape("n>=1 and n<3"), nil, t)
+	var page []interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if wanted := []interface{}{map[string]interface{}{"_id": "b", "n": 1.0}}; !reflect.DeepEqual(page, wanted) {
+		t.Errorf("first page: wanted %v, got %v", wanted, page)
+	}
+	link := recorder.Header().Get("Link")
+	recorder = doRequest(s, "GET", "/col/"+link[1:strings.Index(link, ">")], nil, t)
+	page = nil
+	if err := json.NewDecoder(recorder.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if wanted := []interface{}{map[string]interface{}{"_id": "c", "n": 2.0}}; !reflect.DeepEqual(page, wanted) {
+		t.Errorf("second page: wanted %v, got %v", wanted, page)
+	}
+	if next := recorder.Header().Get("X-Next-Cursor"); next != "" {
+		t.Errorf("cursor: wanted none in last page, got %q", next)
+	}
+}
+
+func TestListEntitiesSortPages(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	for i, id := range []string{"a", "b", "c", "d", "e"} {
+		if err := store.Save(contextTest, "col", map[string]interface{}{"_id": id, "n": float64(i % 2), "x": "x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ids []string
+	path := "/col/?limit=2&sort=-n&fields=n"
+	for path != "" {
+		recorder := doRequest(s, "GET", path, nil, t)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status code: wanted %d, got %d", http.StatusOK, recorder.Code)
+		}
+		var page []map[string]interface{}
+		if err := json.NewDecoder(recorder.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range page {
+			if _, found := e["x"]; found {
+				t.Errorf("wanted only _id and n, got %v", e)
+			}
+			ids = append(ids, e["_id"].(string))
+		}
+		path = ""
+		if link := recorder.Header().Get("Link"); link != "" {
+			path = "/col/" + link[1:strings.Index(link, ">")]
+		}
+	}
+	if wanted := []string{"b", "d", "a", "c", "e"}; !reflect.DeepEqual(ids, wanted) {
+		t.Errorf("entities: wanted %v, got %v", wanted, ids)
+	}
+}
+
+func TestRetrieveEntityFields(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	if err := store.Save(contextTest, "col", map[string]interface{}{"_id": "id", "a": map[string]interface{}{"b": 1, "c": 2}, "d": 3}); err != nil {
+		t.Fatal(err)
+	}
+	recorder := doRequest(s, "GET", "/col/id?fields=a.b", nil, t)
+	var ent map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&ent); err != nil {
+		t.Fatal(err)
+	}
+	if wanted := map[string]interface{}{"_id": "id", "a": map[string]interface{}{"b": 1.0}}; !reflect.DeepEqual(ent, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, ent)
+	}
+	for path, code := range map[string]int{
+		"/col/other?fields=a":  http.StatusNotFound,
+		"/col/id?fields=a,a.b": http.StatusBadRequest,
+	} {
+		if got := doRequest(s, "GET", path, nil, t).Code; got != code {
+			t.Errorf("%s: status code: wanted %d, got %d", path, code, got)
+		}
+	}
+}
+
+func TestRetrieveEntityFieldsCached(t *testing.T) {
+	cs, backend := newCachingTest(10, 0, t)
+	s := NewServer(cs, nil)
+	for _, path := range []string{"/col/a", "/col/a?fields=x.y", "/col/a?fields=x"} {
+		path = strings.Replace(path, "col", collectionTest, 1)
+		if got := doRequest(s, "GET", path, nil, t).Code; got != http.StatusOK {
+			t.Errorf("%s: status code: wanted %d, got %d", path, http.StatusOK, got)
+		}
+	}
+	if backend.reads != 1 {
+		t.Errorf("expected 1 backend read, got %d", backend.reads)
+	}
+}
+
+func TestListEntitiesInvalidParams(t *testing.T) {
+	s := NewServer(NewMemStore(), nil)
+	for _, path := range []string{"/col/?limit=-1", "/col/?limit=x", "/col/?cursor=%25%25", "/col/?filter=a%3D", "/col/?sort=a,", "/col/?fields=a..b"} {
+		if code := doRequest(s, "GET", path, nil, t).Code; code != http.StatusBadRequest {
+			t.Errorf("%s: status code: wanted %d, got %d", path, http.StatusBadRequest, code)
+		}
+	}
+}
+
+func TestListEntitiesNDJSON(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	for _, id := range []string{"b", "a", "c"} {
+		if err := store.Save(contextTest, "col", map[string]interface{}{"_id": id, "x": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	header := http.Header{"Accept": {ndjsonContentType}}
+	recorder := doRequestHeader(s, "GET", "/col/?limit=2", header, nil, t)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != ndjsonContentType {
+		t.Errorf("content-type: wanted %s, got %s", ndjsonContentType, contentType)
+	}
+	wanted := `{"_id":"a","x":1}` + "\n" + `{"_id":"b","x":1}` + "\n"
+	if body := recorder.Body.String(); body != wanted {
+		t.Errorf("body: wanted %q, got %q", wanted, body)
+	}
+	if !recorder.Flushed {
+		t.Errorf("wanted flushed response")
+	}
+}
+
+func TestAddEntityReservedID(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	for _, path := range []string{"/col/_search", "/col/_near", "/col/_within", "/col/_indexes", "/col/_aggregate"} {
+		recorder := doRequest(s, "PUT", path, map[string]interface{}{"v": 1}, t)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: status code: wanted %d, got %d", path, http.StatusBadRequest, recorder.Code)
+		}
+	}
+	if n, err := store.Count(contextTest, "col"); err != nil || n != 0 {
+		t.Errorf("wanted no entities, got %d %v", n, err)
+	}
+	// any other ID starting with _ is not taken
+	if code := doRequest(s, "PUT", "/col/_x", map[string]interface{}{"v": 1}, t).Code; code >= 300 {
+		t.Errorf("/col/_x: unexpected status code %d", code)
+	}
+	if code := doRequest(s, "GET", "/col/_x", nil, t).Code; code != http.StatusOK {
+		t.Errorf("/col/_x: status code: wanted %d, got %d", http.StatusOK, code)
+	}
+}
+
+func TestReplaceEntities(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	if err := store.Save(contextTest, "col", map[string]interface{}{"_id": "old"}); err != nil {
+		t.Fatal(err)
+	}
+	checkIDs := func(wanted []string) {
+		t.Helper()
+		entities, err := store.Find(contextTest, "col", &Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range entities {
+			ids = append(ids, e["_id"].(string))
+		}
+		if !reflect.DeepEqual(ids, wanted) {
+			t.Errorf("wanted %v, got %v", wanted, ids)
+		}
+	}
+
+	body := []interface{}{map[string]interface{}{"_id": "b"}, map[string]interface{}{"_id": "a"}}
+	if code := doRequest(s, "PUT", "/col/", body, t).Code; code != http.StatusNoContent {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusNoContent, code)
+	}
+	checkIDs([]string{"a", "b"})
+
+	header := http.Header{"Content-Type": {ndjsonContentType}}
+	ndjson := []byte("{\"_id\": \"c\"}\n{\"_id\": \"d\", \"x\": [1]}\n")
+	if code := doRequestHeader(s, "PUT", "/col/", header, ndjson, t).Code; code != http.StatusNoContent {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusNoContent, code)
+	}
+	checkIDs([]string{"c", "d"})
+
+	for _, c := range []struct {
+		header http.Header
+		body   interface{}
+		code   int
+	}{
+		{nil, map[string]interface{}{"_id": "x"}, http.StatusBadRequest},
+		{nil, []interface{}{"x"}, http.StatusBadRequest},
+		{nil, []interface{}{map[string]interface{}{"_id": "x"}, map[string]interface{}{"_id": "x"}}, http.StatusConflict},
+		{nil, []interface{}{map[string]interface{}{"_id": "x"}, map[string]interface{}{"_id": "_search"}}, http.StatusBadRequest},
+		{header, []byte("{\"_id\": \"x\"}\n[]\n"), http.StatusBadRequest},
+		{header, []byte("{\"_id\": \"x\"}\nnull\n"), http.StatusBadRequest},
+	} {
+		if code := doRequestHeader(s, "PUT", "/col/", c.header, c.body, t).Code; code != c.code {
+			t.Errorf("%v: status code: wanted %d, got %d", c.body, c.code, code)
+		}
+	}
+	checkIDs([]string{"c", "d"})
+}
+
+func TestDeleteEntities(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	if err := store.Save(contextTest, "col", map[string]interface{}{"_id": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{http.StatusNoContent, http.StatusNotFound} {
+		if got := doRequest(s, "DELETE", "/col/", nil, t).Code; got != code {
+			t.Errorf("status code: wanted %d, got %d", code, got)
+		}
+	}
+	if code := doRequest(s, "GET", "/col/a", nil, t).Code; code != http.StatusNotFound {
+		t.Errorf("status code: wanted %d, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestPatchEntity(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	// example from RFC 7396
+	original := map[string]interface{}{
+		"_id":     "id",
+		"title":   "Goodbye!",
+		"author":  map[string]interface{}{"givenName": "John", "familyName": "Doe"},
+		"tags":    []interface{}{"example", "sample"},
+		"content": "This will be unchanged",
+	}
+	if err := store.Save(contextTest, "col", original); err != nil {
+		t.Fatal(err)
+	}
+	patch := map[string]interface{}{
+		"title":       "Hello!",
+		"phoneNumber": "+01-123-456-7890",
+		"author":      map[string]interface{}{"familyName": nil},
+		"tags":        []interface{}{"example"},
+	}
+	header := http.Header{"Content-Type": {mergePatchContentType}}
+	if code := doRequestHeader(s, "PATCH", "/col/id", header, patch, t).Code; code != http.StatusNoContent {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusNoContent, code)
+	}
+	ent, err := store.FindByID(contextTest, "col", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := map[string]interface{}{
+		"_id":         "id",
+		"title":       "Hello!",
+		"author":      map[string]interface{}{"givenName": "John"},
+		"tags":        []interface{}{"example"},
+		"content":     "This will be unchanged",
+		"phoneNumber": "+01-123-456-7890",
+	}
+	if !reflect.DeepEqual(ent, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, ent)
+	}
+
+	for _, c := range []struct {
+		path   string
+		header http.Header
+		body   interface{}
+		code   int
+	}{
+		{"/col/id", nil, patch, http.StatusUnsupportedMediaType},
+		{"/col/id", header, []interface{}{}, http.StatusBadRequest},
+		{"/col/id", header, map[string]interface{}{"_id": "other"}, http.StatusBadRequest},
+		{"/col/missing", header, patch, http.StatusNotFound},
+	} {
+		if code := doRequestHeader(s, "PATCH", c.path, c.header, c.body, t).Code; code != c.code {
+			t.Errorf("%s %v: status code: wanted %d, got %d", c.path, c.body, c.code, code)
+		}
+	}
+}
+
+func TestPatchEntityMerge(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	if err := store.Save(contextTest, "col", map[string]interface{}{"_id": "id", "a": 5, "b": []interface{}{1, 2}, "c": 6}); err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Content-Type": {mergePatchContentType}}
+	patch := []byte(`{"a": {"b": 1}, "b": {"0": 3}, "c": {}, "d": {"e": null}}`)
+	if code := doRequestHeader(s, "PATCH", "/col/id", header, patch, t).Code; code != http.StatusNoContent {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusNoContent, code)
+	}
+	ent, err := store.FindByID(contextTest, "col", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// objects replace the values which are not objects
+	wanted := map[string]interface{}{
+		"_id": "id",
+		"a":   map[string]interface{}{"b": 1.0},
+		"b":   map[string]interface{}{"0": 3.0},
+		"c":   map[string]interface{}{},
+		"d":   map[string]interface{}{},
+	}
+	if !reflect.DeepEqual(ent, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, ent)
+	}
+
+	for _, body := range []string{`{"a.b": 1}`, `{"a": {"$inc": 1}}`} {
+		if code := doRequestHeader(s, "PATCH", "/col/id", header, []byte(body), t).Code; code != http.StatusBadRequest {
+			t.Errorf("%s: status code: wanted %d, got %d", body, http.StatusBadRequest, code)
+		}
+	}
+	etag := doRequest(s, "GET", "/col/id", nil, t).Header().Get("ETag")
+	if err := store.UpdateField(contextTest, "col", "id", "c", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	header.Set("If-Match", etag)
+	if code := doRequestHeader(s, "PATCH", "/col/id", header, []byte(`{"a": 1}`), t).Code; code != http.StatusPreconditionFailed {
+		t.Errorf("status code: wanted %d, got %d", http.StatusPreconditionFailed, code)
+	}
+}
+
+func TestPatchEntityJSONPatch(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	original := map[string]interface{}{"_id": "id", "a": "A", "list": []interface{}{1.0}}
+	if err := store.Save(contextTest, "col", original); err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Content-Type": {jsonPatchContentType}}
+	failing := []byte(`[{"op": "add", "path": "/list/-", "value": 2}, {"op": "test", "path": "/a", "value": "B"}]`)
+	recorder := doRequestHeader(s, "PATCH", "/col/id", header, failing, t)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("status code: wanted %d, got %d", http.StatusConflict, recorder.Code)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, `patch operation 1 (test \"/a\"): test failed`) {
+		t.Errorf("wanted a precise error, got %s", body)
+	}
+	patch := []byte(`[{"op": "test", "path": "/a", "value": "A"}, {"op": "add", "path": "/list/-", "value": 2}]`)
+	if code := doRequestHeader(s, "PATCH", "/col/id", header, patch, t).Code; code != http.StatusNoContent {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusNoContent, code)
+	}
+	ent, err := store.FindByID(contextTest, "col", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := map[string]interface{}{"_id": "id", "a": "A", "list": []interface{}{1.0, 2.0}}
+	if !reflect.DeepEqual(ent, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, ent)
+	}
+	if code := doRequestHeader(s, "PATCH", "/col/id", header, []byte(`{}`), t).Code; code != http.StatusBadRequest {
+		t.Errorf("status code: wanted %d, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestEntityETag(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	if err := store.Save(contextTest, "col", map[string]interface{}{"_id": "ID", "a": "A"}); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) string {
+		recorder := doRequest(s, "GET", path, nil, t)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("GET %s: status code: wanted %d, got %d", path, http.StatusOK, recorder.Code)
+		}
+		if strings.Contains(recorder.Body.String(), RevField) {
+			t.Errorf("GET %s: revision in body %s", path, recorder.Body)
+		}
+		etag := recorder.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("GET %s: no ETag", path)
+		}
+		return etag
+	}
+	mergePatch := http.Header{"Content-Type": {mergePatchContentType}}
+	if etag := get("/col/ID/a"); etag != get("/col/ID") {
+		t.Errorf("ETag of the field: wanted %s, got %s", get("/col/ID"), etag)
+	}
+	if code := doRequest(s, "GET", "/col/ID/"+RevField, nil, t).Code; code != http.StatusNotFound {
+		t.Errorf("GET the revision: status code: wanted %d, got %d", http.StatusNotFound, code)
+	}
+
+	stale := get("/col/ID")
+	cases := []struct {
+		method, path string
+		header       http.Header
+		ifMatch      string // the current ETag if empty
+		body         interface{}
+		status       int
+	}{
+		{"PUT", "/col/ID", nil, "", map[string]interface{}{"a": "B"}, http.StatusNoContent},
+		{"PUT", "/col/ID", nil, stale, map[string]interface{}{"a": "C"}, http.StatusPreconditionFailed},
+		{"PATCH", "/col/ID", mergePatch, "", []byte(`{"b": "B"}`), http.StatusNoContent},
+		{"PATCH", "/col/ID", mergePatch, stale, []byte(`{"b": "C"}`), http.StatusPreconditionFailed},
+		{"PUT", "/col/ID/b", nil, "", "D", http.StatusNoContent},
+		{"DELETE", "/col/ID/b", nil, stale, nil, http.StatusPreconditionFailed},
+		{"DELETE", "/col/ID/b", nil, "unquoted", nil, http.StatusPreconditionFailed},
+		{"DELETE", "/col/ID/b", nil, "", nil, http.StatusNoContent},
+		{"DELETE", "/col/ID", nil, stale, nil, http.StatusPreconditionFailed},
+		{"DELETE", "/col/ID", nil, "", nil, http.StatusNoContent},
+		{"PUT", "/col/ID", nil, "", map[string]interface{}{"a": "E"}, http.StatusPreconditionFailed},
+	}
+	current := stale
+	for _, c := range cases {
+		header := http.Header{"If-Match": {current}}
+		for k, v := range c.header {
+			header[k] = v
+		}
+		if c.ifMatch != "" {
+			header.Set("If-Match", c.ifMatch)
+		}
+		recorder := doRequestHeader(s, c.method, c.path, header, c.body, t)
+		if recorder.Code != c.status {
+			t.Errorf("%s %s %v: status code: wanted %d, got %d", c.method, c.path, header, c.status, recorder.Code)
+		}
+		if recorder.Code == http.StatusNoContent && !(c.method == "DELETE" && c.path == "/col/ID") {
+			current = get("/col/ID/a")
+		}
+	}
+}
+
+func TestCachedEntityETag(t *testing.T) {
+	backend := NewMemStore()
+	s := NewServer(NewCachingStore(backend, 10, 0), nil)
+	if err := backend.Save(contextTest, "col", map[string]interface{}{"_id": "ID", "a": "A"}); err != nil {
+		t.Fatal(err)
+	}
+	cached := doRequest(s, "GET", "/col/ID", nil, t).Header().Get("ETag")
+	// changed behind the cache, which keeps serving the old version
+	if err := backend.UpdateField(contextTest, "col", "ID", "a", "B"); err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range [][2]string{{"GET", "/col/ID"}, {"HEAD", "/col/ID"}, {"GET", "/col/ID/a"}} {
+		if etag := doRequest(s, req[0], req[1], nil, t).Header().Get("ETag"); etag != cached {
+			t.Errorf("%s %s: ETag: wanted %s of the cached entity, got %s", req[0], req[1], cached, etag)
+		}
+	}
+	// so a change made on the cached version cannot overwrite the newer one
+	recorder := doRequestHeader(s, "PUT", "/col/ID", http.Header{"If-Match": {cached}}, map[string]interface{}{"a": "C"}, t)
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Errorf("status code: wanted %d, got %d", http.StatusPreconditionFailed, recorder.Code)
+	}
+}
+
+func TestFieldArrayElements(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	ent := map[string]interface{}{"_id": "ID", "items": []interface{}{map[string]interface{}{"name": "a"}}}
+	if err := store.Save(contextTest, "col", ent); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		method, path string
+		body         interface{}
+		status       int
+	}{
+		{"GET", "/col/ID/items/0/name", nil, http.StatusOK},
+		{"GET", "/col/ID/items/1/name", nil, http.StatusNotFound},
+		{"PUT", "/col/ID/items/-", map[string]interface{}{"name": "b"}, http.StatusNoContent},
+		{"PUT", "/col/ID/items/1/name", "B", http.StatusNoContent},
+		{"PUT", "/col/ID/items/5", "X", http.StatusNotFound},
+		{"DELETE", "/col/ID/items/0", nil, http.StatusNoContent},
+		{"DELETE", "/col/ID/items/1", nil, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		recorder := doRequest(s, c.method, c.path, c.body, t)
+		if recorder.Code != c.status {
+			t.Errorf("%s %s: status code: wanted %d, got %d", c.method, c.path, c.status, recorder.Code)
+		}
+	}
+	res, err := store.FindByID(contextTest, "col", "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"_id": "ID", "items": []interface{}{map[string]interface{}{"name": "B"}}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestUpdateFieldOperator(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	if err := store.Save(contextTest, "col", map[string]interface{}{"_id": "ID", "n": 1.0, "s": "S"}); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path   string
+		body   interface{}
+		status int
+	}{
+		{"/col/ID/n", map[string]interface{}{"op": "inc", "value": 5}, http.StatusNoContent},
+		{"/col/ID/n", map[string]interface{}{"op": "dec", "value": 2}, http.StatusNoContent},
+		{"/col/ID/tags", map[string]interface{}{"op": "push", "value": "a"}, http.StatusNoContent},
+		{"/col/ID/s", map[string]interface{}{"op": "inc", "value": 1}, http.StatusConflict},
+		{"/col/ID/n", map[string]interface{}{"op": "unknown", "value": 1}, http.StatusBadRequest},
+		{"/col/missing/n", map[string]interface{}{"op": "inc", "value": 1}, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		recorder := doRequest(s, "POST", c.path, c.body, t)
+		if recorder.Code != c.status {
+			t.Errorf("POST %s %v: status code: wanted %d, got %d", c.path, c.body, c.status, recorder.Code)
+		}
+	}
+	res, err := store.FindByID(contextTest, "col", "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"_id": "ID", "n": 4.0, "s": "S", "tags": []interface{}{"a"}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestUpdateFieldParents(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	if err := store.Save(contextTest, "col", map[string]interface{}{"_id": "ID"}); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path   string
+		status int
+	}{
+		{"/col/ID/a/b", http.StatusConflict},
+		{"/col/ID/a/b?parents=true", http.StatusNoContent},
+		{"/col/ID/a/b/c?parents=true", http.StatusBadRequest},
+		{"/col/missing/a/b?parents=true", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		recorder := doRequest(s, "PUT", c.path, "V", t)
+		if recorder.Code != c.status {
+			t.Errorf("PUT %s: status code: wanted %d, got %d", c.path, c.status, recorder.Code)
+		}
+	}
+	res, err := store.FindByID(contextTest, "col", "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"_id": "ID", "a": map[string]interface{}{"b": "V"}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestCollectionMetadata(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	for _, id := range []string{"a", "b"} {
+		if err := store.Save(contextTest, "col", map[string]interface{}{"_id": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Save(contextTest, "other", map[string]interface{}{"_id": "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := doRequest(s, "GET", "/", nil, t)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusOK, recorder.Code)
+	}
+	var infos []CollectionInfo
+	if err := json.NewDecoder(recorder.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(`{"_id":"a","_rev":"012345678901234567890123"}`)) // as JSON, with its revision
+	expected := []CollectionInfo{{"col", 2, 2 * size}, {"other", 1, size}}
+	if !reflect.DeepEqual(infos, expected) {
+		t.Errorf("wanted %v, got %v", expected, infos)
+	}
+
+	cases := []struct {
+		path   string
+		status int
+		header string
+		value  string
+	}{
+		{"/col/", http.StatusOK, "X-Total-Count", "2"},
+		{"/missing/", http.StatusOK, "X-Total-Count", "0"},
+		{"/col/a", http.StatusOK, "ETag", ""},
+		{"/col/missing", http.StatusNotFound, "ETag", ""},
+	}
+	for _, c := range cases {
+		recorder := doRequest(s, "HEAD", c.path, nil, t)
+		if recorder.Code != c.status {
+			t.Errorf("HEAD %s: status code: wanted %d, got %d", c.path, c.status, recorder.Code)
+		}
+		value := recorder.Header().Get(c.header)
+		if c.value != "" && value != c.value {
+			t.Errorf("HEAD %s: %s: wanted %q, got %q", c.path, c.header, c.value, value)
+		}
+		if c.value == "" && (value != "") != (c.status == http.StatusOK) {
+			t.Errorf("HEAD %s: unexpected %s %q", c.path, c.header, value)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	for _, e := range []map[string]interface{}{
+		{"_id": "a", "city": "Madrid", "temperature": 20.0},
+		{"_id": "b", "city": "Madrid", "temperature": 30.0},
+		{"_id": "c", "city": "Oslo", "temperature": 5.0},
+	} {
+		if err := store.Save(contextTest, "col", e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pipeline := []interface{}{
+		map[string]interface{}{"group": map[string]interface{}{
+			"by":     "city",
+			"fields": map[string]interface{}{"n": "count()", "avg": "avg(temperature)"},
+		}},
+		map[string]interface{}{"sort": "-avg"},
+	}
+	recorder := doRequest(s, "POST", "/col/_aggregate", pipeline, t)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusOK, recorder.Code)
+	}
+	var res []map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]interface{}{
+		{"_id": "Madrid", "n": 2.0, "avg": 25.0},
+		{"_id": "Oslo", "n": 1.0, "avg": 5.0},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+
+	cases := []struct {
+		path   string
+		body   interface{}
+		status int
+	}{
+		{"/col/_aggregate", map[string]interface{}{"limit": 1}, http.StatusBadRequest},
+		{"/col/_aggregate", []interface{}{map[string]interface{}{"unknown": 1}}, http.StatusBadRequest},
+		{"/missing/_aggregate", []interface{}{}, http.StatusOK},
+		{"/col/a", map[string]interface{}{}, http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		recorder := doRequest(s, "POST", c.path, c.body, t)
+		if recorder.Code != c.status {
+			t.Errorf("POST %s %v: status code: wanted %d, got %d", c.path, c.body, c.status, recorder.Code)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	for _, e := range []map[string]interface{}{
+		{"_id": "a", "label": "very hot"},
+		{"_id": "b", "label": "hot hot"},
+		{"_id": "c", "label": "cold"},
+	} {
+		for _, col := range []string{"col", "unindexed"} {
+			if err := store.Save(contextTest, col, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := store.EnsureIndex(contextTest, "col", IndexSpec{Fields: []string{"label"}, Text: true}); err != nil {
+		t.Fatal(err)
+	}
+	recorder := doRequest(s, "GET", "/col/_search?q=hot&limit=1", nil, t)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusOK, recorder.Code)
+	}
+	var hits []SearchHit
+	if err := json.NewDecoder(recorder.Body).Decode(&hits); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"_id": "b", "label": "hot hot"}
+	if len(hits) != 1 || hits[0].Score <= 0 || !reflect.DeepEqual(hits[0].Entity, expected) {
+		t.Errorf("expected a hit for %v, got %v", expected, hits)
+	}
+
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/col/_search?q=", http.StatusBadRequest},
+		{"/col/_search?q=hot&limit=x", http.StatusBadRequest},
+		{"/missing/_search?q=hot", http.StatusBadRequest},
+		{"/unindexed/_search?q=hot", http.StatusBadRequest},
+	} {
+		recorder := doRequest(s, "GET", c.path, nil, t)
+		if recorder.Code != c.status {
+			t.Errorf("GET %s: status code: wanted %d, got %d", c.path, c.status, recorder.Code)
+		}
+	}
+}
+
+func TestGeo(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	for _, e := range []map[string]interface{}{
+		{"_id": "madrid", "at": map[string]interface{}{"lon": -3.7, "lat": 40.4}},
+		{"_id": "bilbao", "at": []interface{}{-2.9, 43.3}},
+		{"_id": "oslo", "at": map[string]interface{}{"lon": 10.7, "lat": 59.9}},
+	} {
+		if err := store.Save(contextTest, "col", e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if recorder := doRequest(s, "GET", "/col/_near?lon=-3.7&lat=40.4&radius=1000", nil, t); recorder.Code != http.StatusBadRequest {
+		t.Errorf("status code without index: wanted %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+	recorder := doRequest(s, "POST", "/col/_indexes", map[string]interface{}{"fields": []string{"at"}, "geo": true}, t)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusCreated, recorder.Code)
+	}
+
+	recorder = doRequest(s, "GET", "/col/_near?lon=-3.7&lat=40.4&radius=500000", nil, t)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusOK, recorder.Code)
+	}
+	var hits []GeoHit
+	if err := json.NewDecoder(recorder.Body).Decode(&hits); err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || hits[0].Entity["_id"] != "madrid" || hits[1].Entity["_id"] != "bilbao" || hits[1].Distance <= 0 {
+		t.Errorf("expected madrid and bilbao, got %v", hits)
+	}
+
+	recorder = doRequest(s, "GET", "/col/_within?box=-10,35,0,45", nil, t)
+	var ents []map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&ents); err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 2 || ents[0]["_id"] != "bilbao" || ents[1]["_id"] != "madrid" {
+		t.Errorf("expected bilbao and madrid, got %v", ents)
+	}
+
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/col/_near?lon=-3.7&lat=40.4", http.StatusBadRequest},
+		{"/col/_near?lon=-3.7&lat=140&radius=1", http.StatusBadRequest},
+		{"/col/_near?lon=-3.7&lat=40.4&radius=1&field=other", http.StatusBadRequest},
+		{"/col/_within?polygon=0,0,10,10,10,0&field=at", http.StatusOK},
+		{"/col/_within?polygon=0,0,10,10", http.StatusBadRequest},
+		{"/col/_within", http.StatusBadRequest},
+		{"/missing/_within?box=0,0,1,1", http.StatusBadRequest},
+		{"/missing/_within?box=0,0,1,1&field=at", http.StatusOK},
+	} {
+		recorder := doRequest(s, "GET", c.path, nil, t)
+		if recorder.Code != c.status {
+			t.Errorf("GET %s: status code: wanted %d, got %d", c.path, c.status, recorder.Code)
+		}
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store, nil)
+	if err := store.Save(contextTest, "col", map[string]interface{}{"_id": "a", "email": "a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := doRequest(s, "POST", "/col/_indexes", map[string]interface{}{"fields": []string{"email"}, "unique": true}, t)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusCreated, recorder.Code)
+	}
+	if location := recorder.Header().Get("Location"); location != "_indexes/email_1" {
+		t.Errorf("location: wanted %q, got %q", "_indexes/email_1", location)
+	}
+	recorder = doRequest(s, "GET", "/col/_indexes", nil, t)
+	var specs []IndexSpec
+	if err := json.NewDecoder(recorder.Body).Decode(&specs); err != nil {
+		t.Fatal(err)
+	}
+	expected := []IndexSpec{{Name: "email_1", Fields: []string{"email"}, Unique: true}}
+	if !reflect.DeepEqual(specs, expected) {
+		t.Errorf("expected %v, got %v", expected, specs)
+	}
+
+	cases := []struct {
+		method string
+		path   string
+		body   interface{}
+		status int
+	}{
+		{"PUT", "/col/b", map[string]interface{}{"email": "a@example.com"}, http.StatusConflict},
+		{"POST", "/col/_indexes", map[string]interface{}{"fields": []string{}}, http.StatusBadRequest},
+		{"POST", "/col/_indexes", []interface{}{}, http.StatusBadRequest},
+		{"POST", "/col/_indexes", map[string]interface{}{"name": "email_1", "fields": []string{"x"}}, http.StatusConflict},
+		{"DELETE", "/col/_indexes/email_1", nil, http.StatusNoContent},
+		{"DELETE", "/col/_indexes/email_1", nil, http.StatusNotFound},
+		{"PUT", "/col/b", map[string]interface{}{"email": "a@example.com"}, http.StatusCreated},
+	}
+	for _, c := range cases {
+		recorder := doRequest(s, c.method, c.path, c.body, t)
+		if recorder.Code != c.status {
+			t.Errorf("%s %s %v: status code: wanted %d, got %d", c.method, c.path, c.body, c.status, recorder.Code)
+		}
+	}
+}
+
+func TestNotImplemented(t *testing.T) {
+	// only the methods of Store, also behind a cache
+	backend := struct{ Store }{NewMemStore()}
+	for _, s := range []*Server{NewServer(backend, nil), NewServer(NewCachingStore(backend, 10, 0), nil)} {
+		testNotImplemented(s, t)
+	}
+}
+
+func testNotImplemented(s *Server, t *testing.T) {
+	for _, c := range []struct {
+		method, path string
+		body         interface{}
+		status       int
+	}{
+		{"POST", "/col/_aggregate", []interface{}{map[string]interface{}{"limit": 1}}, http.StatusNotImplemented},
+		{"GET", "/col/_search?q=hot", nil, http.StatusNotImplemented},
+		{"GET", "/col/_indexes", nil, http.StatusNotImplemented},
+		{"POST", "/col/_indexes", map[string]interface{}{"fields": []string{"a"}}, http.StatusNotImplemented},
+		{"DELETE", "/col/_indexes/a_1", nil, http.StatusNotImplemented},
+		{"GET", "/col/_near?lon=0&lat=0&radius=1&field=at", nil, http.StatusNotImplemented},
+		{"GET", "/col/_within?box=0,0,1,1&field=at", nil, http.StatusNotImplemented},
+		{"GET", "/", nil, http.StatusNotImplemented},
+		{"HEAD", "/col/", nil, http.StatusNotImplemented},
+		{"PUT", "/col/", []interface{}{map[string]interface{}{"_id": "a"}}, http.StatusNotImplemented},
+		{"DELETE", "/col/", nil, http.StatusNotImplemented},
+		{"GET", "/col/", nil, http.StatusOK},
+	} {
+		if got := doRequest(s, c.method, c.path, c.body, t).Code; got != c.status {
+			t.Errorf("%s %s: status code: wanted %d, got %d", c.method, c.path, c.status, got)
+		}
+	}
+}
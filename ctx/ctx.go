@@ -1,6 +1,7 @@
 package ctx
 
 import (
+	"context"
 	"fmt"
 	"log"
 )
@@ -16,6 +17,19 @@ type Ctx struct {
 	Debug       bool
 }
 
+type key struct{}
+
+// NewContext returns a copy of parent carrying c
+func NewContext(parent context.Context, c *Ctx) context.Context {
+	return context.WithValue(parent, key{}, c)
+}
+
+// FromContext returns the Ctx carried by c, if any
+func FromContext(c context.Context) (*Ctx, bool) {
+	cc, ok := c.Value(key{}).(*Ctx)
+	return cc, ok
+}
+
 func (c *Ctx) Infof(format string, args ...interface{}) {
 	f, a := c.addTransID(format, args)
 	c.InfoLogger.Printf(f, a...)
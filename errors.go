@@ -6,12 +6,21 @@ type Error struct {
 }
 
 var (
-	ErrExisting         = &Error{statusCode: 400, message: "existing id"}
-	ErrNotFound         = &Error{statusCode: 404, message: "not found"}
-	ErrTooMany          = &Error{statusCode: 400, message: "too many"}
-	ErrObjectExpected   = &Error{statusCode: 400, message: "expected object"}
-	ErrIdNotString      = &Error{statusCode: 500, message: "ID is not a string"}
-	ErrTraversingObject = &Error{statusCode: 400, message: "traversing object"}
+	ErrExisting           = &Error{statusCode: 409, message: "existing id"}
+	ErrNotFound           = &Error{statusCode: 404, message: "not found"}
+	ErrTooMany            = &Error{statusCode: 400, message: "too many"}
+	ErrObjectExpected     = &Error{statusCode: 400, message: "expected object"}
+	ErrArrayExpected      = &Error{statusCode: 400, message: "expected array"}
+	ErrIdNotString        = &Error{statusCode: 500, message: "ID is not a string"}
+	ErrTraversingObject   = &Error{statusCode: 400, message: "traversing object"}
+	ErrParentNotFound     = &Error{statusCode: 409, message: "parent field not found"}
+	ErrPreconditionFailed = &Error{statusCode: 412, message: "precondition failed"}
+	ErrConcurrentChange   = &Error{statusCode: 409, message: "entity changed concurrently, try again"}
+	ErrIndexOutOfRange    = &Error{statusCode: 404, message: "array index out of range"}
+	ErrReservedID         = &Error{statusCode: 400, message: "reserved ID"}
+
+	ErrUnsupportedMediaType = &Error{statusCode: 415, message: "unsupported media type"}
+	ErrNotImplemented       = &Error{statusCode: 501, message: "not implemented by the store"}
 )
 
 func (e *Error) Error() string {
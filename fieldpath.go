@@ -0,0 +1,185 @@
+package almacen
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Field paths are dotted, as in "items.3.name". On an array a segment is the index of an
+// element, or "-" for the position after the last one, where a new element is added. On an
+// object any segment is a key, so "3" is a field there.
+//
+// Changing a field whose parent object is missing is an ErrParentNotFound, unless the
+// parents are created. Going through any other value, or through an array with a segment
+// which is not an index, is an ErrTraversingObject.
+//
+// The traversal works on segments, so it is shared with the JSON Pointers of a JSON Patch,
+// once split by splitPointer.
+
+// lookupField returns the value at path, ErrNotFound if there is none
+func lookupField(root map[string]interface{}, path string) (interface{}, error) {
+	return lookupPath(root, strings.Split(path, "."))
+}
+
+// lookupPath returns the value at the segments of path, ErrNotFound if there is none, or
+// ErrIndexOutOfRange if an index is beyond the end of its array
+func lookupPath(v interface{}, path []string) (interface{}, error) {
+	for _, seg := range path {
+		var err error
+		if v, err = fieldChild(v, seg); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func fieldChild(v interface{}, seg string) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		child, found := v[seg]
+		if !found {
+			return nil, ErrNotFound
+		}
+		return child, nil
+	case []interface{}:
+		i, err := elementIndex(seg, len(v))
+		if err != nil {
+			return nil, err
+		}
+		return v[i], nil
+	}
+	return nil, ErrNotFound
+}
+
+// elementIndex parses the index of an element of an array of length n. A segment which
+// is not a number does not name any element
+func elementIndex(seg string, n int) (int, error) {
+	if seg == "-" {
+		return 0, ErrIndexOutOfRange
+	}
+	i, err := strconv.Atoi(seg)
+	if err != nil || strconv.Itoa(i) != seg {
+		return 0, ErrNotFound
+	}
+	if i < 0 || i >= n {
+		return 0, ErrIndexOutOfRange
+	}
+	return i, nil
+}
+
+// hasIndexSegment tells whether some segment of path could be an array index
+func hasIndexSegment(path string) bool {
+	for _, seg := range strings.Split(path, ".") {
+		if seg == "-" {
+			return true
+		}
+		if _, err := strconv.Atoi(seg); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isCoordinatePath tells whether path ends in the longitude or the latitude of a GeoPoint
+func isCoordinatePath(path string) bool {
+	last := path[strings.LastIndex(path, ".")+1:]
+	return last == "lon" || last == "lat"
+}
+
+// setField sets the value at path, replacing an element of an array or adding one at "-".
+// The objects and arrays on the way must exist
+func setField(root map[string]interface{}, path string, value interface{}) error {
+	return changeField(root, path, false, func(interface{}, bool) (interface{}, error) {
+		return copyValue(value), nil
+	})
+}
+
+// changeField sets the value at path to what fn makes of the current one, if found. With
+// parents, the missing objects on the way are created
+func changeField(root map[string]interface{}, path string, parents bool, fn func(old interface{}, found bool) (interface{}, error)) error {
+	_, err := fieldContainer(root, strings.Split(path, "."), parents, func(container interface{}, seg string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			old, found := c[seg]
+			value, err := fn(old, found)
+			if err != nil {
+				return nil, err
+			}
+			c[seg] = value
+			return c, nil
+		case []interface{}:
+			if seg == "-" {
+				value, err := fn(nil, false)
+				if err != nil {
+					return nil, err
+				}
+				return append(c, value), nil
+			}
+			i, err := elementIndex(seg, len(c))
+			if err != nil {
+				return nil, err
+			}
+			if c[i], err = fn(c[i], true); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+		return nil, ErrTraversingObject
+	})
+	if err == ErrNotFound {
+		return ErrTraversingObject
+	}
+	return err
+}
+
+// deleteField removes the value at path, shifting the next elements if it is in an array.
+// A missing field is not an error, an element out of range is
+func deleteField(root map[string]interface{}, path string) error {
+	_, err := fieldContainer(root, strings.Split(path, "."), false, func(container interface{}, seg string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			delete(c, seg)
+		case []interface{}:
+			i, err := elementIndex(seg, len(c))
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i:i], c[i+1:]...), nil
+		}
+		return container, nil
+	})
+	if err == ErrNotFound || err == ErrParentNotFound {
+		return nil
+	}
+	return err
+}
+
+// fieldContainer calls fn with the value holding the last of the segments, storing back
+// what fn returns, as arrays change when growing or shrinking. With parents, the missing
+// objects on the way are created
+func fieldContainer(v interface{}, path []string, parents bool, fn func(container interface{}, seg string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(v, path[0])
+	}
+	child, err := fieldChild(v, path[0])
+	if _, isObject := v.(map[string]interface{}); isObject && err == ErrNotFound {
+		if !parents {
+			return nil, ErrParentNotFound
+		}
+		child, err = map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if child, err = fieldContainer(child, path[1:], parents, fn); err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		v[path[0]] = child
+	case []interface{}:
+		i, _ := strconv.Atoi(path[0])
+		v[i] = child
+	}
+	return v, nil
+}
@@ -0,0 +1,421 @@
+package almacen
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+
+	DefaultSnapshotEvery = 1000
+)
+
+// FileStore is a MemStore made durable with a write-ahead log and periodic snapshots.
+// Every change is appended and fsync'd to the log before it is made in memory, and a
+// change which cannot be logged is not made. When the log reaches SnapshotEvery records,
+// the whole database is written to a new snapshot and the log is truncated. A snapshot
+// failure does not fail the change, it is reported to InfoLogger and tried again later.
+// Opening the store loads the snapshot and replays the log.
+//
+// Changes of different collections run concurrently, only writing the log is serialized,
+// and records written meanwhile share the fsync of the log (group commit). Those of a
+// collection are logged in the order they are made, as it is locked meanwhile.
+//
+// Entities go through encoding/json on disk, so after a restart every number is a float64.
+type FileStore struct {
+	*MemStore
+	SnapshotEvery int
+
+	dir string
+	mu  sync.RWMutex // held for reading by changes, for writing by snapshots, which need them done
+
+	walMu      sync.Mutex // the fields below
+	synced     *sync.Cond // signaled after every fsync of the log
+	wal        *os.File
+	size       int64  // of the log, up to the last record written
+	seq        uint64 // last record written
+	syncedSize int64  // of the log on disk
+	syncedSeq  uint64 // last record on disk
+	syncing    bool   // an fsync is running
+	failures   int    // fsyncs failed, removing the records not on disk yet
+	syncErr    error  // of the last failed fsync
+	pending    int    // records since last snapshot
+	broken     error  // a failed record could not be removed from the log, no change is logged any more
+}
+
+type walRecord struct {
+	Seq   uint64      `json:"seq"`
+	Op    string      `json:"op"`
+	Col   string      `json:"col"`
+	ID    string      `json:"id"`
+	Value interface{} `json:"value,omitempty"`
+	Index *IndexSpec  `json:"index,omitempty"`
+}
+
+type snapshot struct {
+	Seq     uint64                                       `json:"seq"`
+	DB      map[string]map[string]map[string]interface{} `json:"db"`
+	Indexes map[string][]IndexSpec                       `json:"indexes,omitempty"`
+}
+
+const (
+	opSave   = "save"
+	opDelete = "delete"
+	opLoad   = "load"
+	opDrop   = "drop"
+
+	opIndex     = "index"
+	opDropIndex = "dropindex" // only the name of the index
+)
+
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	fs := &FileStore{
+		MemStore:      NewMemStore(),
+		SnapshotEvery: DefaultSnapshotEvery,
+		dir:           dir,
+	}
+	if err := fs.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := fs.replay(); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	fs.wal, fs.size, fs.syncedSize, fs.syncedSeq = wal, info.Size(), info.Size(), fs.seq
+	fs.synced = sync.NewCond(&fs.walMu)
+	fs.MemStore.logChange = fs.append
+	return fs, nil
+}
+
+func (fs *FileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.wal.Close()
+}
+
+func (fs *FileStore) Save(ctx context.Context, collection string, ent map[string]interface{}) error {
+	return fs.change(func() error { return fs.MemStore.Save(ctx, collection, ent) })
+}
+
+func (fs *FileStore) Insert(ctx context.Context, collection string, ent map[string]interface{}) error {
+	return fs.change(func() error { return fs.MemStore.Insert(ctx, collection, ent) })
+}
+
+func (fs *FileStore) Replace(ctx context.Context, collection string, ent map[string]interface{}) error {
+	return fs.change(func() error { return fs.MemStore.Replace(ctx, collection, ent) })
+}
+
+func (fs *FileStore) Delete(ctx context.Context, collection, id string) error {
+	return fs.change(func() error { return fs.MemStore.Delete(ctx, collection, id) })
+}
+
+func (fs *FileStore) UpdateField(ctx context.Context, collection, id, field string, value interface{}) error {
+	return fs.change(func() error { return fs.MemStore.UpdateField(ctx, collection, id, field, value) })
+}
+
+func (fs *FileStore) DeleteField(ctx context.Context, collection, id, field string) error {
+	return fs.change(func() error { return fs.MemStore.DeleteField(ctx, collection, id, field) })
+}
+
+func (fs *FileStore) Update(ctx context.Context, collection, id string, u *Update) error {
+	return fs.change(func() error { return fs.MemStore.Update(ctx, collection, id, u) })
+}
+
+func (fs *FileStore) Patch(ctx context.Context, collection, id string, ops []PatchOp) error {
+	return fs.change(func() error { return fs.MemStore.Patch(ctx, collection, id, ops) })
+}
+
+func (fs *FileStore) ReplaceCollection(ctx context.Context, collection string, ents []map[string]interface{}) error {
+	return fs.change(func() error { return fs.MemStore.ReplaceCollection(ctx, collection, ents) })
+}
+
+func (fs *FileStore) DropCollection(ctx context.Context, collection string) error {
+	return fs.change(func() error { return fs.MemStore.DropCollection(ctx, collection) })
+}
+
+func (fs *FileStore) EnsureIndex(ctx context.Context, collection string, spec IndexSpec) error {
+	return fs.change(func() error { return fs.MemStore.EnsureIndex(ctx, collection, spec) })
+}
+
+func (fs *FileStore) DropIndex(ctx context.Context, collection, name string) error {
+	return fs.change(func() error { return fs.MemStore.DropIndex(ctx, collection, name) })
+}
+
+// change runs fn, a change of the MemStore, which logs it through append. Afterwards, it
+// takes a snapshot if it is due
+func (fs *FileStore) change(fn func() error) error {
+	fs.mu.RLock()
+	err := fn()
+	fs.mu.RUnlock()
+	if fs.snapshotDue() {
+		fs.mu.Lock()
+		if fs.snapshotDue() { // not taken meanwhile
+			if serr := fs.snapshot(); serr != nil {
+				// the log is still good, so try again after as many records
+				InfoLogger.Printf("snapshot of %s failed: %v", fs.dir, serr)
+				fs.walMu.Lock()
+				fs.pending = 0
+				fs.walMu.Unlock()
+			}
+		}
+		fs.mu.Unlock()
+	}
+	return err
+}
+
+func (fs *FileStore) snapshotDue() bool {
+	fs.walMu.Lock()
+	defer fs.walMu.Unlock()
+	return fs.SnapshotEvery > 0 && fs.pending >= fs.SnapshotEvery
+}
+
+// Snapshot writes the current state to disk and truncates the log.
+func (fs *FileStore) Snapshot() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.snapshot()
+}
+
+// append writes r to the log and waits for it to be on disk. Records written while an
+// fsync runs wait for the next one, which is made by any of their writers. If the write
+// fails, the log is truncated back to where it was, so a partial record is not left
+// before the next one. If the fsync fails, so are the records not on disk yet, as they
+// may be lost, and their changes are not made. It must be called with fs.mu held for
+// reading
+func (fs *FileStore) append(r *walRecord) error {
+	fs.walMu.Lock()
+	defer fs.walMu.Unlock()
+	if fs.broken != nil {
+		return fs.broken
+	}
+	r.Seq = fs.seq + 1
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err = fs.wal.Write(b); err != nil {
+		if terr := fs.wal.Truncate(fs.size); terr != nil {
+			fs.broken = terr
+		}
+		return err
+	}
+	fs.size += int64(len(b))
+	fs.seq = r.Seq
+	fs.pending++
+	end, failures := fs.size, fs.failures
+	for fs.syncedSize < end {
+		if fs.failures != failures {
+			return fs.syncErr // removed with the records of the failed fsync
+		}
+		if fs.syncing {
+			fs.synced.Wait()
+			continue
+		}
+		fs.syncing = true
+		size, seq := fs.size, fs.seq
+		fs.walMu.Unlock()
+		err = fs.wal.Sync()
+		fs.walMu.Lock()
+		fs.syncing = false
+		if err != nil {
+			if terr := fs.wal.Truncate(fs.syncedSize); terr != nil {
+				fs.broken = terr
+			}
+			fs.pending -= int(fs.seq - fs.syncedSeq)
+			fs.size, fs.seq = fs.syncedSize, fs.syncedSeq
+			fs.failures++
+			fs.syncErr = err
+		} else {
+			fs.syncedSize, fs.syncedSeq = size, seq
+		}
+		fs.synced.Broadcast()
+	}
+	return nil
+}
+
+// snapshot must be called with fs.mu held for writing, so every record logged is on disk
+// and its change made
+func (fs *FileStore) snapshot() error {
+	fs.walMu.Lock()
+	seq, broken := fs.seq, fs.broken
+	fs.walMu.Unlock()
+	if broken != nil {
+		return broken
+	}
+	b, err := json.Marshal(&snapshot{Seq: seq, DB: fs.MemStore.dump(), Indexes: fs.MemStore.indexSpecs()})
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(fs.dir, snapshotFileName)
+	tmp := name + ".tmp"
+	if err = writeFileSync(tmp, b); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return err
+	}
+	if err = syncDir(fs.dir); err != nil {
+		return err
+	}
+
+	// Records already in the snapshot are skipped on replay, so a crash
+	// before truncating the log is harmless
+	fs.walMu.Lock()
+	defer fs.walMu.Unlock()
+	if err = fs.wal.Truncate(0); err != nil {
+		return err
+	}
+	fs.size, fs.syncedSize = 0, 0
+	if err = fs.wal.Sync(); err != nil {
+		return err
+	}
+	fs.pending = 0
+	return nil
+}
+
+func (fs *FileStore) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(fs.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var s snapshot
+	if err = json.NewDecoder(f).Decode(&s); err != nil {
+		return err
+	}
+	fs.MemStore.load(s.DB)
+	for col, specs := range s.Indexes {
+		for _, spec := range specs {
+			fs.rebuildIndex(col, spec)
+		}
+	}
+	fs.seq = s.Seq
+	return nil
+}
+
+func (fs *FileStore) replay() error {
+	name := filepath.Join(fs.dir, walFileName)
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		ctx    = context.Background()
+		reader = bufio.NewReader(f)
+		good   int64 // offset after the last complete record
+	)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// torn write of the last record, it was never acknowledged
+				return f.Truncate(good)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var r walRecord
+		if err = json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		good += int64(len(line))
+		fs.pending++
+		if r.Seq <= fs.seq {
+			continue
+		}
+		fs.apply(ctx, &r)
+		fs.seq = r.Seq
+	}
+}
+
+func (fs *FileStore) apply(ctx context.Context, r *walRecord) {
+	// Errors are not possible here, the record was logged after checking the change
+	switch r.Op {
+	case opSave:
+		if ent, isObject := r.Value.(map[string]interface{}); isObject {
+			fs.MemStore.restore(r.Col, []map[string]interface{}{ent}, false)
+		}
+	case opDelete:
+		fs.MemStore.Delete(ctx, r.Col, r.ID)
+	case opLoad:
+		list, _ := r.Value.([]interface{})
+		ents := make([]map[string]interface{}, len(list))
+		for i, e := range list {
+			ents[i], _ = e.(map[string]interface{})
+		}
+		fs.MemStore.restore(r.Col, ents, true)
+	case opDrop:
+		fs.MemStore.DropCollection(ctx, r.Col)
+	case opIndex:
+		if r.Index != nil {
+			fs.rebuildIndex(r.Col, *r.Index)
+		}
+	case opDropIndex:
+		if r.Index != nil {
+			fs.MemStore.DropIndex(ctx, r.Col, r.Index.Name)
+		}
+	}
+}
+
+// rebuildIndex declares an index of the snapshot or the log. It could only fail if the
+// files were changed, as by hand, so the store is opened anyway, without the index
+func (fs *FileStore) rebuildIndex(collection string, spec IndexSpec) {
+	if err := fs.MemStore.EnsureIndex(context.Background(), collection, spec); err != nil {
+		InfoLogger.Printf("index %s of %s in %s not rebuilt: %v", spec.Name, collection, fs.dir, err)
+	}
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,438 @@
+package almacen
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fileStoreChanges applies some operations of every kind, leaving the store with the expected entities
+func fileStoreChanges(fs *FileStore, t *testing.T) map[string]map[string]interface{} {
+	ops := []func() error{
+		func() error {
+			return fs.Save(contextTest, collectionTest, map[string]interface{}{"_id": "a", "x": map[string]interface{}{"y": 1.0}})
+		},
+		func() error {
+			return fs.Save(contextTest, collectionTest, map[string]interface{}{"_id": "b", "label": "B"})
+		},
+		func() error { return fs.UpdateField(contextTest, collectionTest, "a", "x.z", "Z") },
+		func() error { return fs.DeleteField(contextTest, collectionTest, "a", "x.y") },
+		func() error { return fs.Delete(contextTest, collectionTest, "b") },
+		func() error {
+			return fs.Insert(contextTest, collectionTest, map[string]interface{}{"_id": "c", "n": 3.0})
+		},
+		func() error {
+			return fs.ReplaceCollection(contextTest, "replaced", []map[string]interface{}{{"_id": "r"}})
+		},
+		func() error { return fs.DropCollection(contextTest, "replaced") },
+		func() error {
+			return fs.ReplaceCollection(contextTest, collectionTest, []map[string]interface{}{
+				{"_id": "a", "x": map[string]interface{}{"y": 1.0}},
+				{"_id": "c", "n": 3.0},
+			})
+		},
+		func() error { return fs.UpdateField(contextTest, collectionTest, "a", "x.z", "Z") },
+		func() error { return fs.DeleteField(contextTest, collectionTest, "a", "x.y") },
+		func() error {
+			return fs.Update(contextTest, collectionTest, "c", &Update{Set: map[string]interface{}{"m.n": "N"}, Unset: []string{"n"}})
+		},
+		func() error {
+			return fs.Patch(contextTest, collectionTest, "c", []PatchOp{{Op: "move", From: "/m/n", Path: "/o"}})
+		},
+	}
+	for _, op := range ops {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return map[string]map[string]interface{}{
+		"a": {"_id": "a", "x": map[string]interface{}{"z": "Z"}},
+		"c": {"_id": "c", "m": map[string]interface{}{}, "o": "N"},
+	}
+}
+
+func checkFileStoreReopen(dir string, expected map[string]map[string]interface{}, t *testing.T) {
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	res, err := fs.FindAll(contextTest, collectionTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+	for _, e := range res {
+		if !reflect.DeepEqual(e, expected[e["_id"].(string)]) {
+			t.Errorf("expected %v, got %v", expected[e["_id"].(string)], e)
+		}
+	}
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almacen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.EnsureIndex(contextTest, collectionTest, IndexSpec{Fields: []string{"x.z", "o"}, Text: true}); err != nil {
+		t.Fatal(err)
+	}
+	expected := fileStoreChanges(fs, t)
+	fs.Close()
+
+	checkFileStoreReopen(dir, expected, t)
+
+	// the text index is rebuilt too
+	if fs, err = OpenFileStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	hits, err := fs.Search(contextTest, collectionTest, "z n", 0)
+	if err != nil || len(hits) != 2 {
+		t.Errorf("expected 2 hits, got %v %v", hits, err)
+	}
+}
+
+func TestFileStoreReopenRevisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almacen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileStoreChanges(fs, t)
+	revs := map[string]interface{}{}
+	for _, id := range []string{"a", "c"} {
+		if revs[id], err = fs.FindField(contextTest, collectionTest, id, RevField); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.Close()
+
+	if fs, err = OpenFileStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	for id, expected := range revs {
+		rev, err := fs.FindField(contextTest, collectionTest, id, RevField)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev != expected {
+			t.Errorf("%s: expected revision %v, got %v", id, expected, rev)
+		}
+	}
+}
+
+func TestFileStoreReopenIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almacen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileStoreChanges(fs, t)
+	specs := []IndexSpec{
+		{Name: "n_1", Fields: []string{"n"}},
+		{Name: "x", Fields: []string{"x.z"}, Unique: true},
+	}
+	for _, spec := range append(specs, IndexSpec{Name: "dropped", Fields: []string{"o"}}) {
+		if err = fs.EnsureIndex(contextTest, collectionTest, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = fs.DropIndex(contextTest, collectionTest, "dropped"); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	// from the log, and then from a snapshot
+	for i := 0; i < 2; i++ {
+		if fs, err = OpenFileStore(dir); err != nil {
+			t.Fatal(err)
+		}
+		res, err := fs.Indexes(contextTest, collectionTest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, specs) {
+			t.Errorf("expected %v, got %v", specs, res)
+		}
+		err = fs.Save(contextTest, collectionTest, map[string]interface{}{"_id": "d", "x": map[string]interface{}{"z": "Z"}})
+		if err != ErrDuplicateKey {
+			t.Errorf("expected %v, got %v", ErrDuplicateKey, err)
+		}
+		if err = fs.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+		fs.Close()
+	}
+}
+
+func TestFileStoreSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almacen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SnapshotEvery = 4
+	expected := fileStoreChanges(fs, t)
+	fs.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); err != nil {
+		t.Errorf("expected snapshot file, got %v", err)
+	}
+	checkFileStoreReopen(dir, expected, t)
+}
+
+func TestFileStoreSnapshotBeforeTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almacen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fileStoreChanges(fs, t)
+	wal, err := ioutil.ReadFile(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	// simulate a crash between writing the snapshot and truncating the log
+	if err = ioutil.WriteFile(filepath.Join(dir, walFileName), wal, 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkFileStoreReopen(dir, expected, t)
+}
+
+func TestFileStoreTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almacen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fileStoreChanges(fs, t)
+	fs.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":99,"op":"save","col":"collectionTest","id":"d","value":{"_i`)
+	f.Close()
+
+	checkFileStoreReopen(dir, expected, t)
+
+	// the torn record has been discarded and the log is usable again
+	fs, err = OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Save(contextTest, collectionTest, map[string]interface{}{"_id": "d"}); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+	expected["d"] = map[string]interface{}{"_id": "d"}
+	checkFileStoreReopen(dir, expected, t)
+}
+
+func TestFileStoreFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almacen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fileStoreChanges(fs, t)
+
+	// a log which cannot be written to, nor truncated
+	wal := fs.wal
+	if fs.wal, err = os.Open(filepath.Join(dir, walFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Save(contextTest, collectionTest, map[string]interface{}{"_id": "d"}); err == nil {
+		t.Error("expected error saving")
+	}
+	if err = fs.UpdateField(contextTest, collectionTest, "a", "x.z", "changed"); err == nil {
+		t.Error("expected error updating")
+	}
+	if err = fs.Delete(contextTest, collectionTest, "c"); err == nil {
+		t.Error("expected error deleting")
+	}
+	if err = fs.DropCollection(contextTest, collectionTest); err == nil {
+		t.Error("expected error dropping")
+	}
+	// nothing changed in memory either
+	for id, e := range expected {
+		if ent, err := fs.FindByID(contextTest, collectionTest, id); err != nil || !reflect.DeepEqual(ent, e) {
+			t.Errorf("expected %v, got %v, %v", e, ent, err)
+		}
+	}
+	if _, err = fs.FindByID(contextTest, collectionTest, "d"); err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+
+	// the log could not be truncated, so it is not written any more
+	fs.wal.Close()
+	fs.wal = wal
+	if err = fs.Save(contextTest, collectionTest, map[string]interface{}{"_id": "d"}); err == nil {
+		t.Error("expected error saving after a failed truncate")
+	}
+	fs.Close()
+	checkFileStoreReopen(dir, expected, t)
+}
+
+func TestFileStoreSnapshotFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almacen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the snapshot cannot be written where a directory is
+	if err = os.Mkdir(filepath.Join(dir, snapshotFileName+".tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SnapshotEvery = 2
+	expected := fileStoreChanges(fs, t) // fails on any error
+	if err = fs.Snapshot(); err == nil {
+		t.Error("expected error taking a snapshot")
+	}
+	fs.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); !os.IsNotExist(err) {
+		t.Errorf("expected no snapshot file, got %v", err)
+	}
+	checkFileStoreReopen(dir, expected, t)
+}
+
+func TestFileStoreConcurrentChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almacen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SnapshotEvery = 30
+	const collections, changes = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < collections; i++ {
+		wg.Add(1)
+		go func(col string) {
+			defer wg.Done()
+			for j := 0; j < changes; j++ {
+				ent := map[string]interface{}{"_id": fmt.Sprint(j), "n": float64(j)}
+				if err := fs.Save(contextTest, col, ent); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			// the records of a collection are replayed in order
+			if err := fs.DropCollection(contextTest, col); err != nil {
+				t.Error(err)
+			}
+			if err := fs.Save(contextTest, col, map[string]interface{}{"_id": "last"}); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprint("col", i))
+	}
+	wg.Wait()
+	fs.Close()
+
+	if fs, err = OpenFileStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	for i := 0; i < collections; i++ {
+		ents, err := fs.FindAll(contextTest, fmt.Sprint("col", i))
+		expected := []map[string]interface{}{{"_id": "last"}}
+		if err != nil || !reflect.DeepEqual(ents, expected) {
+			t.Errorf("col%d: expected %v, got %v %v", i, expected, ents, err)
+		}
+	}
+}
+
+func TestFileStoreIndexNotRebuilt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "almacen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	defer func(logger *log.Logger) { InfoLogger = logger }(InfoLogger)
+	InfoLogger = log.New(&buf, "", 0)
+
+	// changed by hand, so the unique index does not hold
+	snap := `{"seq": 1, "db": {"c": {"a": {"_id": "a", "k": 1}, "b": {"_id": "b", "k": 1}}},
+		"indexes": {"c": [{"name": "k_1", "fields": ["k"], "unique": true}]}}`
+	if err = ioutil.WriteFile(filepath.Join(dir, snapshotFileName), []byte(snap), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if n, err := fs.Count(contextTest, "c"); err != nil || n != 2 {
+		t.Errorf("expected 2 entities, got %d %v", n, err)
+	}
+	if specs, err := fs.Indexes(contextTest, "c"); err != nil || len(specs) != 0 {
+		t.Errorf("expected no indexes, got %v %v", specs, err)
+	}
+	if !strings.Contains(buf.String(), "index k_1 of c") {
+		t.Errorf("expected the index reported, got %q", buf.String())
+	}
+}
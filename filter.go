@@ -0,0 +1,467 @@
+package almacen
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Operators of a Filter
+const (
+	FilterAnd    = "and"
+	FilterOr     = "or"
+	FilterEq     = "eq"
+	FilterNe     = "ne"
+	FilterGt     = "gt"
+	FilterGte    = "gte"
+	FilterLt     = "lt"
+	FilterLte    = "lte"
+	FilterIn     = "in"
+	FilterExists = "exists"
+)
+
+// Filter is a condition on the entities, independent of the backend. And and Or combine
+// Filters. The rest compare Field, a dotted path, with Value, which is a string, a float64,
+// a bool or nil, a slice of them for In, or whether the field must be present for Exists.
+//
+// A field holding an array matches if any of its elements does, and a missing field is
+// equal to null, as in MongoDB.
+type Filter struct {
+	Op      string
+	Field   string
+	Value   interface{}
+	Filters []*Filter
+}
+
+func filterErr(msg string) error {
+	return &Error{statusCode: http.StatusBadRequest, message: "invalid filter: " + msg}
+}
+
+// ParseFilter parses expressions such as
+//
+//	location.lat>40 and (name="Madrid" or tags in ["a", "b"]) and exists(email)
+//
+// Comparison operators are =, !=, >, >=, < and <=. Values are JSON literals, or bare
+// words taken as strings. "and" binds tighter than "or". An empty expression is a nil Filter.
+func ParseFilter(s string) (*Filter, error) {
+	p := &filterParser{lex: filterLexer{src: s}}
+	p.next()
+	if p.tok.kind == tokEOF {
+		return nil, nil
+	}
+	f := p.parseOr()
+	if p.err == nil && p.tok.kind != tokEOF {
+		p.fail("unexpected " + p.tok.String())
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return f, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string // the string value for tokString
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of filter"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return "'" + t.text + "'"
+}
+
+type filterLexer struct {
+	src string // what is left to scan
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_-+.", r)
+}
+
+func (l *filterLexer) next() (token, error) {
+	l.src = strings.TrimLeftFunc(l.src, unicode.IsSpace)
+	if l.src == "" {
+		return token{kind: tokEOF}, nil
+	}
+	switch c := l.src[0]; {
+	case c == '"':
+		end := 1
+		for ; end < len(l.src) && l.src[end] != '"'; end++ {
+			if l.src[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(l.src) {
+			return token{}, filterErr("unterminated string")
+		}
+		var s string
+		if err := json.Unmarshal([]byte(l.src[:end+1]), &s); err != nil {
+			return token{}, filterErr("bad string " + l.src[:end+1])
+		}
+		l.src = l.src[end+1:]
+		return token{kind: tokString, text: s}, nil
+	case strings.HasPrefix(l.src, "!="), strings.HasPrefix(l.src, ">="), strings.HasPrefix(l.src, "<="):
+		t := token{kind: tokPunct, text: l.src[:2]}
+		l.src = l.src[2:]
+		return t, nil
+	case strings.IndexByte("()[],=<>!", c) >= 0:
+		t := token{kind: tokPunct, text: l.src[:1]}
+		l.src = l.src[1:]
+		return t, nil
+	}
+	end := strings.IndexFunc(l.src, func(r rune) bool { return !isWordRune(r) })
+	if end == 0 {
+		return token{}, filterErr("unexpected character " + strconv.QuoteRune([]rune(l.src)[0]))
+	}
+	if end < 0 {
+		end = len(l.src)
+	}
+	t := token{kind: tokWord, text: l.src[:end]}
+	l.src = l.src[end:]
+	return t, nil
+}
+
+// filterParser is a recursive descent parser. The first error stops it, later calls do nothing
+type filterParser struct {
+	lex filterLexer
+	tok token
+	err error
+}
+
+func (p *filterParser) fail(msg string) {
+	if p.err == nil {
+		p.err = filterErr(msg)
+	}
+	p.tok = token{kind: tokEOF}
+}
+
+func (p *filterParser) next() {
+	if p.err != nil {
+		return
+	}
+	tok, err := p.lex.next()
+	if err != nil {
+		p.err = err
+		tok = token{kind: tokEOF}
+	}
+	p.tok = tok
+}
+
+func (p *filterParser) is(kind tokenKind, text string) bool {
+	return p.tok.kind == kind && p.tok.text == text
+}
+
+func (p *filterParser) expect(text string) {
+	if !p.is(tokPunct, text) {
+		p.fail("expected '" + text + "', found " + p.tok.String())
+		return
+	}
+	p.next()
+}
+
+func (p *filterParser) parseOr() *Filter {
+	return p.parseList(FilterOr, p.parseAnd)
+}
+
+func (p *filterParser) parseAnd() *Filter {
+	return p.parseList(FilterAnd, p.parseTerm)
+}
+
+func (p *filterParser) parseList(op string, parseOperand func() *Filter) *Filter {
+	f := parseOperand()
+	if !p.is(tokWord, op) {
+		return f
+	}
+	list := &Filter{Op: op, Filters: []*Filter{f}}
+	for p.is(tokWord, op) {
+		p.next()
+		list.Filters = append(list.Filters, parseOperand())
+	}
+	return list
+}
+
+var comparisonOps = map[string]string{
+	"=":  FilterEq,
+	"!=": FilterNe,
+	">":  FilterGt,
+	">=": FilterGte,
+	"<":  FilterLt,
+	"<=": FilterLte,
+}
+
+func (p *filterParser) parseTerm() *Filter {
+	switch {
+	case p.is(tokPunct, "("):
+		p.next()
+		f := p.parseOr()
+		p.expect(")")
+		return f
+	case p.is(tokPunct, "!"):
+		p.next()
+		if !p.is(tokWord, "exists") {
+			p.fail("expected 'exists' after '!'")
+			return nil
+		}
+		f := p.parseTerm()
+		if f != nil {
+			f.Value = false
+		}
+		return f
+	case p.is(tokWord, "exists"):
+		p.next()
+		p.expect("(")
+		f := &Filter{Op: FilterExists, Field: p.parseField(), Value: true}
+		p.expect(")")
+		return f
+	}
+	field := p.parseField()
+	if p.is(tokWord, "in") {
+		p.next()
+		return &Filter{Op: FilterIn, Field: field, Value: p.parseValues()}
+	}
+	op, isComparison := comparisonOps[p.tok.text]
+	if p.tok.kind != tokPunct || !isComparison {
+		p.fail("expected comparison after " + strconv.Quote(field) + ", found " + p.tok.String())
+		return nil
+	}
+	p.next()
+	value := p.parseValue()
+	if value == nil && op != FilterEq && op != FilterNe {
+		p.fail("null can only be compared with = or !=")
+	}
+	return &Filter{Op: op, Field: field, Value: value}
+}
+
+func (p *filterParser) parseField() string {
+	if p.tok.kind != tokWord {
+		p.fail("expected field, found " + p.tok.String())
+		return ""
+	}
+	field := p.tok.text
+	if !validPath(field) {
+		p.fail("empty segment in field " + strconv.Quote(field))
+		return ""
+	}
+	p.next()
+	return field
+}
+
+// parseValues parses the values of an In
+func (p *filterParser) parseValues() []interface{} {
+	values := []interface{}{}
+	p.expect("[")
+	for p.err == nil && !p.is(tokPunct, "]") {
+		if len(values) > 0 {
+			p.expect(",")
+		}
+		values = append(values, p.parseValue())
+	}
+	p.expect("]")
+	return values
+}
+
+func (p *filterParser) parseValue() interface{} {
+	tok := p.tok
+	switch tok.kind {
+	case tokString:
+		p.next()
+		return tok.text
+	case tokWord:
+		p.next()
+		switch tok.text {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		if isNumber(tok.text) {
+			if n, err := strconv.ParseFloat(tok.text, 64); err == nil {
+				return n
+			}
+		}
+		return tok.text
+	}
+	p.fail("expected value, found " + tok.String())
+	return nil
+}
+
+// isNumber rules out what ParseFloat takes but JSON does not, as Inf or hexadecimal
+func isNumber(s string) bool {
+	return strings.Trim(s, "0123456789+-.eE") == ""
+}
+
+// match evaluates the filter against an entity, as MongoDB would
+func (f *Filter) match(ent map[string]interface{}) bool {
+	switch f.Op {
+	case FilterAnd:
+		for _, sub := range f.Filters {
+			if !sub.match(ent) {
+				return false
+			}
+		}
+		return true
+	case FilterOr:
+		for _, sub := range f.Filters {
+			if sub.match(ent) {
+				return true
+			}
+		}
+		return false
+	}
+
+	values, missing := resolvePath(ent, strings.Split(f.Field, "."))
+	switch f.Op {
+	case FilterExists:
+		return (len(values) > 0) == f.Value.(bool)
+	case FilterEq:
+		return matchEq(values, missing, f.Value)
+	case FilterNe:
+		return !matchEq(values, missing, f.Value)
+	case FilterIn:
+		for _, v := range f.Value.([]interface{}) {
+			if matchEq(values, missing, v) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range expandArrays(values) {
+		c, comparable := compareValues(v, f.Value)
+		if !comparable {
+			continue
+		}
+		switch {
+		case f.Op == FilterGt && c > 0,
+			f.Op == FilterGte && c >= 0,
+			f.Op == FilterLt && c < 0,
+			f.Op == FilterLte && c <= 0:
+			return true
+		}
+	}
+	return false
+}
+
+func matchEq(values []interface{}, missing bool, want interface{}) bool {
+	if want == nil && missing {
+		return true
+	}
+	for _, v := range expandArrays(values) {
+		if c, comparable := compareValues(v, want); comparable && c == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath returns the values found following path, which goes into every
+// element of the arrays on its way, and whether it is missing in some branch
+func resolvePath(v interface{}, path []string) (values []interface{}, missing bool) {
+	if len(path) == 0 {
+		return []interface{}{v}, false
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		child, found := v[path[0]]
+		if !found {
+			return nil, true
+		}
+		return resolvePath(child, path[1:])
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i < 0 || i >= len(v) {
+				return nil, true
+			}
+			return resolvePath(v[i], path[1:])
+		}
+		for _, elem := range v {
+			if _, isObject := elem.(map[string]interface{}); !isObject {
+				missing = true
+				continue
+			}
+			found, m := resolvePath(elem, path)
+			values = append(values, found...)
+			missing = missing || m
+		}
+		return values, missing
+	}
+	return nil, true
+}
+
+// expandArrays adds the elements of the arrays among values
+func expandArrays(values []interface{}) []interface{} {
+	expanded := append([]interface{}{}, values...)
+	for _, v := range values {
+		if array, isArray := v.([]interface{}); isArray {
+			expanded = append(expanded, array...)
+		}
+	}
+	return expanded
+}
+
+// compareValues orders scalars of the same kind. Values of different kinds are not comparable
+func compareValues(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case nil:
+		return 0, b == nil
+	case string:
+		if b, isString := b.(string); isString {
+			return strings.Compare(a, b), true
+		}
+	case bool:
+		if b, isBool := b.(bool); isBool {
+			switch {
+			case a == b:
+				return 0, true
+			case b:
+				return -1, true
+			}
+			return 1, true
+		}
+	default:
+		x, isNumber := toFloat(a)
+		y, isNumberB := toFloat(b)
+		if isNumber && isNumberB {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
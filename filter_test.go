@@ -0,0 +1,78 @@
+package almacen
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseFilter(t *testing.T) {
+	for _, c := range []struct {
+		s      string
+		wanted *Filter
+	}{
+		{"", nil},
+		{"  ", nil},
+		{`a=1`, &Filter{Op: FilterEq, Field: "a", Value: 1.0}},
+		{`a.b != "x y"`, &Filter{Op: FilterNe, Field: "a.b", Value: "x y"}},
+		{`a>=-2.5e1`, &Filter{Op: FilterGte, Field: "a", Value: -25.0}},
+		{`a<Inf`, &Filter{Op: FilterLt, Field: "a", Value: "Inf"}},
+		{`a=null`, &Filter{Op: FilterEq, Field: "a", Value: nil}},
+		{`a="null"`, &Filter{Op: FilterEq, Field: "a", Value: "null"}},
+		{`a in [1, "b", true]`, &Filter{Op: FilterIn, Field: "a", Value: []interface{}{1.0, "b", true}}},
+		{`exists(a.b)`, &Filter{Op: FilterExists, Field: "a.b", Value: true}},
+		{`!exists(a)`, &Filter{Op: FilterExists, Field: "a", Value: false}},
+		{`a=1 or b=2 and c=3`, &Filter{Op: FilterOr, Filters: []*Filter{
+			{Op: FilterEq, Field: "a", Value: 1.0},
+			{Op: FilterAnd, Filters: []*Filter{
+				{Op: FilterEq, Field: "b", Value: 2.0},
+				{Op: FilterEq, Field: "c", Value: 3.0},
+			}},
+		}}},
+		{`(a=1 or b=2) and c=3`, &Filter{Op: FilterAnd, Filters: []*Filter{
+			{Op: FilterOr, Filters: []*Filter{
+				{Op: FilterEq, Field: "a", Value: 1.0},
+				{Op: FilterEq, Field: "b", Value: 2.0},
+			}},
+			{Op: FilterEq, Field: "c", Value: 3.0},
+		}}},
+	} {
+		f, err := ParseFilter(c.s)
+		if err != nil {
+			t.Errorf("%q: %v", c.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(f, c.wanted) {
+			t.Errorf("%q: wanted %#v, got %#v", c.s, c.wanted, f)
+		}
+	}
+}
+
+func TestParseFilterErr(t *testing.T) {
+	for _, s := range []string{
+		`a`, `a=`, `=1`, `a==1`, `a=1 and`, `(a=1`, `a=1)`, `a="x`, `a.=1`,
+		`a in 1`, `a in [1,]`, `a in [1 2]`, `exists a`, `!a=1`, `a>null`, `a=1 $`,
+	} {
+		if f, err := ParseFilter(s); err == nil {
+			t.Errorf("%q: wanted error, got %#v", s, f)
+		}
+	}
+}
+
+func TestMongoFilter(t *testing.T) {
+	f, err := ParseFilter(`a.b>1 and (c in [x] or !exists(d))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := bson.M{"$and": []bson.M{
+		{"a.b": bson.M{"$gt": 1.0}},
+		{"$or": []bson.M{
+			{"c": bson.M{"$in": []interface{}{"x"}}},
+			{"d": bson.M{"$exists": false}},
+		}},
+	}}
+	if got := mongoFilter(f); !reflect.DeepEqual(got, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, got)
+	}
+}
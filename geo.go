@@ -0,0 +1,391 @@
+package almacen
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GeoPoint is a position in degrees. In entities, a field with a geo index holds it as
+// {"lon": x, "lat": y}, as [x, y] or as a GeoJSON Point
+type GeoPoint struct {
+	Lon float64 `json:"lon"`
+	Lat float64 `json:"lat"`
+}
+
+// GeoArea is a box, from its south-west corner to its north-east one, or a polygon. Both
+// are on the sphere, as MongoDB takes a GeoJSON Polygon: edges are the shortest arcs
+// between their vertices, and the area must be smaller than a hemisphere. The edges of a
+// box along the parallels are split every 90 degrees of longitude at most, so they do
+// not go the other way around the Earth, but they still bend towards the pole
+type GeoArea struct {
+	Box     []GeoPoint // two corners
+	Polygon []GeoPoint // three or more vertices
+}
+
+// GeoHit is an entity found near a point, at Distance meters
+type GeoHit struct {
+	Distance float64                `json:"distance"`
+	Entity   map[string]interface{} `json:"entity"`
+}
+
+var (
+	ErrNoGeoIndex      = &Error{statusCode: http.StatusBadRequest, message: "no geo index on the field"}
+	ErrInvalidLocation = &Error{statusCode: http.StatusBadRequest, message: "invalid location, expected longitude and latitude in degrees"}
+)
+
+func geoErr(msg string) error {
+	return &Error{statusCode: http.StatusBadRequest, message: "invalid geo query: " + msg}
+}
+
+// earthRadius is the one of MongoDB, in meters, so distances are the same
+const earthRadius = 6378100.0
+
+func (p GeoPoint) valid() bool {
+	return p.Lon >= -180 && p.Lon <= 180 && p.Lat >= -90 && p.Lat <= 90
+}
+
+// haversine returns the distance in meters along the surface of the Earth
+func haversine(a, b GeoPoint) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat, dLon := lat2-lat1, (b.Lon-a.Lon)*math.Pi/180
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// geoPoint reads a point as an entity holds it
+func geoPoint(v interface{}) (GeoPoint, bool) {
+	var p GeoPoint
+	var isLon, isLat bool
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v["type"] == "Point" {
+			return geoPoint(v["coordinates"])
+		}
+		if len(v) != 2 {
+			return p, false
+		}
+		p.Lon, isLon = toFloat(v["lon"])
+		p.Lat, isLat = toFloat(v["lat"])
+	case []interface{}:
+		if len(v) != 2 {
+			return p, false
+		}
+		p.Lon, isLon = toFloat(v[0])
+		p.Lat, isLat = toFloat(v[1])
+	}
+	return p, isLon && isLat && p.valid()
+}
+
+// entityPoint reads the point at field. found is false if the field is missing or null
+func entityPoint(ent map[string]interface{}, field string) (p GeoPoint, found bool, err error) {
+	v, err := lookupField(ent, field)
+	if err != nil || v == nil {
+		return p, false, nil
+	}
+	if p, found = geoPoint(v); !found {
+		return p, true, ErrInvalidLocation
+	}
+	return p, true, nil
+}
+
+// parseGeoPoints reads points like "lon,lat,lon,lat"
+func parseGeoPoints(s string) ([]GeoPoint, error) {
+	parts := strings.Split(s, ",")
+	if len(parts)%2 != 0 {
+		return nil, geoErr("expected pairs of longitude and latitude")
+	}
+	points := make([]GeoPoint, len(parts)/2)
+	for i := range points {
+		var err1, err2 error
+		points[i].Lon, err1 = strconv.ParseFloat(parts[2*i], 64)
+		points[i].Lat, err2 = strconv.ParseFloat(parts[2*i+1], 64)
+		if err1 != nil || err2 != nil {
+			return nil, ErrInvalidLocation
+		}
+	}
+	return points, nil
+}
+
+// parseNear reads the lon, lat and radius parameters of a query
+func parseNear(values url.Values) (center GeoPoint, radius float64, err error) {
+	var err1, err2 error
+	center.Lon, err1 = strconv.ParseFloat(values.Get("lon"), 64)
+	center.Lat, err2 = strconv.ParseFloat(values.Get("lat"), 64)
+	if err1 != nil || err2 != nil {
+		return center, 0, ErrInvalidLocation
+	}
+	if radius, err = strconv.ParseFloat(values.Get("radius"), 64); err != nil {
+		return center, 0, geoErr("radius must be positive")
+	}
+	return center, radius, checkNear(center, radius)
+}
+
+// parseGeoArea reads the box parameter of a query, like "minLon,minLat,maxLon,maxLat", or
+// the polygon one, with the vertices like "lon,lat,lon,lat,lon,lat"
+func parseGeoArea(values url.Values) (*GeoArea, error) {
+	var (
+		area GeoArea
+		err  error
+	)
+	if box := values.Get("box"); box != "" {
+		if area.Box, err = parseGeoPoints(box); err != nil {
+			return nil, err
+		}
+	}
+	if polygon := values.Get("polygon"); polygon != "" {
+		if area.Polygon, err = parseGeoPoints(polygon); err != nil {
+			return nil, err
+		}
+	}
+	if area.Box == nil && area.Polygon == nil {
+		return nil, geoErr("expected a box or a polygon")
+	}
+	return &area, area.check()
+}
+
+func checkNear(center GeoPoint, radius float64) error {
+	if !center.valid() {
+		return ErrInvalidLocation
+	}
+	if !(radius > 0) {
+		return geoErr("radius must be positive")
+	}
+	return nil
+}
+
+func (a *GeoArea) check() error {
+	points := a.Polygon
+	switch {
+	case a.Box != nil && a.Polygon != nil:
+		return geoErr("either a box or a polygon")
+	case a.Box != nil:
+		if len(a.Box) != 2 || a.Box[0].Lon >= a.Box[1].Lon || a.Box[0].Lat >= a.Box[1].Lat {
+			return geoErr("a box needs its south-west and north-east corners")
+		}
+		points = a.Box
+	case len(a.Polygon) < 3:
+		return geoErr("a polygon needs three vertices at least")
+	}
+	for _, p := range points {
+		if !p.valid() {
+			return ErrInvalidLocation
+		}
+	}
+	return nil
+}
+
+// ring returns the vertices of the area, not closed
+func (a *GeoArea) ring() []GeoPoint {
+	if a.Box == nil {
+		return a.Polygon
+	}
+	sw, ne := a.Box[0], a.Box[1]
+	n := int(math.Ceil((ne.Lon - sw.Lon) / 90))
+	ring := make([]GeoPoint, 0, 2*n+2)
+	for i := 0; i <= n; i++ {
+		ring = append(ring, GeoPoint{sw.Lon + (ne.Lon-sw.Lon)*float64(i)/float64(n), sw.Lat})
+	}
+	for i := n; i >= 0; i-- {
+		ring = append(ring, GeoPoint{sw.Lon + (ne.Lon-sw.Lon)*float64(i)/float64(n), ne.Lat})
+	}
+	return ring
+}
+
+// bounds returns the corners of a box around the area, every longitude if it goes
+// across the antimeridian or around a pole
+func (a *GeoArea) bounds() (sw, ne GeoPoint) {
+	ring := a.ring()
+	sw, ne = ring[0], ring[0]
+	wraps := false
+	for i, u := range ring {
+		w := ring[(i+1)%len(ring)]
+		sw.Lon, sw.Lat = math.Min(sw.Lon, u.Lon), math.Min(sw.Lat, u.Lat)
+		ne.Lon, ne.Lat = math.Max(ne.Lon, u.Lon), math.Max(ne.Lat, u.Lat)
+		wraps = wraps || math.Abs(w.Lon-u.Lon) >= 180
+		// an edge goes further from the equator than its ends
+		if lat, found := arcExtreme(u, w, 1); found {
+			ne.Lat = math.Max(ne.Lat, lat)
+		}
+		if lat, found := arcExtreme(u, w, -1); found {
+			sw.Lat = math.Min(sw.Lat, lat)
+		}
+	}
+	if a.contains(GeoPoint{0, 90}) {
+		ne.Lat, wraps = 90, true
+	}
+	if a.contains(GeoPoint{0, -90}) {
+		sw.Lat, wraps = -90, true
+	}
+	if wraps {
+		sw.Lon, ne.Lon = -180, 180
+	}
+	return sw, ne
+}
+
+// arcExtreme returns the latitude of the point of the shortest arc from u to w furthest to
+// the north, or to the south with a negative sign, if it is not one of the ends
+func arcExtreme(u, w GeoPoint, sign float64) (float64, bool) {
+	n := u.vector().cross(w.vector())
+	norm := math.Sqrt(n.dot(n))
+	if norm < 1e-12 {
+		return 0, false
+	}
+	// the pole, less its component out of the plane of the arc
+	q := vec3{0, 0, sign}
+	q = q.sub(n.scale(q.dot(n) / (norm * norm)))
+	qn := math.Sqrt(q.dot(q))
+	if qn < 1e-12 {
+		return 0, false // the arc is on the equator
+	}
+	q = q.scale(1 / qn)
+	if u.vector().cross(q).dot(n) < 0 || q.cross(w.vector()).dot(n) < 0 {
+		return 0, false
+	}
+	return math.Asin(q[2]) * 180 / math.Pi, true
+}
+
+// contains tells whether p is on the smaller side of the edges, as MongoDB takes a polygon.
+// It counts the edges crossed on the way from a point just to the left of the first edge
+func (a *GeoArea) contains(p GeoPoint) bool {
+	points := a.ring()
+	ring := make([]vec3, len(points))
+	for i, q := range points {
+		ring[i] = q.vector()
+	}
+	// the turns add up to 2π less the area on the left, which is the smaller side if they
+	// are to the left
+	turns := 0.0
+	for i, v := range ring {
+		u, w := ring[(i+len(ring)-1)%len(ring)], ring[(i+1)%len(ring)]
+		n1, n2 := u.cross(v), v.cross(w)
+		turns += math.Atan2(n1.cross(n2).dot(v), n1.dot(n2))
+	}
+	leftSmaller := turns >= 0
+	n := ring[0].cross(ring[1])
+	start := ring[0].add(ring[1]).unit().add(n.unit().scale(1e-9)).unit()
+	v := p.vector()
+	left := true
+	for i, u := range ring {
+		if crosses(start, v, u, ring[(i+1)%len(ring)]) {
+			left = !left
+		}
+	}
+	return left == leftSmaller
+}
+
+// crosses tells whether the shortest arcs from a to b and from c to d cross
+func crosses(a, b, c, d vec3) bool {
+	ab := a.cross(b)
+	acb, bda := -ab.dot(c), ab.dot(d)
+	if acb*bda <= 0 {
+		return false
+	}
+	cd := c.cross(d)
+	cbd, dac := -cd.dot(b), cd.dot(a)
+	return acb*cbd > 0 && acb*dac > 0
+}
+
+// vec3 is a point of the unit sphere, or any vector
+type vec3 [3]float64
+
+func (p GeoPoint) vector() vec3 {
+	lon, lat := p.Lon*math.Pi/180, p.Lat*math.Pi/180
+	return vec3{math.Cos(lat) * math.Cos(lon), math.Cos(lat) * math.Sin(lon), math.Sin(lat)}
+}
+
+func (a vec3) add(b vec3) vec3      { return vec3{a[0] + b[0], a[1] + b[1], a[2] + b[2]} }
+func (a vec3) sub(b vec3) vec3      { return vec3{a[0] - b[0], a[1] - b[1], a[2] - b[2]} }
+func (a vec3) scale(k float64) vec3 { return vec3{a[0] * k, a[1] * k, a[2] * k} }
+func (a vec3) dot(b vec3) float64   { return a[0]*b[0] + a[1]*b[1] + a[2]*b[2] }
+func (a vec3) unit() vec3           { return a.scale(1 / math.Sqrt(a.dot(a))) }
+func (a vec3) cross(b vec3) vec3 {
+	return vec3{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+// A geo memIndex keeps the entities by the cell of a grid holding their point
+const geoCellSize = 0.1 // degrees
+
+func geoCell(p GeoPoint) string {
+	return fmt.Sprintf("%d,%d", cellIndex(p.Lon), cellIndex(p.Lat))
+}
+
+func cellIndex(degrees float64) int {
+	return int(math.Floor(degrees / geoCellSize))
+}
+
+// cellIDs returns the IDs in the cells between the corners. If there are fewer cells in
+// the index than in the box, it goes through the index
+func (ix *memIndex) cellIDs(sw, ne GeoPoint) map[string]bool {
+	ids := map[string]bool{}
+	x0, x1, y0, y1 := cellIndex(sw.Lon), cellIndex(ne.Lon), cellIndex(sw.Lat), cellIndex(ne.Lat)
+	if (x1-x0+1)*(y1-y0+1) > len(ix.ids) {
+		for cell, cellIDs := range ix.ids {
+			var x, y int
+			fmt.Sscanf(cell, "%d,%d", &x, &y)
+			if x >= x0 && x <= x1 && y >= y0 && y <= y1 {
+				for id := range cellIDs {
+					ids[id] = true
+				}
+			}
+		}
+		return ids
+	}
+	for x := x0; x <= x1; x++ {
+		for y := y0; y <= y1; y++ {
+			for id := range ix.ids[fmt.Sprintf("%d,%d", x, y)] {
+				ids[id] = true
+			}
+		}
+	}
+	return ids
+}
+
+// nearIDs returns the IDs in the cells which could be within radius meters of center
+func (ix *memIndex) nearIDs(center GeoPoint, radius float64) map[string]bool {
+	d := radius / earthRadius // radians
+	minLat, maxLat := center.Lat-d*180/math.Pi, center.Lat+d*180/math.Pi
+	if minLat <= -90 || maxLat >= 90 {
+		// around a pole, every longitude
+		return ix.cellIDs(GeoPoint{-180, math.Max(minLat, -90)}, GeoPoint{180, math.Min(maxLat, 90)})
+	}
+	dLon := math.Asin(math.Min(1, math.Sin(d)/math.Cos(center.Lat*math.Pi/180))) * 180 / math.Pi
+	minLon, maxLon := center.Lon-dLon, center.Lon+dLon
+	ids := ix.cellIDs(GeoPoint{math.Max(minLon, -180), minLat}, GeoPoint{math.Min(maxLon, 180), maxLat})
+	// across the antimeridian
+	var more map[string]bool
+	switch {
+	case minLon < -180:
+		more = ix.cellIDs(GeoPoint{minLon + 360, minLat}, GeoPoint{180, maxLat})
+	case maxLon > 180:
+		more = ix.cellIDs(GeoPoint{-180, minLat}, GeoPoint{maxLon - 360, maxLat})
+	}
+	for id := range more {
+		ids[id] = true
+	}
+	return ids
+}
+
+// geoIndex returns the geo index on field, nil if there is none. It must be called with col.mu held
+func (col *memCollection) geoIndex(field string) *memIndex {
+	for _, ix := range col.indexes {
+		if ix.spec.Geo && ix.spec.Fields[0] == field {
+			return ix
+		}
+	}
+	return nil
+}
+
+// sortGeoHits orders by distance, and then by ID
+func sortGeoHits(hits []GeoHit) {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Distance != hits[j].Distance {
+			return hits[i].Distance < hits[j].Distance
+		}
+		return hits[i].Entity["_id"].(string) < hits[j].Entity["_id"].(string)
+	})
+}
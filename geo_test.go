@@ -0,0 +1,168 @@
+package almacen
+
+import (
+	"math"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestHaversine(t *testing.T) {
+	for _, c := range []struct {
+		a, b   GeoPoint
+		wanted float64
+	}{
+		{GeoPoint{-3.7, 40.4}, GeoPoint{-3.7, 40.4}, 0},
+		{GeoPoint{0, 0}, GeoPoint{0, 1}, earthRadius * math.Pi / 180},
+		{GeoPoint{179.5, 0}, GeoPoint{-179.5, 0}, earthRadius * math.Pi / 180},
+		{GeoPoint{0, 90}, GeoPoint{0, -90}, earthRadius * math.Pi},
+	} {
+		if got := haversine(c.a, c.b); math.Abs(got-c.wanted) > 1e-6 {
+			t.Errorf("%v %v: wanted %v, got %v", c.a, c.b, c.wanted, got)
+		}
+	}
+}
+
+func TestGeoPoint(t *testing.T) {
+	for _, c := range []struct {
+		v      interface{}
+		wanted bool
+	}{
+		{map[string]interface{}{"lon": -3.7, "lat": 40.4}, true},
+		{[]interface{}{-3.7, 40.4}, true},
+		{map[string]interface{}{"type": "Point", "coordinates": []interface{}{-3.7, 40.4}}, true},
+		{map[string]interface{}{"lon": 1, "lat": 2}, true},
+		{map[string]interface{}{"lon": -3.7, "lat": 40.4, "alt": 600.0}, false},
+		{map[string]interface{}{"lon": -3.7}, false},
+		{map[string]interface{}{"lon": "-3.7", "lat": 40.4}, false},
+		{[]interface{}{-3.7, 91.0}, false},
+		{[]interface{}{181.0, 0.0}, false},
+		{"here", false},
+	} {
+		if _, got := geoPoint(c.v); got != c.wanted {
+			t.Errorf("%v: wanted %v, got %v", c.v, c.wanted, got)
+		}
+	}
+}
+
+func TestMemIndexNear(t *testing.T) {
+	docs := map[string]map[string]interface{}{
+		"east": {"p": []interface{}{179.95, 0.0}},
+		"west": {"p": []interface{}{-179.95, 0.0}},
+		"pole": {"p": []interface{}{90.0, 89.99}},
+		"far":  {"p": []interface{}{0.0, 0.0}},
+		"none": {},
+	}
+	ix, err := newMemIndex(IndexSpec{Fields: []string{"p"}, Geo: true}, docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		center GeoPoint
+		radius float64
+		wanted map[string]bool
+	}{
+		{GeoPoint{180, 0}, 20e3, map[string]bool{"east": true, "west": true}},
+		{GeoPoint{-90, 89.99}, 5e3, map[string]bool{"pole": true}},
+		{GeoPoint{10, 10}, 1e3, map[string]bool{}},
+	} {
+		if got := ix.nearIDs(c.center, c.radius); !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("%v %v: wanted %v, got %v", c.center, c.radius, c.wanted, got)
+		}
+	}
+	if _, err = newMemIndex(ix.spec, map[string]map[string]interface{}{"x": {"p": "here"}}); err != ErrInvalidLocation {
+		t.Errorf("wanted %v, got %v", ErrInvalidLocation, err)
+	}
+}
+
+func TestGeoAreaContains(t *testing.T) {
+	// a concave polygon, like a C
+	area := &GeoArea{Polygon: []GeoPoint{{0, 0}, {3, 0}, {3, 1}, {1, 1}, {1, 2}, {3, 2}, {3, 3}, {0, 3}}}
+	for _, c := range []struct {
+		p      GeoPoint
+		wanted bool
+	}{
+		{GeoPoint{0.5, 1.5}, true},
+		{GeoPoint{2, 0.5}, true},
+		{GeoPoint{2, 1.5}, false},
+		{GeoPoint{4, 1}, false},
+	} {
+		if got := area.contains(c.p); got != c.wanted {
+			t.Errorf("%v: wanted %v, got %v", c.p, c.wanted, got)
+		}
+	}
+}
+
+func TestGeoAreaSphere(t *testing.T) {
+	for _, c := range []struct {
+		area    *GeoArea
+		in, out []GeoPoint
+	}{
+		// the edges bend towards the pole, up to 59.3 and 67.8 degrees at 45
+		{&GeoArea{Polygon: []GeoPoint{{0, 50}, {90, 50}, {90, 60}, {0, 60}}}, []GeoPoint{{45, 62}, {45, 65}}, []GeoPoint{{45, 70}, {45, 55}, {-1, 55}}},
+		// the same clockwise is the same area
+		{&GeoArea{Polygon: []GeoPoint{{0, 60}, {90, 60}, {90, 50}, {0, 50}}}, []GeoPoint{{45, 62}}, []GeoPoint{{45, 70}, {-135, -55}}},
+		// across the antimeridian
+		{&GeoArea{Polygon: []GeoPoint{{170, -10}, {-170, -10}, {-170, 10}, {170, 10}}}, []GeoPoint{{180, 0}, {-175, 5}, {175, -5}}, []GeoPoint{{0, 0}, {160, 0}}},
+		// a long and narrow box, not across the antimeridian
+		{&GeoArea{Box: []GeoPoint{{-170, 0}, {170, 10}}}, []GeoPoint{{0, 5}, {-165, 5}, {165, 5}}, []GeoPoint{{175, 5}, {0, -5}}},
+		// around the north pole
+		{&GeoArea{Polygon: []GeoPoint{{0, 80}, {120, 80}, {-120, 80}}}, []GeoPoint{{0, 90}, {60, 85}}, []GeoPoint{{0, 70}, {0, -90}}},
+	} {
+		sw, ne := c.area.bounds()
+		for _, p := range c.in {
+			if !c.area.contains(p) {
+				t.Errorf("%+v: wanted %v inside", c.area, p)
+			}
+			if p.Lon < sw.Lon || p.Lon > ne.Lon || p.Lat < sw.Lat || p.Lat > ne.Lat {
+				t.Errorf("%+v: %v out of the bounds %v %v", c.area, p, sw, ne)
+			}
+		}
+		for _, p := range c.out {
+			if c.area.contains(p) {
+				t.Errorf("%+v: wanted %v outside", c.area, p)
+			}
+		}
+	}
+}
+
+func TestParseGeoArea(t *testing.T) {
+	area, err := parseGeoArea(url.Values{"box": {"-4,40,-3,41"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wanted := []GeoPoint{{-4, 40}, {-3, 41}}; !reflect.DeepEqual(area.Box, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, area.Box)
+	}
+	for _, values := range []url.Values{
+		{},
+		{"box": {"-4,40,-3"}},
+		{"box": {"-3,40,-4,41"}},
+		{"box": {"a,40,-3,41"}},
+		{"box": {"-4,40,-4,41"}},
+		{"polygon": {"0,0,1,1"}},
+		{"polygon": {"0,0,1,1,0,95"}},
+		{"box": {"-4,40,-3,41"}, "polygon": {"0,0,1,1,1,0"}},
+	} {
+		if _, err := parseGeoArea(values); err == nil {
+			t.Errorf("%v: wanted an error", values)
+		}
+	}
+}
+
+func TestParseNear(t *testing.T) {
+	center, radius, err := parseNear(url.Values{"lon": {"-3.7"}, "lat": {"40.4"}, "radius": {"1000"}})
+	if err != nil || center != (GeoPoint{-3.7, 40.4}) || radius != 1000 {
+		t.Errorf("unexpected %v %v %v", center, radius, err)
+	}
+	for _, values := range []url.Values{
+		{"lon": {"1,2"}, "lat": {""}, "radius": {"1000"}},
+		{"lon": {""}, "lat": {"1,2"}, "radius": {"1000"}},
+		{"lon": {"-3.7"}, "radius": {"1000"}},
+		{"lon": {"-3.7"}, "lat": {"40.4"}},
+	} {
+		if _, _, err := parseNear(values); err == nil {
+			t.Errorf("%v: wanted an error", values)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package almacen
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Schemes for the IDs generated by the server, Config.IDScheme
+const (
+	IDSchemeUUID     = "uuid"     // random UUID (version 4)
+	IDSchemeULID     = "ulid"     // lexicographically sortable by creation time
+	IDSchemeObjectID = "objectid" // Mongo ObjectId, as hex
+)
+
+var idGenerators = map[string]func() string{
+	"":               newUUID,
+	IDSchemeUUID:     newUUID,
+	IDSchemeULID:     newULID,
+	IDSchemeObjectID: newObjectID,
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns 48 bits of milliseconds followed by 80 random bits, in base 32
+func newULID() string {
+	var b [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(b[:8], ms<<16)
+	rand.Read(b[6:])
+
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var s [26]byte
+	// 128 bits in 26 characters of 5 bits, the first one only has 3
+	for i := 25; i >= 0; i-- {
+		s[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:])
+}
+
+func newObjectID() string {
+	return bson.NewObjectId().Hex()
+}
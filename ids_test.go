@@ -0,0 +1,38 @@
+package almacen
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestIDGenerators(t *testing.T) {
+	cases := map[string]*regexp.Regexp{
+		IDSchemeUUID:     regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		IDSchemeULID:     regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`),
+		IDSchemeObjectID: regexp.MustCompile(`^[0-9a-f]{24}$`),
+	}
+	for scheme, re := range cases {
+		newID := idGenerators[scheme]
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			id := newID()
+			if !re.MatchString(id) {
+				t.Errorf("%s: unexpected format %q", scheme, id)
+			}
+			if seen[id] {
+				t.Errorf("%s: repeated id %q", scheme, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestULIDSortable(t *testing.T) {
+	first := newULID()
+	time.Sleep(2 * time.Millisecond)
+	second := newULID()
+	if first >= second {
+		t.Errorf("expected %q < %q", first, second)
+	}
+}
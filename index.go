@@ -0,0 +1,458 @@
+package almacen
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// IndexSpec declares a secondary index of a collection on one or more fields, dotted
+// paths. A unique index rejects entities repeating the values of its fields in another
+// entity, a missing field being null, with ErrDuplicateKey. A sparse one leaves out the
+// entities without any of its fields. The name is made from the fields if empty.
+//
+// As in MongoDB, an entity holding an array in a field is indexed by each element. A
+// MemStore finds the entities with an index when a filter requires its first fields to be
+// equal to some values, and maybe the next one to be in a range; it sorts them afterwards.
+//
+// A geo index is on a single field holding a GeoPoint, for Near and Within. It leaves out
+// the entities without the field, and rejects the others not having a valid point there
+// with ErrInvalidLocation.
+//
+// A text index is on the string fields, or arrays of strings, searched for words by Search.
+// There is one at most in a collection. Its fields are sorted, as MongoDB lists them.
+type IndexSpec struct {
+	Name   string   `json:"name,omitempty"`
+	Fields []string `json:"fields"`
+	Unique bool     `json:"unique,omitempty"`
+	Sparse bool     `json:"sparse,omitempty"`
+	Geo    bool     `json:"geo,omitempty"`
+	Text   bool     `json:"text,omitempty"`
+}
+
+var (
+	ErrInvalidIndex  = &Error{statusCode: http.StatusBadRequest, message: "invalid index"}
+	ErrIndexConflict = &Error{statusCode: http.StatusConflict, message: "index exists with other fields or options"}
+	ErrDuplicateKey  = &Error{statusCode: http.StatusConflict, message: "duplicate key in unique index"}
+)
+
+// normalize checks the fields and names the index after them, as MongoDB does, if needed
+func (spec *IndexSpec) normalize() error {
+	if len(spec.Fields) == 0 || spec.Geo && (len(spec.Fields) > 1 || spec.Unique) ||
+		spec.Text && (spec.Geo || spec.Unique) {
+		return ErrInvalidIndex
+	}
+	if spec.Text {
+		spec.Fields = append([]string{}, spec.Fields...)
+		sort.Strings(spec.Fields)
+	}
+	names := make([]string, len(spec.Fields))
+	for i, field := range spec.Fields {
+		// a leading -, + or @ has a meaning for mgo
+		if !validPath(field) || isRevPath(field) || strings.ContainsAny(field[:1], "-+@") {
+			return ErrInvalidIndex
+		}
+		for _, other := range spec.Fields[:i] {
+			if field == other {
+				return ErrInvalidIndex
+			}
+		}
+		names[i] = field + "_1"
+		if spec.Geo {
+			names[i] = field + "_2dsphere"
+		} else if spec.Text {
+			names[i] = field + "_text"
+		}
+	}
+	if spec.Name == "" {
+		spec.Name = strings.Join(names, "_")
+	}
+	if strings.HasPrefix(spec.Name, "$") || spec.Name == "_id_" {
+		return ErrInvalidIndex
+	}
+	return nil
+}
+
+func (spec *IndexSpec) sameAs(other *IndexSpec) bool {
+	return spec.Name == other.Name && spec.Unique == other.Unique && spec.Sparse == other.Sparse &&
+		spec.sameKey(other)
+}
+
+// sameKey tells whether both indexes are on the same fields the same way
+func (spec *IndexSpec) sameKey(other *IndexSpec) bool {
+	return spec.Geo == other.Geo && spec.Text == other.Text && strings.Join(spec.Fields, ",") == strings.Join(other.Fields, ",")
+}
+
+// parseIndexSpec reads the body of a request declaring an index
+func parseIndexSpec(input interface{}) (IndexSpec, error) {
+	var spec IndexSpec
+	if _, isObject := input.(map[string]interface{}); !isObject {
+		return spec, ErrObjectExpected
+	}
+	b, _ := json.Marshal(input)
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return spec, ErrInvalidIndex
+	}
+	return spec, spec.normalize()
+}
+
+// memIndex is a hash index of a MemStore collection, from the key of every value of the
+// fields to the IDs of the entities having it. Its keys are also kept in the order of their
+// values, for the ranges of the first field. A text index has no keys, but the words
+type memIndex struct {
+	spec  IndexSpec
+	ids   map[string]map[string]bool
+	order []indexKeyValues // not for a geo index, whose keys are cells
+	text  *textIndex       // only for a text index
+}
+
+type indexKeyValues struct {
+	key    string
+	values []interface{} // decoded from key
+}
+
+// newMemIndex indexes docs, ErrDuplicateKey if the index is unique and some of them repeat a key
+func newMemIndex(spec IndexSpec, docs map[string]map[string]interface{}) (*memIndex, error) {
+	ix := &memIndex{spec: spec, ids: map[string]map[string]bool{}}
+	if spec.Text {
+		ix.text = newTextIndex(spec.Fields, docs)
+		return ix, nil
+	}
+	for id, ent := range docs {
+		keys, err := ix.keys(ent)
+		if err != nil {
+			return nil, err
+		}
+		if ix.conflicts(id, keys) {
+			return nil, ErrDuplicateKey
+		}
+		for _, key := range keys {
+			ix.addID(key, id)
+		}
+	}
+	if ix.ordered() {
+		// sorted at once, not key by key
+		for key := range ix.ids {
+			ix.order = append(ix.order, indexKeyValues{key, decodeIndexKey(key)})
+		}
+		sort.Slice(ix.order, func(i, j int) bool {
+			return compareIndexValues(ix.order[i].values, ix.order[j].values) < 0
+		})
+	}
+	return ix, nil
+}
+
+func (ix *memIndex) ordered() bool {
+	return !ix.spec.Geo && !ix.spec.Text
+}
+
+// keys returns the keys of ent, as many as combinations of the values of the fields. None
+// if the index is sparse and ent has none of its fields. For a geo index, the cell of the
+// point, ErrInvalidLocation if there is something else in the field
+func (ix *memIndex) keys(ent map[string]interface{}) ([]string, error) {
+	if ix.spec.Text {
+		return nil, nil
+	}
+	if ix.spec.Geo {
+		p, found, err := entityPoint(ent, ix.spec.Fields[0])
+		if !found || err != nil {
+			return nil, err
+		}
+		return []string{geoCell(p)}, nil
+	}
+	var (
+		combinations = [][]interface{}{{}}
+		present      = false
+	)
+	for _, field := range ix.spec.Fields {
+		values, missing := resolvePath(ent, strings.Split(field, "."))
+		present = present || len(values) > 0
+		candidates := expandArrays(values)
+		if missing || len(values) == 0 {
+			candidates = append(candidates, nil)
+		}
+		var next [][]interface{}
+		for _, c := range combinations {
+			for _, v := range candidates {
+				next = append(next, append(c[:len(c):len(c)], v))
+			}
+		}
+		combinations = next
+	}
+	if ix.spec.Sparse && !present {
+		return nil, nil
+	}
+	seen := map[string]bool{}
+	var keys []string
+	for _, c := range combinations {
+		if key := indexKey(c); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// indexKey encodes values, equal if they are equal for a filter, so any number as a float64
+func indexKey(values []interface{}) string {
+	normalized := make([]interface{}, len(values))
+	for i, v := range values {
+		normalized[i] = v
+		if f, isNumber := toFloat(v); isNumber {
+			normalized[i] = f
+		}
+	}
+	b, _ := json.Marshal(normalized)
+	return string(b)
+}
+
+func decodeIndexKey(key string) []interface{} {
+	var values []interface{}
+	json.Unmarshal([]byte(key), &values)
+	return values
+}
+
+// compareIndexValues orders the values of two keys as a sort by the fields of the index would
+func compareIndexValues(a, b []interface{}) int {
+	for i := range a {
+		if c := compareSortValues(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// conflicts tells whether a unique index has any of the keys for another entity than id
+func (ix *memIndex) conflicts(id string, keys []string) bool {
+	if !ix.spec.Unique {
+		return false
+	}
+	for _, key := range keys {
+		for other := range ix.ids[key] {
+			if other != id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ix *memIndex) add(id string, ent map[string]interface{}, keys []string) {
+	if ix.text != nil {
+		ix.text.add(id, ent)
+	}
+	for _, key := range keys {
+		if !ix.addID(key, id) || !ix.ordered() {
+			continue
+		}
+		values := decodeIndexKey(key)
+		i := sort.Search(len(ix.order), func(i int) bool { return compareIndexValues(ix.order[i].values, values) > 0 })
+		ix.order = append(ix.order, indexKeyValues{})
+		copy(ix.order[i+1:], ix.order[i:])
+		ix.order[i] = indexKeyValues{key, values}
+	}
+}
+
+// addID adds id to the entities with key, telling whether the key is new
+func (ix *memIndex) addID(key, id string) bool {
+	ids, found := ix.ids[key]
+	if !found {
+		ids = map[string]bool{}
+		ix.ids[key] = ids
+	}
+	ids[id] = true
+	return !found
+}
+
+func (ix *memIndex) remove(id string, keys []string) {
+	if ix.text != nil {
+		ix.text.remove(id)
+	}
+	for _, key := range keys {
+		delete(ix.ids[key], id)
+		if len(ix.ids[key]) != 0 {
+			continue
+		}
+		delete(ix.ids, key)
+		if !ix.ordered() {
+			continue
+		}
+		// among the keys with values comparing equal, as objects do
+		values := decodeIndexKey(key)
+		for i := sort.Search(len(ix.order), func(i int) bool { return compareIndexValues(ix.order[i].values, values) >= 0 }); i < len(ix.order); i++ {
+			if ix.order[i].key == key {
+				ix.order = append(ix.order[:i], ix.order[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// lookup returns the IDs of the entities which could match f, if f requires the first fields
+// of the index to be equal to one of some values, other than null, and the next one, if any,
+// to be in a range, as MongoDB uses an index. Otherwise found is false. A sort does not use
+// the index, as an array is sorted by its lowest or highest element
+func (ix *memIndex) lookup(f *Filter) (ids map[string]bool, found bool) {
+	if !ix.ordered() {
+		return nil, false
+	}
+	conds := []*Filter{f}
+	if f.Op == FilterAnd {
+		conds = f.Filters
+	}
+	combinations := [][]interface{}{{}}
+	n := 0
+	for ; n < len(ix.spec.Fields); n++ {
+		values := equalValues(conds, ix.spec.Fields[n])
+		if len(values) == 0 {
+			break
+		}
+		var next [][]interface{}
+		for _, c := range combinations {
+			for _, v := range values {
+				next = append(next, append(c[:len(c):len(c)], v))
+			}
+		}
+		combinations = next
+	}
+	ids = map[string]bool{}
+	if n == len(ix.spec.Fields) {
+		for _, c := range combinations {
+			for id := range ix.ids[indexKey(c)] {
+				ids[id] = true
+			}
+		}
+		return ids, true
+	}
+	var ranges []*Filter
+	for _, c := range conds {
+		if c.Field == ix.spec.Fields[n] && (c.Op == FilterGt || c.Op == FilterGte || c.Op == FilterLt || c.Op == FilterLte) {
+			ranges = append(ranges, c)
+		}
+	}
+	if n == 0 && len(ranges) == 0 {
+		return nil, false
+	}
+	for _, c := range combinations {
+		// an entity may be in each range by another element of an array
+		matching := ix.rangeIDs(c, nil)
+		for _, r := range ranges {
+			inRange := ix.rangeIDs(c, r)
+			for id := range matching {
+				if !inRange[id] {
+					delete(matching, id)
+				}
+			}
+		}
+		for id := range matching {
+			ids[id] = true
+		}
+	}
+	return ids, true
+}
+
+// equalValues returns the values conds require field to be equal to one of, none if they
+// do not or any of them is null, which also matches the missing fields
+func equalValues(conds []*Filter, field string) []interface{} {
+	for _, c := range conds {
+		if c.Field != field {
+			continue
+		}
+		var values []interface{}
+		switch c.Op {
+		case FilterEq:
+			values = []interface{}{c.Value}
+		case FilterIn:
+			values, _ = c.Value.([]interface{})
+		default:
+			continue
+		}
+		for _, v := range values {
+			if v == nil {
+				return nil
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// rangeIDs returns the IDs under the keys beginning with the values of prefix, and then with
+// a value of the same type as cond in its range, if cond is not nil
+func (ix *memIndex) rangeIDs(prefix []interface{}, cond *Filter) map[string]bool {
+	n := len(prefix)
+	// where the key is, before the range, in it or after it
+	position := func(i int) int {
+		values := ix.order[i].values
+		if c := compareIndexValues(values[:n], prefix); c != 0 || cond == nil {
+			return c
+		}
+		if ra, rb := sortRank(values[n]), sortRank(cond.Value); ra != rb {
+			return ra - rb
+		}
+		c := compareSortValues(values[n], cond.Value)
+		switch {
+		case cond.Op == FilterGt && c <= 0, cond.Op == FilterGte && c < 0:
+			return -1
+		case cond.Op == FilterLt && c >= 0, cond.Op == FilterLte && c > 0:
+			return 1
+		}
+		return 0
+	}
+	first := sort.Search(len(ix.order), func(i int) bool { return position(i) >= 0 })
+	end := sort.Search(len(ix.order), func(i int) bool { return position(i) > 0 })
+	ids := map[string]bool{}
+	for _, kv := range ix.order[first:end] {
+		for id := range ix.ids[kv.key] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// searchIndex returns the words of the text index, if the collection has one
+func (col *memCollection) searchIndex() *textIndex {
+	for _, ix := range col.indexes {
+		if ix.text != nil {
+			return ix.text
+		}
+	}
+	return nil
+}
+
+// indexedIDs returns the IDs which could match f as some index tells, if any
+func (col *memCollection) indexedIDs(f *Filter) (map[string]bool, bool) {
+	if f == nil {
+		return nil, false
+	}
+	for _, ix := range col.indexes {
+		if ids, found := ix.lookup(f); found {
+			return ids, true
+		}
+	}
+	return nil, false
+}
+
+// indexSpecs returns the specs of the indexes, ordered by name. It must be called with col.mu held
+func (col *memCollection) indexSpecs() []IndexSpec {
+	specs := make([]IndexSpec, len(col.indexes))
+	for i, ix := range col.indexes {
+		specs[i] = ix.spec
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	return specs
+}
+
+// rebuildIndexes makes the indexes of col for docs, as they would replace the current ones.
+// It must be called with col.mu held
+func (col *memCollection) rebuildIndexes(docs map[string]map[string]interface{}) ([]*memIndex, error) {
+	indexes := make([]*memIndex, len(col.indexes))
+	for i, ix := range col.indexes {
+		var err error
+		if indexes[i], err = newMemIndex(ix.spec, docs); err != nil {
+			return nil, err
+		}
+	}
+	return indexes, nil
+}
@@ -0,0 +1,135 @@
+package almacen
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestIndexSpecNormalize(t *testing.T) {
+	spec := IndexSpec{Fields: []string{"a.b", "c"}}
+	if err := spec.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Name != "a.b_1_c_1" {
+		t.Errorf("wanted name %q, got %q", "a.b_1_c_1", spec.Name)
+	}
+	geo := IndexSpec{Fields: []string{"location"}, Geo: true}
+	if err := geo.normalize(); err != nil || geo.Name != "location_2dsphere" {
+		t.Errorf("wanted name %q, got %q %v", "location_2dsphere", geo.Name, err)
+	}
+	text := IndexSpec{Fields: []string{"title", "body"}, Text: true}
+	if err := text.normalize(); err != nil || text.Name != "body_text_title_text" {
+		t.Errorf("wanted name %q, got %q %v", "body_text_title_text", text.Name, err)
+	}
+	for _, spec := range []IndexSpec{
+		{},
+		{Fields: []string{""}},
+		{Fields: []string{"a..b"}},
+		{Fields: []string{"$a"}},
+		{Fields: []string{"-a"}},
+		{Fields: []string{"a", "a"}},
+		{Fields: []string{RevField}},
+		{Name: "_id_", Fields: []string{"a"}},
+		{Fields: []string{"a", "b"}, Geo: true},
+		{Fields: []string{"a"}, Geo: true, Unique: true},
+		{Fields: []string{"a"}, Text: true, Geo: true},
+		{Fields: []string{"a"}, Text: true, Unique: true},
+	} {
+		if err := spec.normalize(); err != ErrInvalidIndex {
+			t.Errorf("%v: wanted %v, got %v", spec, ErrInvalidIndex, err)
+		}
+	}
+}
+
+func TestMemIndexKeys(t *testing.T) {
+	for _, c := range []struct {
+		spec   IndexSpec
+		ent    map[string]interface{}
+		wanted []string
+	}{
+		{IndexSpec{Fields: []string{"a"}}, map[string]interface{}{"a": 1}, []string{`[1]`}},
+		{IndexSpec{Fields: []string{"a"}}, map[string]interface{}{}, []string{`[null]`}},
+		{IndexSpec{Fields: []string{"a"}, Sparse: true}, map[string]interface{}{}, nil},
+		{
+			IndexSpec{Fields: []string{"a", "b.c"}},
+			map[string]interface{}{"a": []interface{}{"x", "x"}, "b": []interface{}{map[string]interface{}{"c": 2.0}, 3.0}},
+			[]string{`["x",2]`, `["x",null]`, `[["x","x"],2]`, `[["x","x"],null]`},
+		},
+	} {
+		ix := &memIndex{spec: c.spec}
+		keys, err := ix.keys(c.ent)
+		if err != nil {
+			t.Errorf("%v %v: %v", c.spec, c.ent, err)
+		}
+		sort.Strings(keys)
+		sort.Strings(c.wanted)
+		if !reflect.DeepEqual(keys, c.wanted) {
+			t.Errorf("%v %v: wanted %v, got %v", c.spec, c.ent, c.wanted, keys)
+		}
+	}
+}
+
+func TestMemIndexLookup(t *testing.T) {
+	ix, err := newMemIndex(IndexSpec{Fields: []string{"a", "b"}}, map[string]map[string]interface{}{
+		"1": {"a": 1.0, "b": "x"},
+		"2": {"a": []interface{}{1.0, 2.0}, "b": "y"},
+		"3": {"a": 2.0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		filter string
+		wanted []string // nil if the index cannot be used
+	}{
+		{`a=1 and b=y`, []string{"2"}},
+		{`b in [x, y] and a=1 and c=3`, []string{"1", "2"}},
+		{`a=2 and b=x`, []string{}},
+		{`a=1`, []string{"1", "2"}},
+		{`a=2 and b=null`, []string{"2", "3"}},
+		{`a=1 and b>x`, []string{"2"}},
+		{`a>1 and b=x`, []string{"2", "3"}},
+		{`a>=1 and a<2`, []string{"1", "2"}},
+		// by different elements of the array
+		{`a>1 and a<2`, []string{"2"}},
+		{`a<=2 and a>=2`, []string{"2", "3"}},
+		{`a>a`, []string{}},
+		{`a=null`, nil},
+		{`a!=1`, nil},
+		{`b=x`, nil},
+		{`a=1 or b=x`, nil},
+	}
+	checkLookup := func(filter string, wanted []string) {
+		t.Helper()
+		f, err := ParseFilter(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, found := ix.lookup(f)
+		if found != (wanted != nil) {
+			t.Errorf("%s: wanted index used %v, got %v", filter, wanted != nil, found)
+			return
+		}
+		got := []string{}
+		for id := range ids {
+			got = append(got, id)
+		}
+		sort.Strings(got)
+		if found && !reflect.DeepEqual(got, wanted) {
+			t.Errorf("%s: wanted %v, got %v", filter, wanted, got)
+		}
+	}
+	for _, c := range cases {
+		checkLookup(c.filter, c.wanted)
+	}
+	// the order is kept on changes
+	ent := map[string]interface{}{"a": 1.5}
+	keys, _ := ix.keys(ent)
+	ix.add("4", ent, keys)
+	checkLookup(`a>1 and a<2`, []string{"2", "4"})
+	keys, _ = ix.keys(map[string]interface{}{"a": []interface{}{1.0, 2.0}, "b": "y"})
+	ix.remove("2", keys)
+	checkLookup(`a>1 and a<2`, []string{"4"})
+	checkLookup(`a>=1`, []string{"1", "3", "4"})
+}
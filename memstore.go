@@ -1,121 +1,820 @@
 package almacen
 
 import (
-	"strings"
+	"context"
+	"encoding/json"
+	"sort"
 	"sync"
 )
 
+// MemStore keeps every collection in memory. Each collection has its own lock,
+// so a busy collection does not stall the others. The store lock only guards
+// the map of collections and is held exclusively just when creating one.
+//
+// Entities are deep copied when they come in and when they go out, so callers
+// never share maps or slices with the stored data. Stored entities are never
+// modified, changes replace them with a modified copy at a new revision, so a
+// reference to one can be used after releasing the lock.
 type MemStore struct {
-	db map[string]map[string]map[string]interface{}
+	db map[string]*memCollection
 	mu sync.RWMutex
+
+	// logChange, if set, is called with every change before making it, with the
+	// collection locked. If it fails, the change is not made
+	logChange func(r *walRecord) error
+}
+
+type memCollection struct {
+	docs    map[string]map[string]interface{}
+	indexes []*memIndex // declared ones, changed with docs too
+	dropped bool        // no longer in the store, writers must look it up again
+	mu      sync.RWMutex
+}
+
+func newMemCollection(docs map[string]map[string]interface{}) *memCollection {
+	return &memCollection{docs: docs}
+}
+
+// indexKeys returns the keys of ent for every index, failing if it repeats a key of a
+// unique index or has no valid point for a geo one. It must be called with col.mu held
+func (col *memCollection) indexKeys(id string, ent map[string]interface{}) ([][]string, error) {
+	keys := make([][]string, len(col.indexes))
+	for i, ix := range col.indexes {
+		var err error
+		if keys[i], err = ix.keys(ent); err != nil {
+			return nil, err
+		}
+		if ix.conflicts(id, keys[i]) {
+			return nil, ErrDuplicateKey
+		}
+	}
+	return keys, nil
+}
+
+// put stores ent, which must not be modified afterwards, with its keys from indexKeys.
+// It must be called with col.mu held
+func (col *memCollection) put(id string, ent map[string]interface{}, keys [][]string) {
+	if _, found := col.docs[id]; found {
+		col.remove(id)
+	}
+	col.docs[id] = ent
+	for i, ix := range col.indexes {
+		ix.add(id, ent, keys[i])
+	}
+}
+
+// remove must be called with col.mu held
+func (col *memCollection) remove(id string) {
+	for _, ix := range col.indexes {
+		keys, _ := ix.keys(col.docs[id]) // it was indexed, so it is valid
+		ix.remove(id, keys)
+	}
+	delete(col.docs, id)
 }
 
 func NewMemStore() *MemStore {
-	return &MemStore{db: make(map[string]map[string]map[string]interface{})}
+	return &MemStore{db: make(map[string]*memCollection)}
 }
-func (ms *MemStore) getCol(collection string) map[string]map[string]interface{} {
+
+// log calls logChange, if set
+func (ms *MemStore) log(r *walRecord) error {
+	if ms.logChange == nil {
+		return nil
+	}
+	return ms.logChange(r)
+}
+
+// store logs ent and puts it in col, which must be locked
+func (ms *MemStore) store(collection string, col *memCollection, id string, ent map[string]interface{}) error {
+	keys, err := col.indexKeys(id, ent)
+	if err != nil {
+		return err
+	}
+	if err = ms.log(&walRecord{Op: opSave, Col: collection, ID: id, Value: ent}); err != nil {
+		return err
+	}
+	col.put(id, ent, keys)
+	return nil
+}
+
+// getCol returns nil if the collection does not exist. Reads must not create collections
+func (ms *MemStore) getCol(collection string) *memCollection {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.db[collection]
+}
+
+func (ms *MemStore) getOrCreateCol(collection string) *memCollection {
+	if col := ms.getCol(collection); col != nil {
+		return col
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	col := ms.db[collection]
 	if col == nil {
-		col = make(map[string]map[string]interface{})
+		col = newMemCollection(make(map[string]map[string]interface{}))
 		ms.db[collection] = col
 	}
 	return col
 }
 
-func (ms *MemStore) FindAll(ctx *context, collection string) ([]map[string]interface{}, error) {
-	ms.mu.RLock()
-	defer ms.mu.RUnlock()
+// lockCol returns the collection, created if needed, locked for writing
+func (ms *MemStore) lockCol(collection string) *memCollection {
+	for {
+		col := ms.getOrCreateCol(collection)
+		col.mu.Lock()
+		if !col.dropped {
+			return col
+		}
+		col.mu.Unlock()
+	}
+}
+
+func (ms *MemStore) FindAll(ctx context.Context, collection string) ([]map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	var list []map[string]interface{}
-	for _, e := range ms.getCol(collection) {
-		list = append(list, e)
+	col := ms.getCol(collection)
+	if col == nil {
+		return list, nil
+	}
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	for _, e := range col.docs {
+		list = append(list, publicEntity(e))
 	}
 	return list, nil
 }
 
-func (ms *MemStore) FindByID(ctx *context, collection, id string) (map[string]interface{}, error) {
-	ms.mu.RLock()
-	defer ms.mu.RUnlock()
-	var obj, found = ms.getCol(collection)[id]
+func (ms *MemStore) Find(ctx context.Context, collection string, q *Query) ([]map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	list := []map[string]interface{}{}
+	col := ms.getCol(collection)
+	if col == nil {
+		return list, nil
+	}
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	for _, id := range col.selectIDs(q) {
+		list = append(list, q.output(col.docs[id]))
+	}
+	return list, nil
+}
+
+func (ms *MemStore) Iterate(ctx context.Context, collection string, q *Query, fn func(ent map[string]interface{}) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	col := ms.getCol(collection)
+	if col == nil {
+		return nil
+	}
+	// snapshot, copying only the references
+	col.mu.RLock()
+	ids := col.selectIDs(q)
+	ents := make([]map[string]interface{}, len(ids))
+	for i, id := range ids {
+		ents[i] = col.docs[id]
+	}
+	col.mu.RUnlock()
+
+	for _, e := range ents {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(q.output(e)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MemStore) FindByID(ctx context.Context, collection, id string) (map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	col := ms.getCol(collection)
+	if col == nil {
+		return nil, ErrNotFound
+	}
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	var obj, found = col.docs[id]
 	if !found {
 		return nil, ErrNotFound
 	}
-	return obj, nil
+	return publicEntity(obj), nil
 }
 
-func (ms *MemStore) Save(ctx *context, collection string, ent map[string]interface{}) error {
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
+func (ms *MemStore) FindWithRevision(ctx context.Context, collection, id string) (map[string]interface{}, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	col := ms.getCol(collection)
+	if col == nil {
+		return nil, "", ErrNotFound
+	}
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	var obj, found = col.docs[id]
+	if !found {
+		return nil, "", ErrNotFound
+	}
+	rev, _ := obj[RevField].(string)
+	return publicEntity(obj), rev, nil
+}
+
+func (ms *MemStore) Save(ctx context.Context, collection string, ent map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	key, isString := ent["_id"].(string)
 	if !isString {
 		return ErrIdNotString
 	}
-	ms.getCol(collection)[key] = ent
-	return nil
+	col := ms.lockCol(collection)
+	defer col.mu.Unlock()
+	if err := checkRevision(ctx, col.docs[key]); err != nil {
+		return err
+	}
+	return ms.store(collection, col, key, withRevision(copyEntity(ent)))
 }
 
-func (ms *MemStore) Delete(ctx *context, collection, id string) error {
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
-	delete(ms.getCol(collection), id)
+func (ms *MemStore) Insert(ctx context.Context, collection string, ent map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, isString := ent["_id"].(string)
+	if !isString {
+		return ErrIdNotString
+	}
+	col := ms.lockCol(collection)
+	defer col.mu.Unlock()
+	if _, found := col.docs[key]; found {
+		return ErrExisting
+	}
+	return ms.store(collection, col, key, withRevision(copyEntity(ent)))
+}
+
+func (ms *MemStore) Replace(ctx context.Context, collection string, ent map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, isString := ent["_id"].(string)
+	if !isString {
+		return ErrIdNotString
+	}
+	return ms.change(ctx, collection, key, func(map[string]interface{}) (map[string]interface{}, error) {
+		return copyEntity(ent), nil
+	})
+}
+
+func (ms *MemStore) Delete(ctx context.Context, collection, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	col := ms.getCol(collection)
+	if col == nil {
+		return notFound(ctx)
+	}
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	ent, found := col.docs[id]
+	if err := checkRevision(ctx, ent); err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	if err := ms.log(&walRecord{Op: opDelete, Col: collection, ID: id}); err != nil {
+		return err
+	}
+	col.remove(id)
 	return nil
 }
 
-func (ms *MemStore) FindField(ctx *context, collection, id, field string) (interface{}, error) {
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
-	element, father := ms.traverse(collection, id, field)
-	if father == nil {
-		return nil, ErrNotFound
+func (ms *MemStore) FindField(ctx context.Context, collection, id, field string) (interface{}, error) {
+	value, _, err := ms.FindFieldWithRevision(ctx, collection, id, field)
+	return value, err
+}
+
+func (ms *MemStore) FindFieldWithRevision(ctx context.Context, collection, id, field string) (interface{}, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
 	}
-	value, isPresent := father[element]
-	if !isPresent {
-		return nil, ErrNotFound
+	col := ms.getCol(collection)
+	if col == nil {
+		return nil, "", ErrNotFound
 	}
-	return value, nil
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	value, err := lookupField(col.docs[id], field)
+	if err != nil {
+		return nil, "", err
+	}
+	rev, _ := col.docs[id][RevField].(string)
+	return copyValue(value), rev, nil
 }
 
-func (ms *MemStore) UpdateField(ctx *context, collection, id, fields string, value interface{}) error {
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
-	field, father := ms.traverse(collection, id, fields)
-	if father == nil {
-		return ErrTraversingObject
+func (ms *MemStore) UpdateField(ctx context.Context, collection, id, fields string, value interface{}) error {
+	if isRevPath(fields) {
+		return ErrInvalidFieldName
 	}
-	father[field] = value
+	return ms.change(ctx, collection, id, func(ent map[string]interface{}) (map[string]interface{}, error) {
+		return ent, setField(ent, fields, value)
+	})
+}
+
+func (ms *MemStore) DeleteField(ctx context.Context, collection, id, fields string) error {
+	if isRevPath(fields) {
+		return ErrInvalidFieldName
+	}
+	return ms.change(ctx, collection, id, func(ent map[string]interface{}) (map[string]interface{}, error) {
+		return ent, deleteField(ent, fields)
+	})
+}
+
+func (ms *MemStore) Update(ctx context.Context, collection, id string, u *Update) error {
+	if u.changesRevision() {
+		return ErrInvalidFieldName
+	}
+	return ms.change(ctx, collection, id, func(ent map[string]interface{}) (map[string]interface{}, error) {
+		return ent, u.apply(ent)
+	})
+}
+
+func (ms *MemStore) Patch(ctx context.Context, collection, id string, ops []PatchOp) error {
+	return ms.change(ctx, collection, id, func(ent map[string]interface{}) (map[string]interface{}, error) {
+		return applyPatch(ent, ops)
+	})
+}
+
+// change replaces the entity with what fn makes of a copy of it, at a new revision,
+// checking first the revision required by ctx, if any
+func (ms *MemStore) change(ctx context.Context, collection, id string, fn func(ent map[string]interface{}) (map[string]interface{}, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	col := ms.getCol(collection)
+	if col == nil {
+		return notFound(ctx)
+	}
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	ent, found := col.docs[id]
+	if err := checkRevision(ctx, ent); err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	ent, err := fn(copyEntity(ent))
+	if err != nil {
+		return err
+	}
+	ent[RevField] = newRevision()
+	return ms.store(collection, col, id, ent)
+}
+
+// notFound is the error for a missing entity, which fails any precondition
+func notFound(ctx context.Context) error {
+	if err := checkRevision(ctx, nil); err != nil {
+		return err
+	}
+	return ErrNotFound
+}
+
+// ReplaceCollection swaps the whole collection at once, readers see either the old entities or the new ones
+func (ms *MemStore) ReplaceCollection(ctx context.Context, collection string, ents []map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	docs := make(map[string]map[string]interface{}, len(ents))
+	stored := make([]map[string]interface{}, len(ents))
+	for i, ent := range ents {
+		key, isString := ent["_id"].(string)
+		if !isString {
+			return ErrIdNotString
+		}
+		if _, found := docs[key]; found {
+			return ErrExisting
+		}
+		stored[i] = withRevision(copyEntity(ent))
+		docs[key] = stored[i]
+	}
+	col := ms.lockCol(collection)
+	defer col.mu.Unlock()
+	indexes, err := col.rebuildIndexes(docs)
+	if err != nil {
+		return err
+	}
+	if err = ms.log(&walRecord{Op: opLoad, Col: collection, Value: stored}); err != nil {
+		return err
+	}
+	col.docs, col.indexes = docs, indexes
 	return nil
 }
 
-func (ms *MemStore) DeleteField(ctx *context, collection, id, fields string) error {
+func (ms *MemStore) DropCollection(ctx context.Context, collection string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	col := ms.getCol(collection)
+	if col == nil {
+		return ErrNotFound
+	}
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	if col.dropped {
+		return ErrNotFound
+	}
+	// logged with the collection locked, so no change of it is logged afterwards, and
+	// any change of a new one with the name is logged after removing this one
+	if err := ms.log(&walRecord{Op: opDrop, Col: collection}); err != nil {
+		return err
+	}
 	ms.mu.Lock()
-	defer ms.mu.Unlock()
-	field, father := ms.traverse(collection, id, fields)
-	if father != nil {
-		delete(father, field)
+	delete(ms.db, collection)
+	ms.mu.Unlock()
+	col.docs, col.indexes = make(map[string]map[string]interface{}), nil
+	col.dropped = true
+	return nil
+}
+
+// collections returns the collections of the store, without locking them, as a dropped
+// one locks the store while locked itself
+func (ms *MemStore) collections() map[string]*memCollection {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	cols := make(map[string]*memCollection, len(ms.db))
+	for name, col := range ms.db {
+		cols[name] = col
 	}
+	return cols
+}
+
+// Collections gives as size that of the entities in JSON
+func (ms *MemStore) Collections(ctx context.Context) ([]CollectionInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ms.mu.RLock()
+	names := make([]string, 0, len(ms.db))
+	for name := range ms.db {
+		names = append(names, name)
+	}
+	ms.mu.RUnlock()
+	sort.Strings(names)
+	infos := make([]CollectionInfo, 0, len(names))
+	for _, name := range names {
+		col := ms.getCol(name)
+		if col == nil {
+			continue // dropped meanwhile
+		}
+		info := CollectionInfo{Name: name}
+		col.mu.RLock()
+		info.Count = len(col.docs)
+		for _, ent := range col.docs {
+			b, _ := json.Marshal(ent)
+			info.Size += int64(len(b))
+		}
+		col.mu.RUnlock()
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (ms *MemStore) Count(ctx context.Context, collection string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	col := ms.getCol(collection)
+	if col == nil {
+		return 0, nil
+	}
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	return len(col.docs), nil
+}
+
+func (ms *MemStore) Aggregate(ctx context.Context, collection string, pipeline []Stage) ([]map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	docs := []map[string]interface{}{}
+	if col := ms.getCol(collection); col != nil {
+		col.mu.RLock()
+		for _, id := range col.selectIDs(&Query{}) {
+			docs = append(docs, publicEntity(col.docs[id]))
+		}
+		col.mu.RUnlock()
+	}
+	if res := aggregate(docs, pipeline); res != nil {
+		return res, nil
+	}
+	return []map[string]interface{}{}, nil
+}
+
+func (ms *MemStore) Search(ctx context.Context, collection, text string, limit int) ([]SearchHit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	terms := searchTerms(text)
+	if len(terms) == 0 {
+		return nil, ErrInvalidSearch
+	}
+	col := ms.getCol(collection)
+	if col == nil {
+		return nil, ErrNoTextIndex
+	}
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	words := col.searchIndex()
+	if words == nil {
+		return nil, ErrNoTextIndex
+	}
+	hits := []SearchHit{}
+	for _, ts := range words.search(terms, len(col.docs)) {
+		if limit > 0 && len(hits) == limit {
+			break
+		}
+		hits = append(hits, SearchHit{Score: ts.score, Entity: publicEntity(col.docs[ts.id])})
+	}
+	return hits, nil
+}
+
+func (ms *MemStore) Near(ctx context.Context, collection, field string, center GeoPoint, radius float64, limit int) ([]GeoHit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkNear(center, radius); err != nil {
+		return nil, err
+	}
+	col := ms.getCol(collection)
+	if col == nil {
+		return nil, ErrNoGeoIndex
+	}
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	ix := col.geoIndex(field)
+	if ix == nil {
+		return nil, ErrNoGeoIndex
+	}
+	hits := []GeoHit{}
+	for id := range ix.nearIDs(center, radius) {
+		p, _, _ := entityPoint(col.docs[id], field)
+		if d := haversine(center, p); d <= radius {
+			hits = append(hits, GeoHit{Distance: d, Entity: col.docs[id]})
+		}
+	}
+	sortGeoHits(hits)
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	for i := range hits {
+		hits[i].Entity = publicEntity(hits[i].Entity)
+	}
+	return hits, nil
+}
+
+func (ms *MemStore) Within(ctx context.Context, collection, field string, area *GeoArea, limit int) ([]map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := area.check(); err != nil {
+		return nil, err
+	}
+	ents := []map[string]interface{}{}
+	col := ms.getCol(collection)
+	if col == nil {
+		return ents, nil
+	}
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	var ids []string
+	if ix := col.geoIndex(field); ix != nil {
+		for id := range ix.cellIDs(area.bounds()) {
+			ids = append(ids, id)
+		}
+	} else {
+		for id := range col.docs {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if limit > 0 && len(ents) == limit {
+			break
+		}
+		if p, found, err := entityPoint(col.docs[id], field); found && err == nil && area.contains(p) {
+			ents = append(ents, publicEntity(col.docs[id]))
+		}
+	}
+	return ents, nil
+}
+
+func (ms *MemStore) EnsureIndex(ctx context.Context, collection string, spec IndexSpec) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := spec.normalize(); err != nil {
+		return err
+	}
+	col := ms.lockCol(collection)
+	defer col.mu.Unlock()
+	for _, ix := range col.indexes {
+		if ix.spec.sameAs(&spec) {
+			return nil
+		}
+		if ix.spec.Name == spec.Name || ix.spec.sameKey(&spec) || ix.spec.Text && spec.Text {
+			return ErrIndexConflict
+		}
+	}
+	spec.Fields = append([]string{}, spec.Fields...)
+	ix, err := newMemIndex(spec, col.docs)
+	if err != nil {
+		return err
+	}
+	if err = ms.log(&walRecord{Op: opIndex, Col: collection, Index: &spec}); err != nil {
+		return err
+	}
+	col.indexes = append(col.indexes, ix)
 	return nil
 }
 
-func (ms *MemStore) traverse(collection, id, fields string) (element string, father map[string]interface{}) {
+func (ms *MemStore) Indexes(ctx context.Context, collection string) ([]IndexSpec, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	col := ms.getCol(collection)
-	root := col[id]
-	fSlice := strings.Split(fields, ".")
-	element = fSlice[len(fSlice)-1] // last element in x.y.z -> z
-	fSlice = fSlice[:len(fSlice)-1] // path to z, [x,y]
-	if len(fSlice) == 0 {           // first level field, root is the father
-		return element, root
+	if col == nil {
+		return []IndexSpec{}, nil
 	}
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	return col.indexSpecs(), nil
+}
 
-	father = traverseAux(root, fSlice) // find the father of element
-	return element, father
+func (ms *MemStore) DropIndex(ctx context.Context, collection, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	col := ms.getCol(collection)
+	if col == nil {
+		return ErrNotFound
+	}
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	for i, ix := range col.indexes {
+		if ix.spec.Name == name {
+			if err := ms.log(&walRecord{Op: opDropIndex, Col: collection, Index: &IndexSpec{Name: name}}); err != nil {
+				return err
+			}
+			col.indexes = append(col.indexes[:i:i], col.indexes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
 }
 
-func traverseAux(m map[string]interface{}, fields []string) (father map[string]interface{}) {
-	f, isObject := m[fields[0]].(map[string]interface{})
-	if !isObject || f == nil {
+// indexSpecs returns the indexes of every collection having some
+func (ms *MemStore) indexSpecs() map[string][]IndexSpec {
+	specs := map[string][]IndexSpec{}
+	for name, col := range ms.collections() {
+		col.mu.RLock()
+		if len(col.indexes) > 0 && !col.dropped {
+			specs[name] = col.indexSpecs()
+		}
+		col.mu.RUnlock()
+	}
+	return specs
+}
+
+// restore stores ents as they are, revisions included, after removing the rest of the
+// collection if replace is true. It is for replaying a log
+func (ms *MemStore) restore(collection string, ents []map[string]interface{}, replace bool) {
+	col := ms.lockCol(collection)
+	defer col.mu.Unlock()
+	if replace {
+		col.docs = make(map[string]map[string]interface{}, len(ents))
+		col.indexes, _ = col.rebuildIndexes(col.docs)
+	}
+	for _, ent := range ents {
+		if id, isString := ent["_id"].(string); isString {
+			if keys, err := col.indexKeys(id, ent); err == nil { // it did not fail when logged
+				col.put(id, ent, keys)
+			}
+		}
+	}
+}
+
+// dump returns the whole database, sharing the entities. Callers must prevent concurrent writes
+func (ms *MemStore) dump() map[string]map[string]map[string]interface{} {
+	cols := ms.collections()
+	db := make(map[string]map[string]map[string]interface{}, len(cols))
+	for name, col := range cols {
+		col.mu.RLock()
+		if !col.dropped {
+			docs := make(map[string]map[string]interface{}, len(col.docs))
+			for id, e := range col.docs {
+				docs[id] = e
+			}
+			db[name] = docs
+		}
+		col.mu.RUnlock()
+	}
+	return db
+}
+
+// load replaces the whole database
+func (ms *MemStore) load(db map[string]map[string]map[string]interface{}) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.db = make(map[string]*memCollection, len(db))
+	for name, docs := range db {
+		ms.db[name] = newMemCollection(docs)
+	}
+}
+
+// selectIDs returns the IDs of the entities selected by q, in order. It must be called with col.mu held
+func (col *memCollection) selectIDs(q *Query) []string {
+	var ids []string
+	after := q.After
+	if q.SortAfter != nil {
+		after = "" // only for ties, once sorted
+	}
+	selected := func(id string) bool {
+		return id > after && (q.Filter == nil || q.Filter.match(col.docs[id]))
+	}
+	if candidates, indexed := col.indexedIDs(q.Filter); indexed {
+		for id := range candidates {
+			if selected(id) {
+				ids = append(ids, id)
+			}
+		}
+	} else {
+		for id := range col.docs {
+			if selected(id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	if len(q.Sort) > 0 {
+		sortIDs(ids, col.docs, q.Sort)
+	}
+	if q.SortAfter != nil {
+		ids = ids[sort.Search(len(ids), func(i int) bool { return q.follows(ids[i], col.docs[ids[i]]) }):]
+	}
+	if q.Skip >= len(ids) {
 		return nil
 	}
-	if len(fields) == 1 {
-		return f
+	ids = ids[q.Skip:]
+	if q.Limit > 0 && len(ids) > q.Limit {
+		ids = ids[:q.Limit]
+	}
+	return ids
+}
+
+// output copies ent with the fields selected by q
+func (q *Query) output(ent map[string]interface{}) map[string]interface{} {
+	if len(q.Fields) == 0 {
+		return publicEntity(ent)
+	}
+	return projectEntity(ent, q.Fields)
+}
+
+// publicEntity copies ent without its revision
+func publicEntity(ent map[string]interface{}) map[string]interface{} {
+	c := copyEntity(ent)
+	delete(c, RevField)
+	return c
+}
+
+func copyEntity(ent map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(ent))
+	for k, v := range ent {
+		c[k] = copyValue(v)
+	}
+	return c
+}
+
+// copyValue copies JSON-like values: objects and arrays are copied recursively,
+// anything else is considered immutable
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return copyEntity(v)
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyValue(e)
+		}
+		return c
+	default:
+		return v
 	}
-	return traverseAux(f, fields[1:])
 }
@@ -1,69 +1,264 @@
 package almacen
 
 import (
+	"context"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
-func TestMemStoreFindAll(t *testing.T) {
+func TestMemStoreFindFieldDoesNotCreateCollection(t *testing.T) {
 	m := NewMemStore()
-	testFindAll(m, t)
+	if _, err := m.FindField(contextTest, collectionTest, "ID", "x"); err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	if _, err := m.FindByID(contextTest, collectionTest, "ID"); err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	if len(m.db) != 0 {
+		t.Errorf("expected no collections, got %v", m.db)
+	}
 }
 
-func TestMemStoreFindByID(t *testing.T) {
+func TestMemStoreNoAliasing(t *testing.T) {
 	m := NewMemStore()
-	testFindByID(m, t)
-}
+	original := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{"y": []interface{}{1, 2}}}
+	expected := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{"y": []interface{}{1, 2}}}
+	if err := m.Save(contextTest, collectionTest, original); err != nil {
+		t.Fatal(err)
+	}
+	original["x"].(map[string]interface{})["y"].([]interface{})[0] = "CHANGED"
+	original["z"] = "ADDED"
 
-func TestMemStoreFindByIDNotFound(t *testing.T) {
-	m := NewMemStore()
-	testFindByIDNotFound(m, t)
+	res, err := m.FindByID(contextTest, collectionTest, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res["x"].(map[string]interface{})["y"] = "CHANGED"
+	all, err := m.FindAll(contextTest, collectionTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all[0]["x"].(map[string]interface{})["w"] = "ADDED"
+	field, err := m.FindField(contextTest, collectionTest, "ID", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	field.(map[string]interface{})["y"] = "CHANGED"
+
+	value := map[string]interface{}{"v": 1}
+	if err := m.UpdateField(contextTest, collectionTest, "ID", "u", value); err != nil {
+		t.Fatal(err)
+	}
+	value["v"] = "CHANGED"
+	expected["u"] = map[string]interface{}{"v": 1}
+
+	res, err = m.FindByID(contextTest, collectionTest, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
 }
 
-func TestMemStoreSaveIDNotString(t *testing.T) {
+// TestMemStoreConcurrentAccess is meant to be run with the race detector
+func TestMemStoreConcurrentAccess(t *testing.T) {
 	m := NewMemStore()
-	testSaveIDNotString(m, t)
+	original := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{"y": map[string]interface{}{"z": 0}}}
+	if err := m.Save(contextTest, collectionTest, original); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				switch (g + i) % 4 {
+				case 0:
+					if err := m.UpdateField(contextTest, collectionTest, "ID", "x.y.z", i); err != nil {
+						t.Error(err)
+					}
+				case 1:
+					ent, err := m.FindByID(contextTest, collectionTest, "ID")
+					if err != nil {
+						t.Error(err)
+						continue
+					}
+					ent["x"].(map[string]interface{})["y"].(map[string]interface{})["z"] = "mine"
+				case 2:
+					v, err := m.FindField(contextTest, collectionTest, "ID", "x.y")
+					if err != nil {
+						t.Error(err)
+						continue
+					}
+					v.(map[string]interface{})["w"] = i
+				case 3:
+					all, err := m.FindAll(contextTest, collectionTest)
+					if err != nil {
+						t.Error(err)
+						continue
+					}
+					for _, e := range all {
+						e["x"] = i
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	v, err := m.FindField(contextTest, collectionTest, "ID", "x.y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isInt := v.(map[string]interface{})["z"].(int); !isInt || len(v.(map[string]interface{})) != 1 {
+		t.Errorf("expected only updates through the store, got %v", v)
+	}
 }
 
-func TestMemStoreDelete(t *testing.T) {
+func TestMemStoreReplaceCollectionAtomic(t *testing.T) {
+	const n = 50
 	m := NewMemStore()
-	testDelete(m, t)
+	generation := func(g int) []map[string]interface{} {
+		ents := make([]map[string]interface{}, n)
+		for i := range ents {
+			ents[i] = map[string]interface{}{"_id": strconv.Itoa(g*n + i), "g": g}
+		}
+		return ents
+	}
+	if err := m.ReplaceCollection(contextTest, collectionTest, generation(0)); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for g := 1; g < 100; g++ {
+			if err := m.ReplaceCollection(contextTest, collectionTest, generation(g)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		all, err := m.FindAll(contextTest, collectionTest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != n {
+			t.Fatalf("expected %d entities, got %d", n, len(all))
+		}
+		for _, e := range all {
+			if e["g"] != all[0]["g"] {
+				t.Fatalf("expected a single generation, got %v and %v", all[0]["g"], e["g"])
+			}
+		}
+	}
+	wg.Wait()
 }
 
-func TestMemStoreFindField(t *testing.T) {
+func TestMemStoreDropCollectionConcurrentSave(t *testing.T) {
 	m := NewMemStore()
-	testFindField(m, t)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				id := strconv.Itoa(g*1000 + i)
+				if err := m.Save(contextTest, collectionTest, map[string]interface{}{"_id": id}); err != nil {
+					t.Error(err)
+				}
+				m.DropCollection(contextTest, collectionTest)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if err := m.Save(contextTest, collectionTest, map[string]interface{}{"_id": "last"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.FindByID(contextTest, collectionTest, "last"); err != nil {
+		t.Errorf("expected entity saved after the drops, got %v", err)
+	}
 }
-func TestMemStoreFindFieldNested(t *testing.T) {
+
+func TestMemStoreCanceledContext(t *testing.T) {
 	m := NewMemStore()
-	testFindFieldNested(m, t)
+	if err := m.Save(contextTest, collectionTest, map[string]interface{}{"_id": "e1", "temperature": 12.34}); err != nil {
+		t.Fatal(err)
+	}
+	c, cancel := context.WithCancel(contextTest)
+	cancel()
+	if _, err := m.FindByID(c, collectionTest, "e1"); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if err := m.UpdateField(c, collectionTest, "e1", "temperature", 0); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
 }
 
-func TestMemStoreUpdateField(t *testing.T) {
-	m := NewMemStore()
-	testUpdateField(m, t)
+const benchCollections = 16
+
+func benchPopulate(m *MemStore, b *testing.B) {
+	for c := 0; c < benchCollections; c++ {
+		for i := 0; i < 100; i++ {
+			ent := map[string]interface{}{"_id": strconv.Itoa(i), "x": map[string]interface{}{"y": i}}
+			if err := m.Save(contextTest, strconv.Itoa(c), ent); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
 }
 
-func TestMemStoreUpdateFieldTraversingErr(t *testing.T) {
+// benchParallel runs op from every goroutine, each one working on its own collection.
+// Run with -cpu 1,2,4,8 to see how it scales
+func benchParallel(b *testing.B, op func(m *MemStore, col string, i int) error) {
 	m := NewMemStore()
-	testUpdateFieldTraversingErr(m, t)
+	benchPopulate(m, b)
+	var next int32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		col := strconv.Itoa(int(atomic.AddInt32(&next, 1)) % benchCollections)
+		i := 0
+		for pb.Next() {
+			if err := op(m, col, i); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
 }
 
-func TestMemStoreDeleteField(t *testing.T) {
-	m := NewMemStore()
-	testDeleteField(m, t)
+func BenchmarkMemStoreFindByID(b *testing.B) {
+	benchParallel(b, func(m *MemStore, col string, i int) error {
+		_, err := m.FindByID(contextTest, col, strconv.Itoa(i%100))
+		return err
+	})
 }
 
-func TestMemStoreDeleteFieldTraversingErr(t *testing.T) {
-	m := NewMemStore()
-	testDeleteFieldTraversingErr(m, t)
+func BenchmarkMemStoreFindField(b *testing.B) {
+	benchParallel(b, func(m *MemStore, col string, i int) error {
+		_, err := m.FindField(contextTest, col, strconv.Itoa(i%100), "x.y")
+		return err
+	})
 }
 
-func TestMemStoreUpdateFieldRoot(t *testing.T) {
-	m := NewMemStore()
-	testUpdateFieldRoot(m, t)
+func BenchmarkMemStoreUpdateField(b *testing.B) {
+	benchParallel(b, func(m *MemStore, col string, i int) error {
+		return m.UpdateField(contextTest, col, strconv.Itoa(i%100), "x.y", i)
+	})
 }
 
-func TestMemStoreDeleteFieldRoot(t *testing.T) {
-	m := NewMemStore()
-	testDeleteFieldRoot(m, t)
+func BenchmarkMemStoreMixed(b *testing.B) {
+	benchParallel(b, func(m *MemStore, col string, i int) error {
+		id := strconv.Itoa(i % 100)
+		if i%10 == 0 {
+			return m.UpdateField(contextTest, col, id, "x.y", i)
+		}
+		_, err := m.FindField(contextTest, col, id, "x.y")
+		return err
+	})
 }
@@ -5,17 +5,15 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 
 	"github.com/julienschmidt/httprouter"
 )
 
-var MaxConcurrentConn = 100
-var IncomingReqSem = make(chan struct{}, MaxConcurrentConn)
+type handlerFunc func(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error)
 
-func H(f func(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error)) func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+func (s *Server) H(f handlerFunc) httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
-		var ctx = NewContext()
+		var ctx = s.newRequestContext(req.Context())
 		ctx.params = params
 
 		switch req.Header.Get("x-trace") {
@@ -33,27 +31,29 @@ func H(f func(ctx *context, w http.ResponseWriter, req *http.Request) (interface
 		ctx.Debugf("incoming request: %s", &customReq{req})
 
 		select {
-		case IncomingReqSem <- struct{}{}:
+		case s.sem <- struct{}{}:
 		default:
 			respondErr(w, &Error{message: "too many concurrent requests ", statusCode: http.StatusServiceUnavailable})
 			return
 		}
-		defer func() { <-IncomingReqSem }()
+		defer func() { <-s.sem }()
 
-		// decoding input object
+		// decoding input object, a NDJSON body is left for the handler
 		var object interface{}
-		err := json.NewDecoder(req.Body).Decode(&object)
-		if err != nil && err != io.EOF {
-			ctx.Debugf("error encoding input: %v", err)
-			respondErr(w, &Error{message: "json parsing: " + err.Error(), statusCode: http.StatusBadRequest})
-			return
+		if !isNDJSON(req) {
+			err := json.NewDecoder(req.Body).Decode(&object)
+			if err != nil && err != io.EOF {
+				ctx.Debugf("error encoding input: %v", err)
+				respondErr(w, &Error{message: "json parsing: " + err.Error(), statusCode: http.StatusBadRequest})
+				return
+			}
 		}
 		ctx.input = object
 		ctx.Debugf("incoming object: %v (%T)", object, object)
-		if store, ok := store.(*MongoEntityStore); ok {
-			session := store.session.Copy()
-			defer session.Close()
-			ctx.session = session
+		if scoper, ok := s.store.(RequestScoper); ok {
+			var end func()
+			ctx.Context, end = scoper.BeginRequest(ctx.Context)
+			defer end()
 		}
 
 		// execute logic
@@ -89,18 +89,13 @@ func respondErr(w http.ResponseWriter, err error) {
 
 }
 
-func AddTransId(req *http.Request, c *context) {
+func AddTransId(req *http.Request, c *requestContext) {
 	const transIDHeaderField = "x-transid"
 
 	var transID = req.Header.Get(transIDHeaderField)
 	c.Debugf("received trans id: %q", transID)
 	if transID == "" {
-		// Temporary, to be replaced ...
-		f, _ := os.OpenFile("/dev/urandom", os.O_RDONLY, 0)
-		b := make([]byte, 16)
-		f.Read(b)
-		f.Close()
-		transID = fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+		transID = newUUID()
 		c.Debugf("generated trans id: %q", transID)
 	}
 	c.TransID = transID
@@ -57,13 +57,13 @@ func TestRespondErrorPackage(t *testing.T) {
 
 func TestMiddlewareInvalidJSON(t *testing.T) {
 
-	SetStore(NewMemStore())
-	dummyFunc := func(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	s := NewServer(NewMemStore(), nil)
+	dummyFunc := func(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 		return nil, nil
 	}
 	recorder := httptest.NewRecorder()
 
-	h := H(dummyFunc)
+	h := s.H(dummyFunc)
 
 	buffer := bytes.NewBufferString("not a JSON parseable string")
 	request, err := http.NewRequest("GET", "ruta", buffer)
@@ -87,16 +87,16 @@ func TestMiddlewareMongoStore(t *testing.T) {
 	}
 	defer mes.Stop()
 
-	SetStore(mes)
-	var c = &context{}
-	dummyFunc := func(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	s := NewServer(mes, nil)
+	var c = &requestContext{}
+	dummyFunc := func(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 		// grab the context for later checks
 		c = ctx
 		return nil, nil
 	}
 	recorder := httptest.NewRecorder()
 
-	h := H(dummyFunc)
+	h := s.H(dummyFunc)
 
 	request, err := http.NewRequest("GET", "ruta", &bytes.Buffer{})
 	if err != nil {
@@ -109,26 +109,26 @@ func TestMiddlewareMongoStore(t *testing.T) {
 		t.Errorf("status code: wanted %d, got %d", http.StatusOK, recorder.Code)
 	}
 
-	if c.session == nil {
+	if _, ok := sessionFromContext(c); !ok {
 		t.Errorf("session is nil")
 	}
 }
 
 func TestMiddlewareEcho(t *testing.T) {
 	var err error
-	SetStore(NewMemStore())
+	s := NewServer(NewMemStore(), nil)
 	object := map[string]interface{}{
 		"integer": 2.0,
 		"string":  "STRING",
 		"array":   []interface{}{1.0, "dos", 3.0},
 		"object":  map[string]interface{}{"a": "a", "b": 2.1},
 	}
-	echoFunc := func(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	echoFunc := func(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 		return ctx.input, nil
 	}
 	recorder := httptest.NewRecorder()
 
-	h := H(echoFunc)
+	h := s.H(echoFunc)
 
 	oJSON, err := json.Marshal(object)
 	if err != nil {
@@ -168,14 +168,14 @@ func (testingNotJSONableObject) MarshalJSON() ([]byte, error) {
 
 func TestMiddlewareInvalidJSONInResponse(t *testing.T) {
 	var err error
-	SetStore(NewMemStore())
+	s := NewServer(NewMemStore(), nil)
 
-	notJSONFunc := func(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	notJSONFunc := func(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 		return testingNotJSONableObject{}, nil
 	}
 	recorder := httptest.NewRecorder()
 
-	h := H(notJSONFunc)
+	h := s.H(notJSONFunc)
 
 	request, err := http.NewRequest("GET", "ruta", &bytes.Buffer{})
 	if err != nil {
@@ -198,14 +198,14 @@ func TestMiddlewareInvalidJSONInResponse(t *testing.T) {
 func TestMiddlewareErrorProcessing(t *testing.T) {
 	const errText = "a error from f"
 	var err error
-	SetStore(NewMemStore())
+	s := NewServer(NewMemStore(), nil)
 
-	errFunc := func(ctx *context, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	errFunc := func(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
 		return nil, &Error{statusCode: http.StatusBadRequest, message: errText}
 	}
 	recorder := httptest.NewRecorder()
 
-	h := H(errFunc)
+	h := s.H(errFunc)
 
 	request, err := http.NewRequest("GET", "ruta", &bytes.Buffer{})
 	if err != nil {
@@ -0,0 +1,259 @@
+package almacen
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const jsonPatchContentType = "application/json-patch+json"
+
+// PatchOp is an operation of a JSON Patch (RFC 6902). Path and From are JSON Pointers
+type PatchOp struct {
+	Op    string
+	Path  string
+	From  string
+	Value interface{}
+}
+
+var errPatchPath = &Error{statusCode: http.StatusConflict, message: "path not found"}
+
+func patchErr(i int, op *PatchOp, err error) error {
+	e, isError := err.(*Error)
+	if !isError {
+		return err
+	}
+	return &Error{
+		statusCode: e.statusCode,
+		message:    fmt.Sprintf("patch operation %d (%s %q): %s", i, op.Op, op.Path, e.message),
+	}
+}
+
+// parsePatch reads the operations of a JSON Patch document
+func parsePatch(input interface{}) ([]PatchOp, error) {
+	list, isArray := input.([]interface{})
+	if !isArray {
+		return nil, ErrArrayExpected
+	}
+	ops := make([]PatchOp, len(list))
+	for i, e := range list {
+		m, isObject := e.(map[string]interface{})
+		if !isObject {
+			return nil, ErrObjectExpected
+		}
+		op := &ops[i]
+		op.Op, _ = m["op"].(string)
+		path, isString := m["path"].(string)
+		if !isString {
+			return nil, patchErr(i, op, &Error{statusCode: http.StatusBadRequest, message: "missing path"})
+		}
+		op.Path = path
+		switch op.Op {
+		case "add", "replace", "test":
+			value, found := m["value"]
+			if !found {
+				return nil, patchErr(i, op, &Error{statusCode: http.StatusBadRequest, message: "missing value"})
+			}
+			op.Value = value
+		case "move", "copy":
+			from, isString := m["from"].(string)
+			if !isString {
+				return nil, patchErr(i, op, &Error{statusCode: http.StatusBadRequest, message: "missing from"})
+			}
+			op.From = from
+		case "remove":
+		default:
+			return nil, patchErr(i, op, &Error{statusCode: http.StatusBadRequest, message: "unknown operation"})
+		}
+	}
+	return ops, nil
+}
+
+// splitPointer returns the reference tokens of a JSON Pointer, none for the whole document
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, &Error{statusCode: http.StatusBadRequest, message: "invalid pointer"}
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		if strings.Contains(pointerEscapes.Replace(t), "~") {
+			return nil, &Error{statusCode: http.StatusBadRequest, message: "invalid pointer"}
+		}
+		tokens[i] = pointerUnescaper.Replace(t)
+	}
+	return tokens, nil
+}
+
+var (
+	pointerEscapes   = strings.NewReplacer("~0", "", "~1", "")
+	pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+)
+
+// applyPatch applies ops to ent, which may be modified, returning the patched entity.
+// The ID of the entity cannot change
+func applyPatch(ent map[string]interface{}, ops []PatchOp) (map[string]interface{}, error) {
+	id := ent["_id"]
+	var doc interface{} = ent
+	for i := range ops {
+		op := &ops[i]
+		var err error
+		doc, err = applyPatchOp(doc, op)
+		if err != nil {
+			return nil, patchErr(i, op, pointerErr(err))
+		}
+	}
+	ent, isObject := doc.(map[string]interface{})
+	if !isObject {
+		return nil, ErrObjectExpected
+	}
+	if ent["_id"] != id {
+		return nil, ErrChangingID
+	}
+	return ent, nil
+}
+
+// pointerErr turns the errors of the field path traversal into errPatchPath, as for a
+// JSON Patch they all mean that the path is not in the document
+func pointerErr(err error) error {
+	switch err {
+	case ErrNotFound, ErrIndexOutOfRange, ErrParentNotFound, ErrTraversingObject:
+		return errPatchPath
+	}
+	return err
+}
+
+func applyPatchOp(doc interface{}, op *PatchOp) (interface{}, error) {
+	path, err := splitPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, copyValue(op.Value))
+	case "remove":
+		doc, _, err = removeValue(doc, path)
+		return doc, err
+	case "replace":
+		if len(path) > 0 {
+			if doc, _, err = removeValue(doc, path); err != nil {
+				return nil, err
+			}
+		}
+		return addValue(doc, path, copyValue(op.Value))
+	case "test":
+		value, err := lookupPath(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(value, op.Value) {
+			return nil, &Error{statusCode: http.StatusConflict, message: "test failed"}
+		}
+		return doc, nil
+	}
+
+	from, err := splitPointer(op.From)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if op.Op == "move" {
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, &Error{statusCode: http.StatusBadRequest, message: "cannot move into itself"}
+		}
+		doc, value, err = removeValue(doc, from)
+	} else {
+		value, err = lookupPath(doc, from)
+		value = copyValue(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return addValue(doc, path, value)
+}
+
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return fieldContainer(doc, path, false, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			if token == "-" {
+				return append(c, value), nil
+			}
+			i, err := elementIndex(token, len(c)+1)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, errPatchPath
+	})
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, &Error{statusCode: http.StatusBadRequest, message: "cannot remove the whole entity"}
+	}
+	var removed interface{}
+	doc, err := fieldContainer(doc, path, false, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			value, found := c[token]
+			if !found {
+				return nil, errPatchPath
+			}
+			removed = value
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := elementIndex(token, len(c))
+			if err != nil {
+				return nil, err
+			}
+			removed = c[i]
+			return append(c[:i:i], c[i+1:]...), nil
+		}
+		return nil, errPatchPath
+	})
+	return doc, removed, err
+}
+
+// jsonEqual compares JSON values, numbers by value whatever their type
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, isObject := b.(map[string]interface{})
+		if !isObject || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, found := b[k]; !found || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, isArray := b.([]interface{})
+		if !isArray || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	c, comparable := compareValues(a, b)
+	return comparable && c == 0
+}
@@ -0,0 +1,117 @@
+package almacen
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustPatch(s string, t *testing.T) []PatchOp {
+	var input interface{}
+	if err := json.Unmarshal([]byte(s), &input); err != nil {
+		t.Fatal(err)
+	}
+	ops, err := parsePatch(input)
+	if err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return ops
+}
+
+func mustEntity(s string, t *testing.T) map[string]interface{} {
+	var ent map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &ent); err != nil {
+		t.Fatal(err)
+	}
+	return ent
+}
+
+// cases from the appendix of RFC 6902
+func TestApplyPatch(t *testing.T) {
+	for _, c := range []struct {
+		doc, patch, wanted string
+	}{
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz": "qux", "foo": "bar"}`},
+		{`{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo": ["bar", "qux", "baz"]}`},
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo": "bar"}`},
+		{`{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo": ["bar", "baz"]}`},
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`, `{"baz": "boo", "foo": "bar"}`},
+		{
+			`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			`[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			`{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`,
+		},
+		{`{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`, `{"foo": ["all", "cows", "eat", "grass"]}`},
+		{
+			`{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			`[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			`{"baz": "qux", "foo": ["a", 2, "c"]}`,
+		},
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`, `{"foo": "bar", "child": {"grandchild": {}}}`},
+		{`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`, `{"foo": ["bar", ["abc", "def"]]}`},
+		{`{"foo": null}`, `[{"op": "test", "path": "/foo", "value": null}]`, `{"foo": null}`},
+		{`{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": 10}, {"op": "copy", "from": "/~1", "path": "/c"}]`, `{"/": 9, "~1": 10, "c": 9}`},
+		{`{"a": {"b": [1]}}`, `[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "add", "path": "/c/b/0", "value": 0}]`, `{"a": {"b": [1]}, "c": {"b": [0, 1]}}`},
+		{`{"a": 1}`, `[{"op": "replace", "path": "", "value": {"b": 2}}]`, `{"b": 2}`},
+	} {
+		got, err := applyPatch(mustEntity(c.doc, t), mustPatch(c.patch, t))
+		if err != nil {
+			t.Errorf("%s %s: %v", c.doc, c.patch, err)
+			continue
+		}
+		if wanted := mustEntity(c.wanted, t); !reflect.DeepEqual(got, wanted) {
+			t.Errorf("%s %s: wanted %v, got %v", c.doc, c.patch, wanted, got)
+		}
+	}
+}
+
+func TestApplyPatchErr(t *testing.T) {
+	for _, c := range []struct {
+		doc, patch string
+		code       int
+		message    string
+	}{
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`, http.StatusConflict, `patch operation 0 (add "/baz/bat"): path not found`},
+		{`{"baz": "qux"}`, `[{"op": "test", "path": "/baz", "value": "bar"}]`, http.StatusConflict, "test failed"},
+		{`{"foo": "bar"}`, `[{"op": "remove", "path": "/foo"}, {"op": "remove", "path": "/foo"}]`, http.StatusConflict, `patch operation 1 (remove "/foo")`},
+		{`{"foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": 1}]`, http.StatusConflict, "path not found"},
+		{`{"foo": [1]}`, `[{"op": "add", "path": "/foo/2", "value": 1}]`, http.StatusConflict, "path not found"},
+		{`{"foo": [1]}`, `[{"op": "add", "path": "/foo/01", "value": 1}]`, http.StatusConflict, "path not found"},
+		{`{"foo": [1]}`, `[{"op": "test", "path": "/foo/-", "value": 1}]`, http.StatusConflict, "path not found"},
+		{`{"foo": 1}`, `[{"op": "test", "path": "/foo", "value": "1"}]`, http.StatusConflict, "test failed"},
+		{`{"foo": {"a": 1}}`, `[{"op": "move", "from": "/foo", "path": "/foo/b"}]`, http.StatusBadRequest, "cannot move into itself"},
+		{`{"foo": 1}`, `[{"op": "add", "path": "foo", "value": 1}]`, http.StatusBadRequest, "invalid pointer"},
+		{`{"foo": 1}`, `[{"op": "add", "path": "/~2", "value": 1}]`, http.StatusBadRequest, "invalid pointer"},
+		{`{"foo": 1}`, `[{"op": "remove", "path": ""}]`, http.StatusBadRequest, "cannot remove"},
+		{`{"foo": 1}`, `[{"op": "add", "path": "", "value": []}]`, http.StatusBadRequest, ErrObjectExpected.message},
+		{`{"_id": "id"}`, `[{"op": "replace", "path": "/_id", "value": "other"}]`, http.StatusBadRequest, ErrChangingID.message},
+	} {
+		_, err := applyPatch(mustEntity(c.doc, t), mustPatch(c.patch, t))
+		e, isError := err.(*Error)
+		if !isError || e.statusCode != c.code || !strings.Contains(e.message, c.message) {
+			t.Errorf("%s %s: wanted %d %q, got %v", c.doc, c.patch, c.code, c.message, err)
+		}
+	}
+}
+
+func TestParsePatchErr(t *testing.T) {
+	for _, s := range []string{
+		`{"op": "add", "path": "/a", "value": 1}`,
+		`[1]`,
+		`[{"op": "add", "path": "/a"}]`,
+		`[{"op": "add", "value": 1}]`,
+		`[{"op": "move", "path": "/a"}]`,
+		`[{"op": "rename", "path": "/a"}]`,
+		`[{"path": "/a"}]`,
+	} {
+		var input interface{}
+		if err := json.Unmarshal([]byte(s), &input); err != nil {
+			t.Fatal(err)
+		}
+		if ops, err := parsePatch(input); err == nil {
+			t.Errorf("%s: wanted error, got %v", s, ops)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package almacen
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Query selects a page of the entities of a collection, ordered by ID unless Sort says otherwise
+type Query struct {
+	After  string   // only entities with an ID greater than this one, or after SortAfter
+	Limit  int      // 0 for no limit
+	Skip   int      // entities left out before the first one
+	Filter *Filter  // nil for every entity
+	Fields []string // the fields returned, besides the ID. Every one if empty
+	Sort   []string // fields to order by, descending if prefixed with "-". Ties are ordered by ID
+	// SortAfter, if not nil, has a value for every field of Sort, and selects only the
+	// entities after them in its order, or with the same ones and an ID greater than After
+	SortAfter []interface{}
+}
+
+var (
+	ErrInvalidLimit  = &Error{statusCode: 400, message: "invalid limit"}
+	ErrInvalidCursor = &Error{statusCode: 400, message: "invalid cursor"}
+	ErrInvalidFields = &Error{statusCode: 400, message: "invalid fields"}
+	ErrInvalidSort   = &Error{statusCode: 400, message: "invalid sort"}
+)
+
+// cursor is where the next page starts. Clients only see it encoded
+type cursor struct {
+	After     string        `json:"a,omitempty"`
+	SortAfter []interface{} `json:"k,omitempty"` // for sorted queries
+}
+
+func (c *cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// parseQuery reads the limit, filter, fields, sort and cursor parameters
+func parseQuery(values url.Values) (*Query, error) {
+	fields, err := parseFields(values.Get("fields"))
+	if err != nil {
+		return nil, err
+	}
+	q := &Query{Fields: fields}
+	if q.Sort, err = parseSort(values.Get("sort")); err != nil {
+		return nil, err
+	}
+	if q.Limit, err = parseLimit(values.Get("limit")); err != nil {
+		return nil, err
+	}
+	filter, err := ParseFilter(values.Get("filter"))
+	if err != nil {
+		return nil, err
+	}
+	q.Filter = filter
+	if s := values.Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(c.SortAfter) != len(q.Sort) {
+			return nil, ErrInvalidCursor
+		}
+		q.After, q.SortAfter = c.After, c.SortAfter
+	}
+	return q, nil
+}
+
+// Next returns the query for the entities after ent, the last one of the page of q. It
+// must have the fields of the sort, even if they are not among those returned
+func (q *Query) Next(ent map[string]interface{}) *Query {
+	next := *q
+	next.Skip = 0
+	next.After, _ = ent["_id"].(string)
+	if len(q.Sort) > 0 {
+		next.SortAfter = sortKeys(ent, q.Sort)
+	}
+	return &next
+}
+
+// follows tells whether the entity comes after SortAfter and After in the order of q
+func (q *Query) follows(id string, ent map[string]interface{}) bool {
+	keys := sortKeys(ent, q.Sort)
+	if lessSortKeys(q.SortAfter, keys, q.Sort) {
+		return true
+	}
+	return !lessSortKeys(keys, q.SortAfter, q.Sort) && id > q.After
+}
+
+// parseLimit reads a limit parameter, 0 if empty
+func parseLimit(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, ErrInvalidLimit
+	}
+	return n, nil
+}
+
+// parseSort reads fields to order by like "a,-b.c"
+func parseSort(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.Split(s, ",")
+	for _, field := range fields {
+		if !validPath(strings.TrimPrefix(field, "-")) {
+			return nil, ErrInvalidSort
+		}
+	}
+	return fields, nil
+}
+
+// parseFields reads a projection like "a,b.c". A field cannot be inside another one
+func parseFields(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.Split(s, ",")
+	for i, f := range fields {
+		if !validPath(f) {
+			return nil, ErrInvalidFields
+		}
+		for _, other := range fields[:i] {
+			if f == other || strings.HasPrefix(f, other+".") || strings.HasPrefix(other, f+".") {
+				return nil, ErrInvalidFields
+			}
+		}
+	}
+	return fields, nil
+}
+
+// validPath checks a dotted path has no empty segments nor MongoDB operators
+func validPath(path string) bool {
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" || strings.HasPrefix(segment, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// projectEntity copies the ID and the fields of ent. Arrays in the path keep only their
+// objects, projected in turn, as MongoDB does
+func projectEntity(ent map[string]interface{}, fields []string) map[string]interface{} {
+	res := make(map[string]interface{}, len(fields)+1)
+	if id, found := ent["_id"]; found {
+		res["_id"] = id
+	}
+	for _, f := range fields {
+		projectPath(ent, res, strings.Split(f, "."))
+	}
+	return res
+}
+
+func projectPath(src, dst map[string]interface{}, path []string) {
+	v, found := src[path[0]]
+	if !found {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = copyValue(v)
+		return
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		sub, _ := dst[path[0]].(map[string]interface{})
+		if sub == nil {
+			sub = make(map[string]interface{})
+			dst[path[0]] = sub
+		}
+		projectPath(v, sub, path[1:])
+	case []interface{}:
+		var objects []map[string]interface{}
+		for _, elem := range v {
+			if object, isObject := elem.(map[string]interface{}); isObject {
+				objects = append(objects, object)
+			}
+		}
+		subs, _ := dst[path[0]].([]interface{})
+		if subs == nil {
+			subs = make([]interface{}, len(objects))
+			for i := range subs {
+				subs[i] = make(map[string]interface{})
+			}
+			dst[path[0]] = subs
+		}
+		for i, object := range objects {
+			projectPath(object, subs[i].(map[string]interface{}), path[1:])
+		}
+	}
+}
+
+// sortIDs orders ids by the fields of their entities as MongoDB does: an array sorts by its
+// least element, or greatest if descending, and values of different types by type. ids must
+// be ordered already, to break ties
+func sortIDs(ids []string, docs map[string]map[string]interface{}, fields []string) {
+	keys := make(map[string][]interface{}, len(ids))
+	for _, id := range ids {
+		keys[id] = sortKeys(docs[id], fields)
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return lessSortKeys(keys[ids[i]], keys[ids[j]], fields)
+	})
+}
+
+// sortEntities orders ents as sortIDs does
+func sortEntities(ents []map[string]interface{}, fields []string) {
+	keys := make([][]interface{}, len(ents))
+	for i, ent := range ents {
+		keys[i] = sortKeys(ent, fields)
+	}
+	sort.Stable(&entitySorter{ents, keys, fields})
+}
+
+type entitySorter struct {
+	ents   []map[string]interface{}
+	keys   [][]interface{}
+	fields []string
+}
+
+func (s *entitySorter) Len() int { return len(s.ents) }
+func (s *entitySorter) Swap(i, j int) {
+	s.ents[i], s.ents[j] = s.ents[j], s.ents[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+func (s *entitySorter) Less(i, j int) bool { return lessSortKeys(s.keys[i], s.keys[j], s.fields) }
+
+func sortKeys(ent map[string]interface{}, fields []string) []interface{} {
+	keys := make([]interface{}, len(fields))
+	for i, f := range fields {
+		keys[i] = sortKey(ent, f)
+	}
+	return keys
+}
+
+func lessSortKeys(ki, kj []interface{}, fields []string) bool {
+	for n, f := range fields {
+		c := compareSortValues(ki[n], kj[n])
+		if strings.HasPrefix(f, "-") {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+func sortKey(ent map[string]interface{}, field string) interface{} {
+	desc := strings.HasPrefix(field, "-")
+	values, missing := resolvePath(ent, strings.Split(strings.TrimPrefix(field, "-"), "."))
+	var candidates []interface{}
+	if missing {
+		candidates = append(candidates, nil)
+	}
+	for _, v := range values {
+		if array, isArray := v.([]interface{}); isArray && len(array) > 0 {
+			candidates = append(candidates, array...)
+		} else if !isArray {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	key := candidates[0]
+	for _, v := range candidates[1:] {
+		if c := compareSortValues(v, key); (c < 0 && !desc) || (c > 0 && desc) {
+			key = v
+		}
+	}
+	return key
+}
+
+// sortRank follows the order of types of MongoDB
+func sortRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 1
+	case string:
+		return 3
+	case map[string]interface{}:
+		return 4
+	case []interface{}:
+		return 5
+	case bool:
+		return 8
+	}
+	if _, isNumber := toFloat(v); isNumber {
+		return 2
+	}
+	return 10
+}
+
+func compareSortValues(a, b interface{}) int {
+	if ra, rb := sortRank(a), sortRank(b); ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	c, _ := compareValues(a, b)
+	return c
+}
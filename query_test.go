@@ -0,0 +1,43 @@
+package almacen
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	for _, s := range []string{"a,", ",a", "a..b", "a,$b", "a,a", "a,a.b", "a.b,a"} {
+		if fields, err := parseFields(s); err != ErrInvalidFields {
+			t.Errorf("%q: wanted %v, got %v %v", s, ErrInvalidFields, fields, err)
+		}
+	}
+	fields, err := parseFields("a.b,a.c,ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wanted := []string{"a.b", "a.c", "ab"}; !reflect.DeepEqual(fields, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, fields)
+	}
+}
+
+func TestProjectEntity(t *testing.T) {
+	ent := map[string]interface{}{
+		"_id": "id",
+		"a":   map[string]interface{}{"b": 1.0, "c": 2.0, "d": 3.0},
+		"e":   []interface{}{1.0, map[string]interface{}{"f": 1.0, "g": 2.0}, map[string]interface{}{"g": 3.0}},
+		"h":   "scalar",
+	}
+	got := projectEntity(ent, []string{"a.b", "a.c", "e.f", "h.i", "missing"})
+	wanted := map[string]interface{}{
+		"_id": "id",
+		"a":   map[string]interface{}{"b": 1.0, "c": 2.0},
+		"e":   []interface{}{map[string]interface{}{"f": 1.0}, map[string]interface{}{}},
+	}
+	if !reflect.DeepEqual(got, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, got)
+	}
+	got["a"].(map[string]interface{})["b"] = 0.0
+	if ent["a"].(map[string]interface{})["b"] != 1.0 {
+		t.Errorf("projection shares maps with the entity")
+	}
+}
@@ -0,0 +1,96 @@
+package almacen
+
+import (
+	"context"
+	"strings"
+)
+
+// RevField keeps the revision of every entity, changed by the store on every write. It is
+// not returned with the entity, only by FindField and FindWithRevision, and cannot be
+// written by clients
+const RevField = "_rev"
+
+func newRevision() string {
+	return newObjectID()
+}
+
+// withRevision returns a shallow copy of ent at a new revision
+func withRevision(ent map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(ent)+1)
+	for k, v := range ent {
+		c[k] = v
+	}
+	c[RevField] = newRevision()
+	return c
+}
+
+func isRevPath(field string) bool {
+	return field == RevField || strings.HasPrefix(field, RevField+".")
+}
+
+// RevisionFinder is implemented by stores able to read an entity together with its
+// revision, so that both are of the same version
+type RevisionFinder interface {
+	// FindWithRevision is as FindByID, also returning the revision, "" if there is none
+	FindWithRevision(ctx context.Context, collection, id string) (map[string]interface{}, string, error)
+	// FindFieldWithRevision is as FindField, also returning the revision of the entity
+	FindFieldWithRevision(ctx context.Context, collection, id, field string) (interface{}, string, error)
+}
+
+// findWithRevision reads the entity and its revision from store. If it is not a
+// RevisionFinder, the revision is read first, so a concurrent change can only make it
+// older than the entity, failing a later If-Match instead of losing the change
+func findWithRevision(ctx context.Context, store Store, collection, id string) (map[string]interface{}, string, error) {
+	if finder, ok := store.(RevisionFinder); ok {
+		return finder.FindWithRevision(ctx, collection, id)
+	}
+	value, _ := store.FindField(ctx, collection, id, RevField)
+	rev, _ := value.(string)
+	ent, err := store.FindByID(ctx, collection, id)
+	return ent, rev, err
+}
+
+// findFieldWithRevision is as findWithRevision, reading only a field of the entity
+func findFieldWithRevision(ctx context.Context, store Store, collection, id, field string) (interface{}, string, error) {
+	if finder, ok := store.(RevisionFinder); ok {
+		return finder.FindFieldWithRevision(ctx, collection, id, field)
+	}
+	value, _ := store.FindField(ctx, collection, id, RevField)
+	rev, _ := value.(string)
+	value, err := store.FindField(ctx, collection, id, field)
+	return value, rev, err
+}
+
+type ifMatchKey struct{}
+
+// WithIfMatch returns a copy of parent whose writes fail with ErrPreconditionFailed unless
+// the entity is at revision rev
+func WithIfMatch(parent context.Context, rev string) context.Context {
+	return context.WithValue(parent, ifMatchKey{}, rev)
+}
+
+func ifMatchFromContext(c context.Context) (string, bool) {
+	rev, ok := c.Value(ifMatchKey{}).(string)
+	return rev, ok
+}
+
+// checkRevision fails if ctx requires a revision ent, maybe nil, is not at
+func checkRevision(ctx context.Context, ent map[string]interface{}) error {
+	rev, ok := ifMatchFromContext(ctx)
+	if ok && (ent == nil || ent[RevField] != rev) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+func etag(rev string) string {
+	return `"` + rev + `"`
+}
+
+// parseETag accepts a single strong entity tag
+func parseETag(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' || strings.Contains(s[1:len(s)-1], `"`) {
+		return "", false
+	}
+	return s[1 : len(s)-1], true
+}
@@ -0,0 +1,153 @@
+package almacen
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SearchHit is an entity found by its words, with the score of its relevance. Scores
+// depend on the backend, they only order the hits of a search
+type SearchHit struct {
+	Score  float64                `json:"score"`
+	Entity map[string]interface{} `json:"entity"`
+}
+
+var (
+	ErrInvalidSearch = &Error{statusCode: 400, message: "invalid search, expected some words"}
+	ErrNoTextIndex   = &Error{statusCode: 400, message: "no text index to search"}
+)
+
+// tokenize splits text into lowercase words of letters and digits, without stemming
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchTerms returns the distinct words of a search
+func searchTerms(text string) []string {
+	var terms []string
+	seen := map[string]bool{}
+	for _, term := range tokenize(text) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// textIndex is an inverted index of the words in some fields of the entities of a
+// collection, strings or arrays of strings. It is kept up to date with every change, so it
+// is never rebuilt but for whole collections
+type textIndex struct {
+	fields   [][]string                // paths of the fields, split
+	postings map[string]map[string]int // word -> entity ID -> occurrences
+	words    map[string]map[string]int // entity ID -> word -> occurrences
+	lengths  map[string]int            // entity ID -> number of words
+	total    int                       // words in every entity
+}
+
+func newTextIndex(fields []string, docs map[string]map[string]interface{}) *textIndex {
+	ix := &textIndex{
+		fields:   make([][]string, len(fields)),
+		postings: map[string]map[string]int{},
+		words:    map[string]map[string]int{},
+		lengths:  map[string]int{},
+	}
+	for i, field := range fields {
+		ix.fields[i] = strings.Split(field, ".")
+	}
+	for id, ent := range docs {
+		ix.add(id, ent)
+	}
+	return ix
+}
+
+// add indexes ent, which must not be in the index already
+func (ix *textIndex) add(id string, ent map[string]interface{}) {
+	words := map[string]int{}
+	n := 0
+	for _, path := range ix.fields {
+		values, _ := resolvePath(ent, path)
+		for _, v := range expandArrays(values) {
+			if s, isString := v.(string); isString {
+				n += countWords(s, words)
+			}
+		}
+	}
+	if n == 0 {
+		return
+	}
+	for word, occurrences := range words {
+		if ix.postings[word] == nil {
+			ix.postings[word] = map[string]int{}
+		}
+		ix.postings[word][id] = occurrences
+	}
+	ix.words[id] = words
+	ix.lengths[id] = n
+	ix.total += n
+}
+
+func (ix *textIndex) remove(id string) {
+	for word := range ix.words[id] {
+		delete(ix.postings[word], id)
+		if len(ix.postings[word]) == 0 {
+			delete(ix.postings, word)
+		}
+	}
+	ix.total -= ix.lengths[id]
+	delete(ix.words, id)
+	delete(ix.lengths, id)
+}
+
+func countWords(s string, words map[string]int) int {
+	n := 0
+	for _, word := range tokenize(s) {
+		words[word]++
+		n++
+	}
+	return n
+}
+
+// BM25 parameters, the usual ones
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// search scores with BM25 the entities having any of the terms, among docs entities in
+// total. They are ordered by score, and then by ID
+func (ix *textIndex) search(terms []string, docs int) []textScore {
+	scores := map[string]float64{}
+	avgLength := float64(ix.total) / math.Max(float64(len(ix.lengths)), 1)
+	for _, term := range terms {
+		postings := ix.postings[term]
+		n := float64(len(postings))
+		idf := math.Log(1 + (float64(docs)-n+0.5)/(n+0.5))
+		for id, occurrences := range postings {
+			tf := float64(occurrences)
+			norm := 1 - bm25B + bm25B*float64(ix.lengths[id])/avgLength
+			scores[id] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+	hits := make([]textScore, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, textScore{id, score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].id < hits[j].id
+	})
+	return hits
+}
+
+type textScore struct {
+	id    string
+	score float64
+}
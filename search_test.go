@@ -0,0 +1,53 @@
+package almacen
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	for _, c := range []struct {
+		text   string
+		wanted []string
+	}{
+		{"Very hot", []string{"very", "hot"}},
+		{"  hot,hot-day!", []string{"hot", "hot", "day"}},
+		{"Año 2024", []string{"año", "2024"}},
+		{" -- ", []string{}},
+	} {
+		if got := tokenize(c.text); !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("%q: wanted %v, got %v", c.text, c.wanted, got)
+		}
+	}
+	if got, wanted := searchTerms("hot cold HOT"), []string{"hot", "cold"}; !reflect.DeepEqual(got, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, got)
+	}
+}
+
+func TestTextIndex(t *testing.T) {
+	fields := []string{"label", "tags", "tags.x"}
+	ix := newTextIndex(fields, map[string]map[string]interface{}{
+		"a": {"_id": "a", RevField: "hot", "label": "very hot", "notes": "hot hot hot"},
+		"b": {"_id": "b", "label": "hot hot", "n": 1.0},
+		"c": {"_id": "c", "tags": []interface{}{"cold", map[string]interface{}{"x": "hot water"}}},
+	})
+	var ids []string
+	for _, ts := range ix.search([]string{"hot"}, 3) {
+		ids = append(ids, ts.id)
+	}
+	// b has the word twice, a and c once, but c has more words, and the notes are not indexed
+	if wanted := []string{"b", "a", "c"}; !reflect.DeepEqual(ids, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, ids)
+	}
+
+	ix.remove("b")
+	ix.remove("c")
+	ix.add("c", map[string]interface{}{"_id": "c", "label": "cold"})
+	wanted := newTextIndex(fields, map[string]map[string]interface{}{
+		"a": {"label": "very hot"},
+		"c": {"label": "cold"},
+	})
+	if !reflect.DeepEqual(ix, wanted) {
+		t.Errorf("wanted %+v, got %+v", wanted, ix)
+	}
+}
@@ -0,0 +1,81 @@
+package almacen
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/crbrox/almacen/ctx"
+	"github.com/julienschmidt/httprouter"
+)
+
+const DefaultMaxConcurrentConn = 100
+
+// Server is an almacen instance serving a Store over HTTP. Several of them can
+// live in the same process, each one with its own store, configuration and limits.
+type Server struct {
+	store       Store
+	infoLogger  ctx.Logger
+	debugLogger ctx.Logger
+	prefix      string
+	newID       func() string
+	sem         chan struct{} // bounds the requests being processed
+	router      *httprouter.Router
+}
+
+type Option func(*Server)
+
+// WithLoggers replaces the package loggers, DebugLogger and InfoLogger
+func WithLoggers(info, debug ctx.Logger) Option {
+	return func(s *Server) {
+		s.infoLogger = info
+		s.debugLogger = debug
+	}
+}
+
+// WithMaxConcurrentConn limits the requests processed at the same time, the rest get a 503
+func WithMaxConcurrentConn(n int) Option {
+	return func(s *Server) {
+		s.sem = make(chan struct{}, n)
+	}
+}
+
+// WithPrefix mounts the routes under prefix, as "/api" for "/api/:col/:id".
+// Not needed if the prefix is removed before, as with http.StripPrefix
+func WithPrefix(prefix string) Option {
+	return func(s *Server) {
+		s.prefix = prefix
+	}
+}
+
+// RequestScoper is implemented by stores needing resources for each request, as
+// a Mongo session. The server calls BeginRequest before the store is used and the
+// returned function once the request is done.
+type RequestScoper interface {
+	BeginRequest(ctx context.Context) (context.Context, func())
+}
+
+func NewServer(store Store, config *Config, options ...Option) *Server {
+	if config == nil {
+		config = &Config{}
+	}
+	s := &Server{
+		store:       store,
+		infoLogger:  InfoLogger,
+		debugLogger: DebugLogger,
+		sem:         make(chan struct{}, DefaultMaxConcurrentConn),
+		newID:       idGenerators[config.IDScheme],
+	}
+	if s.newID == nil {
+		s.newID = newUUID
+	}
+	for _, option := range options {
+		option(s)
+	}
+	s.router = httprouter.New()
+	s.AddRoutes(s.router)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.router.ServeHTTP(w, req)
+}
@@ -0,0 +1,98 @@
+package almacen
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func doRequest(h http.Handler, method, path string, body interface{}, t *testing.T) *httptest.ResponseRecorder {
+	return doRequestHeader(h, method, path, nil, body, t)
+}
+
+// doRequestHeader sends body encoded as JSON, unless it is a []byte
+func doRequestHeader(h http.Handler, method, path string, header http.Header, body interface{}, t *testing.T) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	if raw, isRaw := body.([]byte); isRaw {
+		buffer.Write(raw)
+	} else if body != nil {
+		if err := json.NewEncoder(&buffer).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request, err := http.NewRequest(method, path, &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		request.Header[k] = v
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestServerIndependentInstances(t *testing.T) {
+	mux := http.NewServeMux()
+	storeA, storeB := NewMemStore(), NewMemStore()
+	mux.Handle("/a/", NewServer(storeA, nil, WithPrefix("/a")))
+	mux.Handle("/b/", http.StripPrefix("/b", NewServer(storeB, nil)))
+
+	entity := map[string]interface{}{"x": "X"}
+	if code := doRequest(mux, "PUT", "/a/col/ID", entity, t).Code; code != http.StatusCreated {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusCreated, code)
+	}
+
+	recorder := doRequest(mux, "GET", "/a/col/ID", nil, t)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code: wanted %d, got %d", http.StatusOK, recorder.Code)
+	}
+	var got map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"_id": "ID", "x": "X"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("entity: wanted %v, got %v", expected, got)
+	}
+
+	if code := doRequest(mux, "GET", "/b/col/ID", nil, t).Code; code != http.StatusNotFound {
+		t.Errorf("status code: wanted %d, got %d", http.StatusNotFound, code)
+	}
+	if _, err := storeB.FindByID(contextTest, "col", "ID"); err != ErrNotFound {
+		t.Errorf("second store: wanted %v, got %v", ErrNotFound, err)
+	}
+}
+
+func TestServerMaxConcurrentConn(t *testing.T) {
+	s := NewServer(NewMemStore(), nil, WithMaxConcurrentConn(1))
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	f := func(ctx *requestContext, w http.ResponseWriter, req *http.Request) (interface{}, error) {
+		close(blocked)
+		<-release
+		return nil, nil
+	}
+	h := s.H(f)
+	request, err := http.NewRequest("GET", "ruta", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		h(httptest.NewRecorder(), request, nil)
+		close(done)
+	}()
+	<-blocked
+
+	recorder := httptest.NewRecorder()
+	h(recorder, request, nil)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code: wanted %d, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	close(release)
+	<-done
+}
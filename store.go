@@ -1,16 +1,14 @@
 package almacen
 
 import (
+	"context"
+	"sort"
+	"strings"
+
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-var store Store
-
-func SetStore(es Store) {
-	store = es
-}
-
 type MongoConfig struct {
 	URL string
 }
@@ -19,14 +17,134 @@ type MongoEntityStore struct {
 	session *mgo.Session
 }
 
+// Store is the persistence backend. Every operation gets the context of the request,
+// so implementations can honor its cancellation and deadline.
 type Store interface {
-	FindAll(ctx *context, collection string) ([]map[string]interface{}, error)
-	FindByID(ctx *context, collection, id string) (map[string]interface{}, error)
-	Save(ctx *context, collection string, ent map[string]interface{}) error
-	Delete(ctx *context, collection, id string) error
-	FindField(ctx *context, collection, id, field string) (interface{}, error)
-	UpdateField(ctx *context, collection, id, field string, value interface{}) error
-	DeleteField(ctx *context, collection, id, field string) error
+	FindAll(ctx context.Context, collection string) ([]map[string]interface{}, error)
+	// Find returns the entities selected by q, ordered by ID
+	Find(ctx context.Context, collection string, q *Query) ([]map[string]interface{}, error)
+	// Iterate calls fn for every entity selected by q, in the same order as Find,
+	// without loading all of them at once. It stops at the first error from fn, returning it
+	Iterate(ctx context.Context, collection string, q *Query, fn func(ent map[string]interface{}) error) error
+	FindByID(ctx context.Context, collection, id string) (map[string]interface{}, error)
+	Save(ctx context.Context, collection string, ent map[string]interface{}) error
+	// Insert is as Save, but fails with ErrExisting if there is an entity with the same ID
+	Insert(ctx context.Context, collection string, ent map[string]interface{}) error
+	// Replace is as Save, but fails with ErrNotFound if there is no entity with the same ID
+	Replace(ctx context.Context, collection string, ent map[string]interface{}) error
+	Delete(ctx context.Context, collection, id string) error
+	FindField(ctx context.Context, collection, id, field string) (interface{}, error)
+	// UpdateField sets a field whose parent must exist, ErrParentNotFound otherwise. A value
+	// on the way which is not an object is an ErrTraversingObject. Update with Set creates
+	// the missing parents instead
+	UpdateField(ctx context.Context, collection, id, field string, value interface{}) error
+	// DeleteField removes the field, doing nothing if it is missing
+	DeleteField(ctx context.Context, collection, id, field string) error
+	// Update applies every change of u to the entity at once, ErrNotFound if there is none
+	Update(ctx context.Context, collection, id string, u *Update) error
+	// Patch applies the JSON Patch operations to the entity at once, or none of them if any fails
+	Patch(ctx context.Context, collection, id string, ops []PatchOp) error
+}
+
+// The following interfaces are features a Store may have. The server answers
+// ErrNotImplemented to the requests needing one its store does not have. They are looked
+// for in the Backend of the store, as a Wrapper has those of the store it wraps.
+
+// Wrapper is a store in front of another one, as CachingStore
+type Wrapper interface {
+	Store
+	// Unwrap returns the store it is in front of
+	Unwrap() Store
+}
+
+// Backend returns the store behind every Wrapper in front of s, s itself if it is not one
+func Backend(s Store) Store {
+	for {
+		w, isWrapper := s.(Wrapper)
+		if !isWrapper {
+			return s
+		}
+		s = w.Unwrap()
+	}
+}
+
+// CollectionWriter writes whole collections. A Wrapper may be one, to know of the changes,
+// but only those of a Backend being one are: AsCollectionWriter finds them
+type CollectionWriter interface {
+	// ReplaceCollection replaces every entity of the collection with ents, atomically for
+	// readers. It fails with ErrExisting if an ID is repeated
+	ReplaceCollection(ctx context.Context, collection string, ents []map[string]interface{}) error
+	// DropCollection removes the collection, ErrNotFound if there is none
+	DropCollection(ctx context.Context, collection string) error
+}
+
+// AsCollectionWriter returns the first store from s to its Backend being a CollectionWriter,
+// if the Backend is one
+func AsCollectionWriter(s Store) (CollectionWriter, bool) {
+	if _, ok := Backend(s).(CollectionWriter); !ok {
+		return nil, false
+	}
+	for {
+		if cw, ok := s.(CollectionWriter); ok {
+			return cw, true
+		}
+		s = s.(Wrapper).Unwrap()
+	}
+}
+
+// CollectionLister describes the collections
+type CollectionLister interface {
+	// Collections describes every collection, ordered by name
+	Collections(ctx context.Context) ([]CollectionInfo, error)
+	// Count returns the number of entities of the collection, 0 if there is none
+	Count(ctx context.Context, collection string) (int, error)
+}
+
+// Aggregator runs aggregation pipelines
+type Aggregator interface {
+	// Aggregate runs the pipeline over the entities of the collection, returning what its
+	// last stage makes
+	Aggregate(ctx context.Context, collection string, pipeline []Stage) ([]map[string]interface{}, error)
+}
+
+// Searcher searches entities by words
+type Searcher interface {
+	// Search returns the entities with any of the words of text in the fields of the text
+	// index of the collection, the most relevant first, up to limit if it is not 0.
+	// ErrInvalidSearch if text has no words, ErrNoTextIndex if the collection has no text
+	// index, or there is no collection
+	Search(ctx context.Context, collection, text string, limit int) ([]SearchHit, error)
+}
+
+// Indexer keeps secondary and unique indexes declared for a collection
+type Indexer interface {
+	// EnsureIndex creates the index if there is none with the same name and fields,
+	// ErrIndexConflict if there is one with only the same name or the same fields. A unique
+	// index fails with ErrDuplicateKey if some entities repeat a key. Indexes are kept when
+	// replacing the collection and removed when dropping it
+	EnsureIndex(ctx context.Context, collection string, spec IndexSpec) error
+	// Indexes describes the indexes declared with EnsureIndex, ordered by name
+	Indexes(ctx context.Context, collection string) ([]IndexSpec, error)
+	// DropIndex removes the index with that name, ErrNotFound if there is none
+	DropIndex(ctx context.Context, collection, name string) error
+}
+
+// GeoQuerier finds entities by their location
+type GeoQuerier interface {
+	// Near returns the entities within radius meters of center, as the geo index on field
+	// tells, the nearest first and then by ID, up to limit if it is not 0. ErrNoGeoIndex if
+	// there is no such index
+	Near(ctx context.Context, collection, field string, center GeoPoint, radius float64, limit int) ([]GeoHit, error)
+	// Within returns the entities whose point at field is in the area, ordered by ID, up
+	// to limit if it is not 0. It does not need a geo index
+	Within(ctx context.Context, collection, field string, area *GeoArea, limit int) ([]map[string]interface{}, error)
+}
+
+// CollectionInfo describes a collection. Size is the approximate size of its entities, in bytes
+type CollectionInfo struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Size  int64  `json:"size"`
 }
 
 func (mes *MongoEntityStore) Start(config *Config) (err error) {
@@ -39,9 +157,6 @@ func (mes *MongoEntityStore) Start(config *Config) (err error) {
 	// Optional. Switch the session to a monotonic behavior.
 	mes.session.SetMode(mgo.Monotonic, true)
 
-	// Verificacion de indices ...
-	// Opcional ...
-
 	return nil
 }
 
@@ -49,80 +164,852 @@ func (mes *MongoEntityStore) Stop() {
 	mes.session.Close()
 }
 
-func (*MongoEntityStore) FindAll(ctx *context, collection string) ([]map[string]interface{}, error) {
+// BeginRequest gives the request its own copy of the session
+func (mes *MongoEntityStore) BeginRequest(ctx context.Context) (context.Context, func()) {
+	session := mes.session.Copy()
+	return WithSession(ctx, session), session.Close
+}
+
+// collection uses the session carried by ctx, if any, or the store one
+func (mes *MongoEntityStore) collection(ctx context.Context, collection string) (*mgo.Collection, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session, ok := sessionFromContext(ctx)
+	if !ok {
+		session = mes.session
+	}
+	return session.DB("").C(collection), nil
+}
+
+func (mes *MongoEntityStore) FindAll(ctx context.Context, collection string) ([]map[string]interface{}, error) {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
 	var list []map[string]interface{}
-	err := ctx.session.DB("").C(collection).Find(nil).All(&list)
+	err = c.Find(nil).Select(withoutRevision).All(&list)
 	return list, err
 }
 
-func (*MongoEntityStore) FindByID(ctx *context, collection, id string) (map[string]interface{}, error) {
-	var list []map[string]interface{}
-	err := ctx.session.DB("").C(collection).FindId(id).All(&list)
-	if len(list) == 0 && err == nil {
-		return nil, ErrNotFound
+func (mes *MongoEntityStore) Find(ctx context.Context, collection string, q *Query) ([]map[string]interface{}, error) {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	list := []map[string]interface{}{}
+	err = mongoQuery(c, q).All(&list)
+	return list, err
+}
+
+func mongoQuery(c *mgo.Collection, q *Query) *mgo.Query {
+	selector := bson.M{}
+	if q.SortAfter != nil {
+		selector = mongoSortAfter(q)
+	} else if q.After != "" {
+		selector["_id"] = bson.M{"$gt": q.After}
+	}
+	if q.Filter != nil {
+		selector = bson.M{"$and": []bson.M{selector, mongoFilter(q.Filter)}}
+	}
+	query := c.Find(selector).Sort(mongoSort(q.Sort)...).Skip(q.Skip).Limit(q.Limit)
+	if len(q.Fields) > 0 {
+		projection := bson.M{}
+		for _, f := range q.Fields {
+			projection[f] = 1
+		}
+		query = query.Select(projection)
+	} else {
+		query = query.Select(withoutRevision)
+	}
+	return query
+}
+
+// withoutRevision is the projection for returning entities
+var withoutRevision = bson.M{RevField: 0}
+
+// entitySelector selects the entity, at the revision required by ctx, if any
+func entitySelector(ctx context.Context, id string) bson.M {
+	selector := bson.M{"_id": id}
+	if rev, required := ifMatchFromContext(ctx); required {
+		selector[RevField] = rev
+	}
+	return selector
+}
+
+// revErr makes a missing entity a failed precondition when ctx requires a revision,
+// as entitySelector does not tell them apart
+func revErr(ctx context.Context, err error) error {
+	if _, required := ifMatchFromContext(ctx); required && err == ErrNotFound {
+		return ErrPreconditionFailed
+	}
+	return err
+}
+
+// mongoSort appends the ID to the sort fields, to break ties as MemStore does
+func mongoSort(fields []string) []string {
+	for _, f := range fields {
+		if strings.TrimPrefix(f, "-") == "_id" {
+			return fields
+		}
+	}
+	return append(fields[:len(fields):len(fields)], "_id")
+}
+
+// mongoSortAfter selects the entities after q.SortAfter and q.After in the order of q.Sort.
+// As an array is sorted by its least element, or its greatest one in a descending order,
+// an entity is after a value if it has none before nor equal to it, and at the same place
+// if it has the value and none before. Comparisons only match values of the same type,
+// those of the types sorted before are matched by type
+func mongoSortAfter(q *Query) bson.M {
+	selector := bson.M{"_id": bson.M{"$gt": q.After}}
+	for i := len(q.Sort) - 1; i >= 0; i-- {
+		field := strings.TrimPrefix(q.Sort[i], "-")
+		desc := field != q.Sort[i]
+		v := q.SortAfter[i]
+		selector = bson.M{"$or": []bson.M{
+			{"$nor": []bson.M{mongoSortBefore(field, v, desc, true)}},
+			{"$and": []bson.M{{field: v}, {"$nor": []bson.M{mongoSortBefore(field, v, desc, false)}}, selector}},
+		}}
+	}
+	return selector
+}
+
+// mongoSortTypes are the types of JSON values, by their sortRank
+var mongoSortTypes = []struct {
+	rank int
+	name string
+}{{1, "null"}, {2, "number"}, {3, "string"}, {4, "object"}, {8, "bool"}}
+
+// mongoSortBefore selects the entities with a value in field before v, or equal to it
+func mongoSortBefore(field string, v interface{}, desc, orEqual bool) bson.M {
+	op := "$lt"
+	if desc {
+		op = "$gt"
+	}
+	if orEqual {
+		op += "e"
+	}
+	conds := []bson.M{{field: bson.M{op: v}}}
+	rank := sortRank(v)
+	for _, t := range mongoSortTypes {
+		if t.rank < rank && !desc || t.rank > rank && desc {
+			if t.name == "null" {
+				conds = append(conds, bson.M{field: nil}) // also missing
+			} else {
+				conds = append(conds, bson.M{field: bson.M{"$type": t.name}})
+			}
+		}
+	}
+	return bson.M{"$or": conds}
+}
+
+// mongoFilter translates f to a MongoDB query, whose semantics it already follows
+func mongoFilter(f *Filter) bson.M {
+	switch f.Op {
+	case FilterAnd, FilterOr:
+		list := make([]bson.M, len(f.Filters))
+		for i, sub := range f.Filters {
+			list[i] = mongoFilter(sub)
+		}
+		return bson.M{"$" + f.Op: list}
+	}
+	return bson.M{f.Field: bson.M{"$" + f.Op: f.Value}}
+}
+
+func (mes *MongoEntityStore) Iterate(ctx context.Context, collection string, q *Query, fn func(ent map[string]interface{}) error) error {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	iter := mongoQuery(c, q).Iter()
+	for {
+		var ent map[string]interface{}
+		if !iter.Next(&ent) {
+			break
+		}
+		if err = ctx.Err(); err == nil {
+			err = fn(ent)
+		}
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func (mes *MongoEntityStore) FindByID(ctx context.Context, collection, id string) (map[string]interface{}, error) {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	var ent map[string]interface{}
+	err = c.FindId(id).Select(withoutRevision).One(&ent)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return ent, nil
+}
+
+func (mes *MongoEntityStore) FindWithRevision(ctx context.Context, collection, id string) (map[string]interface{}, string, error) {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return nil, "", err
 	}
-	return list[0], err
+	var ent map[string]interface{}
+	if err = c.FindId(id).One(&ent); err != nil {
+		return nil, "", mongoErr(err)
+	}
+	rev, _ := ent[RevField].(string)
+	delete(ent, RevField)
+	return ent, rev, nil
 }
 
-func (*MongoEntityStore) Save(ctx *context, collection string, ent map[string]interface{}) error {
+func (mes *MongoEntityStore) Save(ctx context.Context, collection string, ent map[string]interface{}) error {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
 	id, isString := ent["_id"].(string)
 	if !isString {
 		return ErrIdNotString
 	}
-	_, err := ctx.session.DB("").C(collection).UpsertId(id, ent)
-	return err
+	doc := mongoPoints(withRevision(ent))
+	if _, required := ifMatchFromContext(ctx); required {
+		return revErr(ctx, mongoErr(c.Update(entitySelector(ctx, id), doc)))
+	}
+	_, err = c.UpsertId(id, doc)
+	return mongoErr(err)
 }
 
-func (*MongoEntityStore) Delete(ctx *context, collection, id string) error {
-	err := ctx.session.DB("").C(collection).Remove(bson.M{"_id": id})
-	return err
+func (mes *MongoEntityStore) Insert(ctx context.Context, collection string, ent map[string]interface{}) error {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	if _, isString := ent["_id"].(string); !isString {
+		return ErrIdNotString
+	}
+	return mongoErr(c.Insert(mongoPoints(withRevision(ent))))
 }
 
-func (*MongoEntityStore) FindField(ctx *context, collection, id, field string) (interface{}, error) {
-	var result map[string]interface{}
-	const resultKey = "V"
-	/*
-		err := ctx.session.DB("").C(collection).
-			Find(bson.M{"_id": id}).
-			Select((bson.M{field: 1, "_id": 0})).
-			One(&entity)
+func (mes *MongoEntityStore) Replace(ctx context.Context, collection string, ent map[string]interface{}) error {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	id, isString := ent["_id"].(string)
+	if !isString {
+		return ErrIdNotString
+	}
+	return revErr(ctx, mongoErr(c.Update(entitySelector(ctx, id), mongoPoints(withRevision(ent)))))
+}
 
-		if err != nil {
+func (mes *MongoEntityStore) Delete(ctx context.Context, collection, id string) error {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	return revErr(ctx, mongoErr(c.Remove(entitySelector(ctx, id))))
+}
+
+func (mes *MongoEntityStore) FindField(ctx context.Context, collection, id, field string) (interface{}, error) {
+	value, _, err := mes.FindFieldWithRevision(ctx, collection, id, field)
+	return value, err
+}
+
+func (mes *MongoEntityStore) FindFieldWithRevision(ctx context.Context, collection, id, field string) (interface{}, string, error) {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return nil, "", err
+	}
+	// only the top level field is read, the rest of the path is followed here, as
+	// MongoDB cannot index arrays in projections
+	var ent map[string]interface{}
+	top := strings.SplitN(field, ".", 2)[0]
+	err = c.FindId(id).Select(bson.M{top: 1, RevField: 1}).One(&ent)
+	if err != nil {
+		return nil, "", mongoErr(err)
+	}
+	rev, _ := ent[RevField].(string)
+	value, err := lookupField(ent, field)
+	if err != nil {
+		return nil, "", err
+	}
+	return value, rev, nil
+}
+
+// UpdateField and DeleteField with a path which could go into an array are done reading the
+// entity, as $set fills with nulls the indexes out of range and $unset leaves a null. So is
+// setting a coordinate of a point, which $set could leave after the other one
+func (mes *MongoEntityStore) UpdateField(ctx context.Context, collection, id, field string, value interface{}) error {
+	if isRevPath(field) {
+		return ErrInvalidFieldName
+	}
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	if hasIndexSegment(field) || isCoordinatePath(field) {
+		return modify(ctx, c, id, func(ent map[string]interface{}) (map[string]interface{}, error) {
+			return ent, setField(ent, field, value)
+		})
+	}
+	// $set creates the missing parents, so the parent must be there
+	selector := entitySelector(ctx, id)
+	parent := ""
+	if i := strings.LastIndex(field, "."); i >= 0 {
+		parent = field[:i]
+		selector[parent] = bson.M{"$exists": true}
+	}
+	err = mongoErr(c.Update(selector, bson.M{"$set": bson.M{field: mongoPoints(value), RevField: newRevision()}}))
+	if err == ErrNotFound && parent != "" {
+		// the entity may be there, failing on the way as MemStore does
+		var ent map[string]interface{}
+		if c.Find(entitySelector(ctx, id)).One(&ent) == nil {
+			if err = setField(ent, field, value); err == nil {
+				err = ErrConcurrentChange // the parent was created meanwhile
+			}
+		}
+	}
+	return revErr(ctx, err)
+}
+
+func (mes *MongoEntityStore) DeleteField(ctx context.Context, collection, id, field string) error {
+	if isRevPath(field) {
+		return ErrInvalidFieldName
+	}
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	if hasIndexSegment(field) {
+		return modify(ctx, c, id, func(ent map[string]interface{}) (map[string]interface{}, error) {
+			return ent, deleteField(ent, field)
+		})
+	}
+	return revErr(ctx, mongoErr(c.Update(
+		entitySelector(ctx, id),
+		bson.M{"$unset": bson.M{field: 1}, "$set": bson.M{RevField: newRevision()}})))
+}
+
+// Update translates u to a single update with its operators, whose $set sets the revision
+// too, and the merge patch to the fields it sets and removes. With paths which could go
+// into an array or to a coordinate it is done reading the entity, as UpdateField, and so is
+// a merge patch which cannot be translated, or replacing a value by an object
+func (mes *MongoEntityStore) Update(ctx context.Context, collection, id string, u *Update) error {
+	if u.changesRevision() {
+		return ErrInvalidFieldName
+	}
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	modifyEntity := func() error {
+		return modify(ctx, c, id, func(ent map[string]interface{}) (map[string]interface{}, error) {
+			return ent, u.apply(ent)
+		})
+	}
+	mergeSet, mergeUnset, flat := u.mergeChanges()
+	if !flat || u.hasIndexSegment() || u.hasCoordinatePath() {
+		return modifyEntity()
+	}
+	set := bson.M{RevField: newRevision()}
+	for _, values := range []map[string]interface{}{mergeSet, u.Set} {
+		for path, value := range values {
+			set[path] = mongoPoints(value)
+		}
+	}
+	change := bson.M{"$set": set}
+	if unsetPaths := append(mergeUnset, u.Unset...); len(unsetPaths) > 0 {
+		unset := bson.M{}
+		for _, path := range unsetPaths {
+			unset[path] = 1
+		}
+		change["$unset"] = unset
+	}
+	for op, values := range map[string]map[string]interface{}{
+		"$inc":      u.Inc,
+		"$min":      u.Min,
+		"$max":      u.Max,
+		"$push":     u.Push,
+		"$addToSet": u.AddToSet,
+		"$pull":     u.Pull,
+	} {
+		if len(values) > 0 {
+			points := bson.M{}
+			for path, value := range values {
+				points[path] = mongoPoints(value)
+			}
+			change[op] = points
+		}
+	}
+	err = mongoErr(c.Update(entitySelector(ctx, id), change))
+	if lastErr, ok := err.(*mgo.LastError); ok && lastErr.Code == 2 {
+		err = ErrTypeMismatch // BadValue, as pushing to a value which is not an array
+	}
+	if err == ErrTraversingObject && u.Merge != nil {
+		// the patch merges an object into a value which is not one, replacing it
+		return modifyEntity()
+	}
+	return revErr(ctx, err)
+}
+
+func (mes *MongoEntityStore) Patch(ctx context.Context, collection, id string, ops []PatchOp) error {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	return modify(ctx, c, id, func(ent map[string]interface{}) (map[string]interface{}, error) {
+		return applyPatch(ent, ops)
+	})
+}
+
+const maxModifyAttempts = 10
+
+// modify reads the entity, changes it with fn and replaces it if it has not changed
+// meanwhile, trying again otherwise. It needs MongoDB 3.6 or newer
+func modify(ctx context.Context, c *mgo.Collection, id string, fn func(ent map[string]interface{}) (map[string]interface{}, error)) error {
+	var err error
+	for attempt := 0; attempt < maxModifyAttempts; attempt++ {
+		var raw bson.Raw
+		if err = c.FindId(id).One(&raw); err != nil {
+			return revErr(ctx, mongoErr(err))
+		}
+		var ent map[string]interface{}
+		if err = raw.Unmarshal(&ent); err != nil {
+			return err
+		}
+		if err = checkRevision(ctx, ent); err != nil {
+			return err
+		}
+		if ent, err = fn(ent); err != nil {
+			return err
+		}
+		ent[RevField] = newRevision()
+		unchanged := bson.M{
+			"_id":   id,
+			"$expr": bson.M{"$eq": []interface{}{"$$ROOT", bson.M{"$literal": raw}}},
+		}
+		err = c.Update(unchanged, mongoPoints(ent))
+		if err != mgo.ErrNotFound {
+			return mongoErr(err)
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return ErrConcurrentChange
+}
+
+const stagingBatch = 1000
+
+// ReplaceCollection loads the entities in a staging collection and renames it over the
+// old one, so readers never see a half-loaded collection
+func (mes *MongoEntityStore) ReplaceCollection(ctx context.Context, collection string, ents []map[string]interface{}) error {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	docs := make([]interface{}, len(ents))
+	for i, ent := range ents {
+		if _, isString := ent["_id"].(string); !isString {
+			return ErrIdNotString
+		}
+		docs[i] = mongoPoints(withRevision(ent))
+	}
+	staging := c.Database.C(collection + ".staging." + newUUID())
+	if err = staging.Create(&mgo.CollectionInfo{}); err != nil {
+		return err
+	}
+	// renaming drops the indexes of the old collection, so the new one gets them first
+	indexes, err := c.Indexes()
+	if err = mongoErr(err); err == ErrNotFound {
+		err = nil
+	}
+	for _, index := range indexes {
+		if err == nil && index.Name != "_id_" {
+			err = staging.EnsureIndex(index)
+		}
+	}
+	for len(docs) > 0 && err == nil {
+		n := len(docs)
+		if n > stagingBatch {
+			n = stagingBatch
+		}
+		if err = ctx.Err(); err == nil {
+			err = staging.Insert(docs[:n]...)
+		}
+		docs = docs[n:]
+	}
+	if err == nil {
+		err = c.Database.Session.Run(bson.D{
+			{Name: "renameCollection", Value: staging.FullName},
+			{Name: "to", Value: c.FullName},
+			{Name: "dropTarget", Value: true},
+		}, nil)
+	}
+	if err != nil {
+		staging.DropCollection()
+		return mongoErr(err)
+	}
+	return nil
+}
+
+func (mes *MongoEntityStore) DropCollection(ctx context.Context, collection string) error {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	return mongoErr(c.DropCollection())
+}
+
+// Collections leaves out the system collections and the staging ones of ReplaceCollection.
+// Sizes are those of the BSON documents
+func (mes *MongoEntityStore) Collections(ctx context.Context) ([]CollectionInfo, error) {
+	c, err := mes.collection(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	names, err := c.Database.CollectionNames() // sorted
+	if err != nil {
+		return nil, err
+	}
+	infos := []CollectionInfo{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") || strings.Contains(name, ".staging.") {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
 			return nil, err
 		}
-		val := extractField(field, entity)
-	*/
-	err := ctx.session.DB("").C(collection).
-		Pipe([]bson.M{
-			{"$match": bson.M{"_id": id}},
-			{"$project": bson.M{resultKey: "$" + field, "_id": false}},
-		}).One(&result)
+		info := CollectionInfo{Name: name}
+		if info.Count, err = c.Database.C(name).Count(); err != nil {
+			return nil, err
+		}
+		var stats struct {
+			Size float64 `bson:"size"`
+		}
+		if err = c.Database.Run(bson.D{{Name: "collStats", Value: name}}, &stats); err != nil {
+			return nil, err
+		}
+		info.Size = int64(stats.Size)
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (mes *MongoEntityStore) Count(ctx context.Context, collection string) (int, error) {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return 0, err
+	}
+	return c.Count()
+}
+
+func (mes *MongoEntityStore) Aggregate(ctx context.Context, collection string, pipeline []Stage) ([]map[string]interface{}, error) {
+	c, err := mes.collection(ctx, collection)
 	if err != nil {
 		return nil, err
 	}
-	val, present := result[resultKey]
-	if !present {
-		return nil, ErrNotFound
+	stages := []bson.M{{"$project": withoutRevision}}
+	for i := range pipeline {
+		stages = append(stages, mongoStage(&pipeline[i]))
 	}
-	return val, nil
+	list := []map[string]interface{}{}
+	err = c.Pipe(stages).AllowDiskUse().All(&list)
+	return list, mongoErr(err)
 }
 
-func (*MongoEntityStore) UpdateField(ctx *context, collection, id, field string, value interface{}) error {
-	err := ctx.session.DB("").C(collection).Update(
-		bson.M{"_id": id},
-		bson.M{"$set": bson.M{field: value}})
-	if err, ok := err.(*mgo.LastError); ok {
-		if err.Code == 16837 { // Wrong traverse
-			return ErrTraversingObject
+// mongoStage translates st to a stage of a MongoDB pipeline
+func mongoStage(st *Stage) bson.M {
+	switch {
+	case st.Match != nil:
+		return bson.M{"$match": mongoFilter(st.Match)}
+	case st.Group != nil:
+		var by interface{}
+		if st.Group.By != "" {
+			by = "$" + st.Group.By
+		}
+		group := bson.M{"_id": by}
+		for name, acc := range st.Group.Fields {
+			if acc.Op == AccumulatorCount {
+				group[name] = bson.M{"$sum": 1}
+			} else {
+				group[name] = bson.M{"$" + acc.Op: "$" + acc.Field}
+			}
+		}
+		return bson.M{"$group": group}
+	case len(st.Sort) > 0:
+		var sort bson.D
+		for _, f := range mongoSort(st.Sort) {
+			if strings.HasPrefix(f, "-") {
+				sort = append(sort, bson.DocElem{Name: f[1:], Value: -1})
+			} else {
+				sort = append(sort, bson.DocElem{Name: f, Value: 1})
+			}
 		}
+		return bson.M{"$sort": sort}
 	}
-	return err
+	return bson.M{"$limit": st.Limit}
+}
+
+func (mes *MongoEntityStore) EnsureIndex(ctx context.Context, collection string, spec IndexSpec) error {
+	if err := spec.normalize(); err != nil {
+		return err
+	}
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return err
+	}
+	// not with EnsureIndex, which skips the indexes in the cache of the session without
+	// checking their options
+	key := make(bson.D, len(spec.Fields))
+	for i, field := range spec.Fields {
+		key[i] = bson.DocElem{Name: field, Value: 1}
+		if spec.Geo {
+			key[i].Value = "2dsphere"
+		} else if spec.Text {
+			key[i].Value = "text"
+		}
+	}
+	index := bson.M{"key": key, "name": spec.Name, "unique": spec.Unique, "sparse": spec.Sparse}
+	if spec.Text {
+		// without stemming nor stop words, as MemStore does
+		index["default_language"] = "none"
+	}
+	return mongoErr(c.Database.Run(bson.D{
+		{Name: "createIndexes", Value: c.Name},
+		{Name: "indexes", Value: []bson.M{index}},
+	}, nil))
+}
+
+// Indexes leaves out the ID index
+func (mes *MongoEntityStore) Indexes(ctx context.Context, collection string) ([]IndexSpec, error) {
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	specs := []IndexSpec{}
+	indexes, err := c.Indexes() // sorted by name
+	if err = mongoErr(err); err == ErrNotFound {
+		return specs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		if index.Name == "_id_" {
+			continue
+		}
+		spec := IndexSpec{Name: index.Name, Unique: index.Unique, Sparse: index.Sparse}
+		for _, key := range index.Key {
+			// as mgo names a 2dsphere key
+			if strings.HasPrefix(key, geoKeyPrefix) {
+				key, spec.Geo = key[len(geoKeyPrefix):], true
+			} else if strings.HasPrefix(key, textKeyPrefix) {
+				key, spec.Text = key[len(textKeyPrefix):], true
+			}
+			spec.Fields = append(spec.Fields, key)
+		}
+		if spec.Text {
+			sort.Strings(spec.Fields)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func (mes *MongoEntityStore) DropIndex(ctx context.Context, collection, name string) error {
+	specs, err := mes.Indexes(ctx, collection)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if spec.Name == name {
+			c, err := mes.collection(ctx, collection)
+			if err != nil {
+				return err
+			}
+			return mongoErr(c.DropIndexName(name))
+		}
+	}
+	return ErrNotFound
+}
+
+// scoreField holds the score in the documents found by a text search
+const scoreField = "_score"
+
+func (mes *MongoEntityStore) Search(ctx context.Context, collection, text string, limit int) ([]SearchHit, error) {
+	terms := searchTerms(text)
+	if len(terms) == 0 {
+		return nil, ErrInvalidSearch
+	}
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	// the words alone, as quotes and minus signs have a meaning for MongoDB
+	q := c.Find(bson.M{"$text": bson.M{"$search": strings.Join(terms, " ")}}).
+		Select(bson.M{RevField: 0, scoreField: bson.M{"$meta": "textScore"}}).
+		Sort("$textScore:"+scoreField, "_id").
+		Limit(limit)
+	var docs []map[string]interface{}
+	if err = q.All(&docs); isTextIndexNotFound(err) {
+		return nil, ErrNoTextIndex
+	} else if err != nil {
+		return nil, mongoErr(err)
+	}
+	hits := make([]SearchHit, len(docs))
+	for i, doc := range docs {
+		hits[i].Score, _ = doc[scoreField].(float64)
+		delete(doc, scoreField)
+		hits[i].Entity = doc
+	}
+	return hits, nil
 }
 
-func (*MongoEntityStore) DeleteField(ctx *context, collection, id, field string) error {
-	err := ctx.session.DB("").C(collection).Update(
-		bson.M{"_id": id},
-		bson.M{"$unset": bson.M{field: 1}})
+const (
+	geoKeyPrefix  = "$2dsphere:"
+	textKeyPrefix = "$text:"
+	distanceField = "_distance"
+)
+
+// Near needs MongoDB 4.0 or newer, to choose the index of $geoNear
+func (mes *MongoEntityStore) Near(ctx context.Context, collection, field string, center GeoPoint, radius float64, limit int) ([]GeoHit, error) {
+	if err := checkNear(center, radius); err != nil {
+		return nil, err
+	}
+	// $geoNear could use another kind of index on the field
+	specs, err := mes.Indexes(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	indexed := false
+	for _, spec := range specs {
+		indexed = indexed || spec.Geo && spec.Fields[0] == field
+	}
+	if !indexed {
+		return nil, ErrNoGeoIndex
+	}
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	stages := []bson.M{
+		{"$geoNear": bson.M{
+			"near":          bson.M{"type": "Point", "coordinates": []float64{center.Lon, center.Lat}},
+			"spherical":     true,
+			"key":           field,
+			"distanceField": distanceField,
+			"maxDistance":   radius,
+		}},
+		{"$project": withoutRevision},
+		{"$sort": bson.D{{Name: distanceField, Value: 1}, {Name: "_id", Value: 1}}},
+	}
+	if limit > 0 {
+		stages = append(stages, bson.M{"$limit": limit})
+	}
+	var docs []map[string]interface{}
+	if err = c.Pipe(stages).All(&docs); err != nil {
+		return nil, mongoErr(err)
+	}
+	hits := make([]GeoHit, len(docs))
+	for i, doc := range docs {
+		hits[i].Distance, _ = doc[distanceField].(float64)
+		delete(doc, distanceField)
+		hits[i].Entity = doc
+	}
+	return hits, nil
+}
+
+// Within takes the area as a GeoJSON Polygon, so it uses the 2dsphere index of the field
+// and finds both the points as pairs and the GeoJSON ones, as MemStore does
+func (mes *MongoEntityStore) Within(ctx context.Context, collection, field string, area *GeoArea, limit int) ([]map[string]interface{}, error) {
+	if err := area.check(); err != nil {
+		return nil, err
+	}
+	c, err := mes.collection(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	ring := area.ring()
+	polygon := bson.M{"type": "Polygon", "coordinates": [][][]float64{geoCoordinates(append(ring[:len(ring):len(ring)], ring[0]))}}
+	shape := bson.M{"$geometry": polygon}
+	list := []map[string]interface{}{}
+	err = c.Find(bson.M{field: bson.M{"$geoWithin": shape}}).Select(withoutRevision).Sort("_id").Limit(limit).All(&list)
+	return list, mongoErr(err)
+}
+
+func geoCoordinates(points []GeoPoint) [][]float64 {
+	coords := make([][]float64, len(points))
+	for i, p := range points {
+		coords[i] = []float64{p.Lon, p.Lat}
+	}
+	return coords
+}
+
+// mongoPoints returns v with the objects having only a longitude and a latitude as bson.D,
+// the longitude first, as MongoDB takes the first field of a point as its longitude
+func mongoPoints(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		lon, isLon := v["lon"]
+		lat, isLat := v["lat"]
+		if isLon && isLat && len(v) == 2 {
+			return bson.D{{Name: "lon", Value: lon}, {Name: "lat", Value: lat}}
+		}
+		o := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			o[k] = mongoPoints(child)
+		}
+		return o
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, child := range v {
+			a[i] = mongoPoints(child)
+		}
+		return a
+	}
+	return v
+}
+
+func isTextIndexNotFound(err error) bool {
+	qerr, ok := err.(*mgo.QueryError)
+	return ok && (qerr.Code == 27 || strings.Contains(qerr.Message, "text index required"))
+}
+
+// mongoErr translates the mgo errors with a meaning for almacen
+func mongoErr(err error) error {
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if mgo.IsDup(err) {
+		// the message names the index, _id_ for the ID
+		if msg := err.Error(); strings.Contains(msg, " _id_ ") || strings.Contains(msg, "$_id_ ") {
+			return ErrExisting
+		}
+		return ErrDuplicateKey
+	}
+	if err, ok := err.(*mgo.QueryError); ok && (err.Code == 26 || err.Message == "ns not found") {
+		return ErrNotFound // NamespaceNotFound
+	}
+	if err, ok := err.(*mgo.QueryError); ok && (err.Code == 85 || err.Code == 86) {
+		return ErrIndexConflict // IndexOptionsConflict, IndexKeySpecsConflict
+	}
+	if err, ok := err.(*mgo.QueryError); ok && err.Code == 16755 {
+		return ErrInvalidLocation // Can't extract geo keys, creating a geo index
+	}
+	if err, ok := err.(*mgo.LastError); ok {
+		switch err.Code {
+		case 16755: // Can't extract geo keys
+			return ErrInvalidLocation
+		case 16837, 28: // Wrong traverse, PathNotViable in newer versions
+			return ErrTraversingObject
+		case 14: // TypeMismatch
+			return ErrTypeMismatch
+		}
+	}
 	return err
 }
 
@@ -1,76 +1,11 @@
 package almacen
 
 import (
+	"reflect"
 	"testing"
-)
-
-func makeMongoTest(functest func(s Store, t *testing.T)) func(t *testing.T) {
-	return func(t *testing.T) {
-		store := &MongoEntityStore{}
-		err := store.Start(&Config{MongoURL: "localhost"})
-		contextTest.session = store.session
-		if err != nil {
-			t.Fatal(err)
-		}
-		contextTest.session.DB("").C(collectionTest).DropCollection()
-		defer store.Stop()
-
-		functest(store, t)
-
-	}
-}
-
-func TestMongoStoreFindAll(t *testing.T) {
-	makeMongoTest(testFindAll)(t)
-}
-
-func TestMongoStoreFindByID(t *testing.T) {
-	makeMongoTest(testFindByID)(t)
-}
-
-func TestMongoStoreFindByIDNotFound(t *testing.T) {
-	makeMongoTest(testFindByIDNotFound)(t)
-}
-
-func TestMongoStoreSaveIDNotString(t *testing.T) {
-	makeMongoTest(testSaveIDNotString)(t)
-}
-
-func TestMongoStoreDelete(t *testing.T) {
-	makeMongoTest(testDelete)(t)
-}
-
-func TestMongoStoreFindField(t *testing.T) {
-	makeMongoTest(testFindField)(t)
-}
-
-func TestMongoStoreFindFieldNested(t *testing.T) {
-	makeMongoTest(testFindFieldNested)(t)
-}
 
-func TestMongoStoreUpdateField(t *testing.T) {
-	makeMongoTest(testUpdateField)(t)
-}
-
-func TestMongoStoreUpdateFieldTraversingErr(t *testing.T) {
-	makeMongoTest(testUpdateFieldTraversingErr)(t)
-}
-
-func TestMongoStoreDeleteField(t *testing.T) {
-	makeMongoTest(testDeleteField)(t)
-}
-
-func TestMongoStoreDeleteFieldTraversingErr(t *testing.T) {
-	makeMongoTest(testDeleteFieldTraversingErr)(t)
-}
-
-func TestMongoStoreUpdateFieldRoot(t *testing.T) {
-	makeMongoTest(testUpdateFieldRoot)(t)
-}
-
-func TestMongoStoreDeleteFieldRoot(t *testing.T) {
-	makeMongoTest(testDeleteFieldRoot)(t)
-}
+	"gopkg.in/mgo.v2/bson"
+)
 
 func TestStartErr(t *testing.T) {
 	store := &MongoEntityStore{}
@@ -79,3 +14,35 @@ func TestStartErr(t *testing.T) {
 		t.Errorf("start error: wanted <something>, got nil")
 	}
 }
+
+func TestMongoPoints(t *testing.T) {
+	ent := map[string]interface{}{
+		"at":    map[string]interface{}{"lat": 40.4, "lon": -3.7},
+		"stops": []interface{}{map[string]interface{}{"lat": 1.0, "lon": 2.0}},
+		"other": map[string]interface{}{"lat": 1.0, "lon": 2.0, "alt": 3.0},
+	}
+	wanted := map[string]interface{}{
+		"at":    bson.D{{Name: "lon", Value: -3.7}, {Name: "lat", Value: 40.4}},
+		"stops": []interface{}{bson.D{{Name: "lon", Value: 2.0}, {Name: "lat", Value: 1.0}}},
+		"other": map[string]interface{}{"lat": 1.0, "lon": 2.0, "alt": 3.0},
+	}
+	if got := mongoPoints(ent); !reflect.DeepEqual(got, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, got)
+	}
+}
+
+func TestMongoSortBefore(t *testing.T) {
+	for _, c := range []struct {
+		v             interface{}
+		desc, orEqual bool
+		wanted        bson.M
+	}{
+		{"x", false, false, bson.M{"$or": []bson.M{{"n": bson.M{"$lt": "x"}}, {"n": nil}, {"n": bson.M{"$type": "number"}}}}},
+		{"x", true, true, bson.M{"$or": []bson.M{{"n": bson.M{"$gte": "x"}}, {"n": bson.M{"$type": "object"}}, {"n": bson.M{"$type": "bool"}}}}},
+		{nil, false, true, bson.M{"$or": []bson.M{{"n": bson.M{"$lte": nil}}}}},
+	} {
+		if got := mongoSortBefore("n", c.v, c.desc, c.orEqual); !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("%v %v %v: wanted %v, got %v", c.v, c.desc, c.orEqual, c.wanted, got)
+		}
+	}
+}
@@ -0,0 +1,2156 @@
+// Package storetest checks that an almacen.Store behaves as the ones in almacen do.
+package storetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/crbrox/almacen"
+)
+
+// Collection is where the checks keep their entities
+const Collection = "Collection"
+
+// Factory returns an empty store for each test. Any cleanup can be registered with t.Cleanup
+type Factory func(t *testing.T) almacen.Store
+
+// RunConformance runs every check as a subtest of t, each one with a new store from factory
+func RunConformance(t *testing.T, factory Factory) {
+	for _, c := range []struct {
+		name string
+		test func(s almacen.Store, t *testing.T)
+	}{
+		{"FindAll", testFindAll},
+		{"FindAllEmpty", testFindAllEmpty},
+		{"Find", testFind},
+		{"FindPages", testFindPages},
+		{"Iterate", testIterate},
+		{"IterateStop", testIterateStop},
+		{"FindFilter", testFindFilter},
+		{"FindSort", testFindSort},
+		{"FindFields", testFindFields},
+		{"FindByID", testFindByID},
+		{"FindByIDNotFound", testFindByIDNotFound},
+		{"SaveIDNotString", testSaveIDNotString},
+		{"SaveReplaces", testSaveReplaces},
+		{"Insert", testInsert},
+		{"InsertExisting", testInsertExisting},
+		{"InsertIDNotString", testInsertIDNotString},
+		{"Replace", testReplace},
+		{"ReplaceNotFound", testReplaceNotFound},
+		{"Delete", testDelete},
+		{"DeleteNotFound", testDeleteNotFound},
+		{"FindField", testFindField},
+		{"FindFieldNested", testFindFieldNested},
+		{"FindFieldNull", testFindFieldNull},
+		{"FindFieldNotFoundEntity", testFindFieldNotFoundEntity},
+		{"UpdateField", testUpdateField},
+		{"UpdateFieldTraversingErr", testUpdateFieldTraversingErr},
+		{"UpdateFieldNotFoundEntity", testUpdateFieldNotFoundEntity},
+		{"UpdateFieldParentNotFound", testUpdateFieldParentNotFound},
+		{"UpdateCreateParents", testUpdateCreateParents},
+		{"UpdateFieldRoot", testUpdateFieldRoot},
+		{"DeleteField", testDeleteField},
+		{"DeleteFieldNested", testDeleteFieldNested},
+		{"DeleteFieldTraversingErr", testDeleteFieldTraversingErr},
+		{"DeleteFieldNotFoundEntity", testDeleteFieldNotFoundEntity},
+		{"DeleteFieldRoot", testDeleteFieldRoot},
+		{"ArrayFields", testArrayFields},
+		{"Update", testUpdate},
+		{"UpdateEmpty", testUpdateEmpty},
+		{"UpdateNotFound", testUpdateNotFound},
+		{"UpdateTraversingErr", testUpdateTraversingErr},
+		{"UpdateOperators", testUpdateOperators},
+		{"UpdateOperatorsTypeMismatch", testUpdateOperatorsTypeMismatch},
+		{"UpdateMerge", testUpdateMerge},
+		{"Patch", testPatch},
+		{"PatchFailed", testPatchFailed},
+		{"PatchNotFound", testPatchNotFound},
+		{"Revision", testRevision},
+		{"IfMatch", testIfMatch},
+		{"IfMatchMissing", testIfMatchMissing},
+		{"RevisionNotWritable", testRevisionNotWritable},
+		{"FindWithRevision", testFindWithRevision},
+		{"ReplaceCollection", testReplaceCollection},
+		{"ReplaceCollectionEmpty", testReplaceCollectionEmpty},
+		{"ReplaceCollectionDuplicated", testReplaceCollectionDuplicated},
+		{"ReplaceCollectionIDNotString", testReplaceCollectionIDNotString},
+		{"DropCollection", testDropCollection},
+		{"DropCollectionNotFound", testDropCollectionNotFound},
+		{"Collections", testCollections},
+		{"Count", testCount},
+		{"Aggregate", testAggregate},
+		{"Search", testSearch},
+		{"SearchChanges", testSearchChanges},
+		{"Indexes", testIndexes},
+		{"UniqueIndex", testUniqueIndex},
+		{"UniqueIndexExisting", testUniqueIndexExisting},
+		{"SparseIndex", testSparseIndex},
+		{"IndexFind", testIndexFind},
+		{"IndexReplaceCollection", testIndexReplaceCollection},
+		{"GeoNear", testGeoNear},
+		{"GeoWithin", testGeoWithin},
+		{"GeoInvalidLocation", testGeoInvalidLocation},
+		{"ConcurrentSave", testConcurrentSave},
+		{"ConcurrentUpdateField", testConcurrentUpdateField},
+		{"ConcurrentInc", testConcurrentInc},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			c.test(factory(t), t)
+		})
+	}
+}
+
+// The checks of the optional interfaces are skipped if the store does not implement them
+
+func aggregator(s almacen.Store, t *testing.T) almacen.Aggregator {
+	a, ok := almacen.Backend(s).(almacen.Aggregator)
+	if !ok {
+		t.Skip("not an Aggregator")
+	}
+	return a
+}
+
+func searcher(s almacen.Store, t *testing.T) almacen.Searcher {
+	se, ok := almacen.Backend(s).(almacen.Searcher)
+	if !ok {
+		t.Skip("not a Searcher")
+	}
+	return se
+}
+
+func indexer(s almacen.Store, t *testing.T) almacen.Indexer {
+	ix, ok := almacen.Backend(s).(almacen.Indexer)
+	if !ok {
+		t.Skip("not an Indexer")
+	}
+	return ix
+}
+
+func geoQuerier(s almacen.Store, t *testing.T) almacen.GeoQuerier {
+	geo, ok := almacen.Backend(s).(almacen.GeoQuerier)
+	if !ok {
+		t.Skip("not a GeoQuerier")
+	}
+	return geo
+}
+
+func collectionWriter(s almacen.Store, t *testing.T) almacen.CollectionWriter {
+	cw, ok := almacen.AsCollectionWriter(s)
+	if !ok {
+		t.Skip("not a CollectionWriter")
+	}
+	return cw
+}
+
+func collectionLister(s almacen.Store, t *testing.T) almacen.CollectionLister {
+	cl, ok := almacen.Backend(s).(almacen.CollectionLister)
+	if !ok {
+		t.Skip("not a CollectionLister")
+	}
+	return cl
+}
+
+type sortableEntitySlice []map[string]interface{}
+
+func (s sortableEntitySlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortableEntitySlice) Len() int      { return len(s) }
+func (s sortableEntitySlice) Less(i, j int) bool {
+	idI := s[i]["_id"].(string)
+	idJ := s[j]["_id"].(string)
+	return idI < idJ
+}
+
+var entitiesTest []map[string]interface{}
+var contextTest = context.Background()
+
+func initTest() {
+	entitiesTest = []map[string]interface{}{
+		{"_id": "e1", "temperature": 12.34},
+		{"_id": "e2", "temperature": 56.78, "label": "very hot"},
+		{"_id": "e3", "location": map[string]interface{}{"lon": -3.7025600, "lat": 40.4165000}},
+		{"_id": "e4", "nested": map[string]interface{}{"sub1": map[string]interface{}{"sub2": map[string]interface{}{"sub3": map[string]interface{}{}}}}},
+	}
+}
+
+func populateTest(s almacen.Store, t *testing.T) {
+	initTest()
+	for _, e := range entitiesTest {
+		err := s.Save(contextTest, Collection, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testFindAll(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	res, err := s.FindAll(contextTest, Collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(sortableEntitySlice(res))
+	sort.Sort(sortableEntitySlice(entitiesTest))
+	if !reflect.DeepEqual(res, entitiesTest) {
+		t.Errorf("expected %v, got %v", entitiesTest, res)
+	}
+}
+
+func testFindAllEmpty(s almacen.Store, t *testing.T) {
+	res, err := s.FindAll(contextTest, Collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Errorf("expected no entities, got %v", res)
+	}
+}
+
+func testFind(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	res, err := s.Find(contextTest, Collection, &almacen.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(sortableEntitySlice(entitiesTest))
+	if !reflect.DeepEqual(res, entitiesTest) {
+		t.Errorf("expected %v, got %v", entitiesTest, res)
+	}
+
+	res, err = s.Find(contextTest, "shouldnotexist", &almacen.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Errorf("expected no entities, got %v", res)
+	}
+}
+
+func testFindPages(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	sort.Sort(sortableEntitySlice(entitiesTest))
+	for _, limit := range []int{1, 2, 3, 4, 5} {
+		var all []map[string]interface{}
+		q := &almacen.Query{Limit: limit}
+		for {
+			res, err := s.Find(contextTest, Collection, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) > limit {
+				t.Errorf("expected at most %d entities, got %d", limit, len(res))
+			}
+			all = append(all, res...)
+			if len(res) < limit {
+				break
+			}
+			q.After = res[len(res)-1]["_id"].(string)
+		}
+		if !reflect.DeepEqual(all, entitiesTest) {
+			t.Errorf("limit %d: expected %v, got %v", limit, entitiesTest, all)
+		}
+	}
+}
+
+func testIterate(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	for _, q := range []*almacen.Query{{}, {Limit: 2}, {After: "e2"}, {After: "e2", Limit: 1}} {
+		expected, err := s.Find(contextTest, Collection, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := []map[string]interface{}{}
+		err = s.Iterate(contextTest, Collection, q, func(ent map[string]interface{}) error {
+			res = append(res, ent)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("%+v: expected %v, got %v", q, expected, res)
+		}
+	}
+}
+
+func testIterateStop(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	stop := errors.New("stop")
+	n := 0
+	err := s.Iterate(contextTest, Collection, &almacen.Query{}, func(ent map[string]interface{}) error {
+		n++
+		if n == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("expected %v, got %v", stop, err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 calls, got %d", n)
+	}
+}
+
+var filterEntities = []map[string]interface{}{
+	{"_id": "madrid", "name": "Madrid", "pop": 3.3, "capital": true, "location": map[string]interface{}{"lat": 40.4, "lon": -3.7}, "tags": []interface{}{"big", "old"}},
+	{"_id": "bilbao", "name": "Bilbao", "pop": 0.35, "capital": false, "location": map[string]interface{}{"lat": 43.3, "lon": -2.9}, "tags": []interface{}{"port"}},
+	{"_id": "oslo", "name": "Oslo", "pop": 0.7, "capital": true, "location": map[string]interface{}{"lat": 59.9, "lon": 10.7}, "email": nil},
+	{"_id": "nowhere", "name": "Nowhere", "pop": "unknown", "districts": []interface{}{map[string]interface{}{"n": 1.0}, map[string]interface{}{"n": 5.0}}},
+}
+
+func testFindFilter(s almacen.Store, t *testing.T) {
+	for _, e := range filterEntities {
+		if err := s.Save(contextTest, Collection, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		filter string
+		ids    []string
+	}{
+		{`name=Madrid`, []string{"madrid"}},
+		{`name="Oslo"`, []string{"oslo"}},
+		{`name!=Madrid`, []string{"bilbao", "nowhere", "oslo"}},
+		{`pop>0.5`, []string{"madrid", "oslo"}},
+		{`pop>=0.35`, []string{"bilbao", "madrid", "oslo"}},
+		{`pop<1`, []string{"bilbao", "oslo"}},
+		{`pop<=0.7`, []string{"bilbao", "oslo"}},
+		{`pop>a`, []string{"nowhere"}},
+		{`capital=true`, []string{"madrid", "oslo"}},
+		{`capital=false`, []string{"bilbao"}},
+		{`location.lat>40`, []string{"bilbao", "madrid", "oslo"}},
+		{`location.lat>41 and location.lon<0`, []string{"bilbao"}},
+		{`name=Oslo or location.lon<-3`, []string{"madrid", "oslo"}},
+		{`name=Oslo or name=Bilbao and pop>1`, []string{"oslo"}},
+		{`(name=Oslo or name=Bilbao) and pop<0.5`, []string{"bilbao"}},
+		{`name in ["Oslo", Bilbao]`, []string{"bilbao", "oslo"}},
+		{`name in []`, nil},
+		{`tags=old`, []string{"madrid"}},
+		{`tags in [port, big]`, []string{"bilbao", "madrid"}},
+		{`tags.0=port`, []string{"bilbao"}},
+		{`districts.n>4`, []string{"nowhere"}},
+		{`districts.n=1`, []string{"nowhere"}},
+		{`exists(tags)`, []string{"bilbao", "madrid"}},
+		{`!exists(location)`, []string{"nowhere"}},
+		{`exists(email)`, []string{"oslo"}},
+		{`email=null`, []string{"bilbao", "madrid", "nowhere", "oslo"}},
+		{`email!=null`, nil},
+		{`location.lat=null`, []string{"nowhere"}},
+		{`_id>m`, []string{"madrid", "nowhere", "oslo"}},
+	} {
+		f, err := almacen.ParseFilter(c.filter)
+		if err != nil {
+			t.Errorf("%s: %v", c.filter, err)
+			continue
+		}
+		res, err := s.Find(contextTest, Collection, &almacen.Query{Filter: f})
+		if err != nil {
+			t.Errorf("%s: %v", c.filter, err)
+			continue
+		}
+		var ids []string
+		for _, e := range res {
+			ids = append(ids, e["_id"].(string))
+		}
+		if !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("%s: expected %v, got %v", c.filter, c.ids, ids)
+		}
+	}
+}
+
+func testFindSort(s almacen.Store, t *testing.T) {
+	for _, e := range filterEntities {
+		if err := s.Save(contextTest, Collection, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		q   almacen.Query
+		ids []string
+	}{
+		{almacen.Query{Sort: []string{"name"}}, []string{"bilbao", "madrid", "nowhere", "oslo"}},
+		{almacen.Query{Sort: []string{"-location.lat"}}, []string{"oslo", "bilbao", "madrid", "nowhere"}},
+		{almacen.Query{Sort: []string{"location.lat"}}, []string{"nowhere", "madrid", "bilbao", "oslo"}},
+		// numbers before strings
+		{almacen.Query{Sort: []string{"pop"}}, []string{"bilbao", "oslo", "madrid", "nowhere"}},
+		// booleans after everything, ties by ID
+		{almacen.Query{Sort: []string{"-capital"}}, []string{"madrid", "oslo", "bilbao", "nowhere"}},
+		{almacen.Query{Sort: []string{"capital", "-_id"}}, []string{"nowhere", "bilbao", "oslo", "madrid"}},
+		// arrays by their least element ascending, greatest descending
+		{almacen.Query{Sort: []string{"tags"}}, []string{"nowhere", "oslo", "madrid", "bilbao"}},
+		{almacen.Query{Sort: []string{"-tags"}}, []string{"bilbao", "madrid", "nowhere", "oslo"}},
+		{almacen.Query{Sort: []string{"-pop"}, Skip: 1, Limit: 2}, []string{"madrid", "oslo"}},
+		{almacen.Query{Sort: []string{"name"}, Skip: 4}, nil},
+		{almacen.Query{Filter: &almacen.Filter{Op: almacen.FilterEq, Field: "capital", Value: true}, Sort: []string{"-name"}}, []string{"oslo", "madrid"}},
+	} {
+		res, err := s.Find(contextTest, Collection, &c.q)
+		if err != nil {
+			t.Errorf("%+v: %v", c.q, err)
+			continue
+		}
+		var ids []string
+		for _, e := range res {
+			ids = append(ids, e["_id"].(string))
+		}
+		if !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("%+v: expected %v, got %v", c.q, c.ids, ids)
+		}
+		if c.q.Skip > 0 || c.q.Limit > 0 {
+			continue
+		}
+		// the same, one entity at a time
+		ids = nil
+		q := c.q
+		q.Limit = 1
+		for next := &q; len(ids) <= len(filterEntities); {
+			res, err := s.Find(contextTest, Collection, next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) == 0 {
+				break
+			}
+			ids = append(ids, res[0]["_id"].(string))
+			next = next.Next(res[0])
+		}
+		if !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("%+v by pages: expected %v, got %v", c.q, c.ids, ids)
+		}
+	}
+}
+
+func testFindFields(s almacen.Store, t *testing.T) {
+	for _, e := range filterEntities {
+		if err := s.Save(contextTest, Collection, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := &almacen.Query{Fields: []string{"name", "location.lat", "districts.n", "tags", "email"}}
+	res, err := s.Find(contextTest, Collection, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]interface{}{
+		{"_id": "bilbao", "name": "Bilbao", "location": map[string]interface{}{"lat": 43.3}, "tags": []interface{}{"port"}},
+		{"_id": "madrid", "name": "Madrid", "location": map[string]interface{}{"lat": 40.4}, "tags": []interface{}{"big", "old"}},
+		{"_id": "nowhere", "name": "Nowhere", "districts": []interface{}{map[string]interface{}{"n": 1.0}, map[string]interface{}{"n": 5.0}}},
+		{"_id": "oslo", "name": "Oslo", "location": map[string]interface{}{"lat": 59.9}, "email": nil},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+	var iterated []map[string]interface{}
+	err = s.Iterate(contextTest, Collection, q, func(ent map[string]interface{}) error {
+		iterated = append(iterated, ent)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(iterated, expected) {
+		t.Errorf("iterating: expected %v, got %v", expected, iterated)
+	}
+}
+
+func testUpdate(s almacen.Store, t *testing.T) {
+	ent := map[string]interface{}{"_id": "u", "a": map[string]interface{}{"b": "B", "c": "C"}, "d": "D", "e": "E"}
+	if err := s.Save(contextTest, Collection, ent); err != nil {
+		t.Fatal(err)
+	}
+	u := &almacen.Update{
+		Set:   map[string]interface{}{"a.b": "B2", "d": map[string]interface{}{"x": 1.0}, "f.g.h": []interface{}{"H"}},
+		Unset: []string{"a.c", "e", "missing", "missing.too"},
+	}
+	if err := s.Update(contextTest, Collection, "u", u); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindByID(contextTest, Collection, "u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"_id": "u",
+		"a":   map[string]interface{}{"b": "B2"},
+		"d":   map[string]interface{}{"x": 1.0},
+		"f":   map[string]interface{}{"g": map[string]interface{}{"h": []interface{}{"H"}}},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func testUpdateEmpty(s almacen.Store, t *testing.T) {
+	ent := map[string]interface{}{"_id": "u", "a": "A"}
+	if err := s.Save(contextTest, Collection, ent); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(contextTest, Collection, "u", &almacen.Update{}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindByID(contextTest, Collection, "u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, ent) {
+		t.Errorf("expected %v, got %v", ent, res)
+	}
+	if err := s.Update(contextTest, Collection, "other", &almacen.Update{}); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testUpdateNotFound(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	u := &almacen.Update{Set: map[string]interface{}{"a": "A"}, Unset: []string{"b"}}
+	if err := s.Update(contextTest, Collection, "missing", u); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+	if _, err := s.FindByID(contextTest, Collection, "missing"); err != almacen.ErrNotFound {
+		t.Errorf("expected no entity created, got %v", err)
+	}
+}
+
+func testUpdateTraversingErr(s almacen.Store, t *testing.T) {
+	ent := map[string]interface{}{"_id": "u", "a": "A", "b": "B"}
+	if err := s.Save(contextTest, Collection, ent); err != nil {
+		t.Fatal(err)
+	}
+	u := &almacen.Update{Set: map[string]interface{}{"a.x": 1.0, "c": "C"}, Unset: []string{"b"}}
+	if err := s.Update(contextTest, Collection, "u", u); err != almacen.ErrTraversingObject {
+		t.Errorf("expected %v, got %v", almacen.ErrTraversingObject, err)
+	}
+	res, err := s.FindByID(contextTest, Collection, "u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, ent) {
+		t.Errorf("expected unchanged %v, got %v", ent, res)
+	}
+}
+
+func testUpdateOperators(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{
+		"_id":   "ID",
+		"n":     1.0,
+		"low":   5.0,
+		"high":  5.0,
+		"tags":  []interface{}{"a", "b", "a"},
+		"items": []interface{}{map[string]interface{}{"k": "x", "v": 1.0}, map[string]interface{}{"k": "y"}},
+	}
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	for i, u := range []*almacen.Update{
+		{Inc: map[string]interface{}{"n": 2.0, "counters.hits": 1.0}},
+		{Min: map[string]interface{}{"low": 3.0}, Max: map[string]interface{}{"high": 3.0}},
+		{Max: map[string]interface{}{"new": "N"}},
+		{Push: map[string]interface{}{"tags": "c", "list": 1.0}},
+		{AddToSet: map[string]interface{}{"tags": "b", "set": "s"}},
+		{AddToSet: map[string]interface{}{"set": "t"}},
+		{Pull: map[string]interface{}{"tags": "a", "missing": "m", "items": map[string]interface{}{"k": "x"}}},
+	} {
+		if err := s.Update(contextTest, Collection, "ID", u); err != nil {
+			t.Fatalf("update %d: %v", i, err)
+		}
+	}
+	expected := map[string]interface{}{
+		"_id":      "ID",
+		"n":        3.0,
+		"counters": map[string]interface{}{"hits": 1.0},
+		"low":      3.0,
+		"high":     5.0,
+		"new":      "N",
+		"tags":     []interface{}{"b", "c"},
+		"list":     []interface{}{1.0},
+		"set":      []interface{}{"s", "t"},
+		"items":    []interface{}{map[string]interface{}{"k": "y"}},
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func testUpdateOperatorsTypeMismatch(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "s": "S", "n": 1.0}
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	for i, u := range []*almacen.Update{
+		{Inc: map[string]interface{}{"s": 1.0}},
+		{Push: map[string]interface{}{"n": 1.0}},
+		{AddToSet: map[string]interface{}{"s": 1.0}},
+		{Pull: map[string]interface{}{"n": 1.0}},
+	} {
+		if err := s.Update(contextTest, Collection, "ID", u); err != almacen.ErrTypeMismatch {
+			t.Errorf("update %d: expected %v, got %v", i, almacen.ErrTypeMismatch, err)
+		}
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, original) {
+		t.Errorf("expected %v, got %v", original, res)
+	}
+}
+
+func testUpdateMerge(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{
+		"_id": "ID",
+		"a":   "A",
+		"b":   map[string]interface{}{"c": "C", "d": "D"},
+		"e":   []interface{}{1.0, 2.0},
+		"f":   "F",
+	}
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	for i, patch := range []map[string]interface{}{
+		{"b": map[string]interface{}{"d": "D2"}},
+		{"a": map[string]interface{}{"x": 1.0}, "f": nil, "g": map[string]interface{}{"h": "H"}},
+		{"b": map[string]interface{}{"c": nil, "n": map[string]interface{}{}}, "e": map[string]interface{}{"0": 3.0}},
+	} {
+		if err := s.Update(contextTest, Collection, "ID", &almacen.Update{Merge: patch}); err != nil {
+			t.Fatalf("patch %d: %v", i, err)
+		}
+	}
+	expected := map[string]interface{}{
+		"_id": "ID",
+		"a":   map[string]interface{}{"x": 1.0},
+		"b":   map[string]interface{}{"d": "D2", "n": map[string]interface{}{}},
+		"e":   map[string]interface{}{"0": 3.0},
+		"g":   map[string]interface{}{"h": "H"},
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+	u := &almacen.Update{Merge: map[string]interface{}{"a": map[string]interface{}{}}}
+	if err := s.Update(contextTest, Collection, "missing", u); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testPatch(s almacen.Store, t *testing.T) {
+	ent := map[string]interface{}{"_id": "p", "a": map[string]interface{}{"b": "B"}, "list": []interface{}{"x", "y"}}
+	if err := s.Save(contextTest, Collection, ent); err != nil {
+		t.Fatal(err)
+	}
+	ops := []almacen.PatchOp{
+		{Op: "test", Path: "/a/b", Value: "B"},
+		{Op: "add", Path: "/list/1", Value: "z"},
+		{Op: "move", From: "/a/b", Path: "/c"},
+		{Op: "copy", From: "/list", Path: "/a/copy"},
+		{Op: "remove", Path: "/list/0"},
+		{Op: "replace", Path: "/c", Value: 1.0},
+	}
+	if err := s.Patch(contextTest, Collection, "p", ops); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindByID(contextTest, Collection, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"_id":  "p",
+		"a":    map[string]interface{}{"copy": []interface{}{"x", "z", "y"}},
+		"list": []interface{}{"z", "y"},
+		"c":    1.0,
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func testPatchFailed(s almacen.Store, t *testing.T) {
+	ent := map[string]interface{}{"_id": "p", "a": "A"}
+	if err := s.Save(contextTest, Collection, ent); err != nil {
+		t.Fatal(err)
+	}
+	for _, ops := range [][]almacen.PatchOp{
+		{{Op: "add", Path: "/b", Value: "B"}, {Op: "test", Path: "/a", Value: "other"}},
+		{{Op: "remove", Path: "/a"}, {Op: "remove", Path: "/missing"}},
+		{{Op: "replace", Path: "/_id", Value: "q"}},
+	} {
+		if err := s.Patch(contextTest, Collection, "p", ops); err == nil {
+			t.Errorf("%v: expected error", ops)
+		}
+	}
+	res, err := s.FindByID(contextTest, Collection, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, ent) {
+		t.Errorf("expected unchanged %v, got %v", ent, res)
+	}
+}
+
+func testPatchNotFound(s almacen.Store, t *testing.T) {
+	ops := []almacen.PatchOp{{Op: "add", Path: "/a", Value: "A"}}
+	if err := s.Patch(contextTest, Collection, "missing", ops); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func revision(s almacen.Store, t *testing.T, id string) string {
+	rev, err := s.FindField(contextTest, Collection, id, almacen.RevField)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, isString := rev.(string)
+	if !isString || r == "" {
+		t.Fatalf("expected revision, got %v", rev)
+	}
+	return r
+}
+
+func testRevision(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	id := entitiesTest[0]["_id"].(string)
+	seen := map[string]bool{revision(s, t, id): true}
+	for i, change := range []func() error{
+		func() error { return s.Save(contextTest, Collection, map[string]interface{}{"_id": id, "a": 1.0}) },
+		func() error { return s.Replace(contextTest, Collection, map[string]interface{}{"_id": id, "a": 2.0}) },
+		func() error { return s.UpdateField(contextTest, Collection, id, "b", 3.0) },
+		func() error { return s.DeleteField(contextTest, Collection, id, "b") },
+		func() error {
+			return s.Update(contextTest, Collection, id, &almacen.Update{Set: map[string]interface{}{"a": 4.0}})
+		},
+		func() error {
+			return s.Patch(contextTest, Collection, id, []almacen.PatchOp{{Op: "add", Path: "/a", Value: 5.0}})
+		},
+	} {
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		rev := revision(s, t, id)
+		if seen[rev] {
+			t.Errorf("change %d: revision %q repeated", i, rev)
+		}
+		seen[rev] = true
+	}
+	res, err := s.FindByID(contextTest, Collection, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"_id": id, "a": 5.0}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func testIfMatch(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	id := entitiesTest[0]["_id"].(string)
+	for i, change := range []func(ctx context.Context) error{
+		func(ctx context.Context) error {
+			return s.Save(ctx, Collection, map[string]interface{}{"_id": id, "a": 1.0})
+		},
+		func(ctx context.Context) error {
+			return s.Replace(ctx, Collection, map[string]interface{}{"_id": id, "a": 2.0})
+		},
+		func(ctx context.Context) error { return s.UpdateField(ctx, Collection, id, "b", 3.0) },
+		func(ctx context.Context) error { return s.DeleteField(ctx, Collection, id, "b") },
+		func(ctx context.Context) error {
+			return s.Update(ctx, Collection, id, &almacen.Update{Set: map[string]interface{}{"a": 4.0}})
+		},
+		func(ctx context.Context) error {
+			return s.Patch(ctx, Collection, id, []almacen.PatchOp{{Op: "add", Path: "/a", Value: 5.0}})
+		},
+		func(ctx context.Context) error { return s.Delete(ctx, Collection, id) },
+	} {
+		before, err := s.FindByID(contextTest, Collection, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = change(almacen.WithIfMatch(contextTest, "stale"))
+		if err != almacen.ErrPreconditionFailed {
+			t.Errorf("change %d: expected %v, got %v", i, almacen.ErrPreconditionFailed, err)
+		}
+		after, err := s.FindByID(contextTest, Collection, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(before, after) {
+			t.Errorf("change %d: expected %v, got %v", i, before, after)
+		}
+		if err = change(almacen.WithIfMatch(contextTest, revision(s, t, id))); err != nil {
+			t.Errorf("change %d: %v", i, err)
+		}
+	}
+	if _, err := s.FindByID(contextTest, Collection, id); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testIfMatchMissing(s almacen.Store, t *testing.T) {
+	ctx := almacen.WithIfMatch(contextTest, "any")
+	for i, change := range []func() error{
+		func() error { return s.Save(ctx, Collection, map[string]interface{}{"_id": "missing"}) },
+		func() error { return s.Replace(ctx, Collection, map[string]interface{}{"_id": "missing"}) },
+		func() error { return s.UpdateField(ctx, Collection, "missing", "a", 1.0) },
+		func() error { return s.Delete(ctx, Collection, "missing") },
+	} {
+		if err := change(); err != almacen.ErrPreconditionFailed {
+			t.Errorf("change %d: expected %v, got %v", i, almacen.ErrPreconditionFailed, err)
+		}
+	}
+	if _, err := s.FindByID(contextTest, Collection, "missing"); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testRevisionNotWritable(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	id := entitiesTest[0]["_id"].(string)
+	for i, err := range []error{
+		s.UpdateField(contextTest, Collection, id, almacen.RevField, "mine"),
+		s.DeleteField(contextTest, Collection, id, almacen.RevField),
+		s.Update(contextTest, Collection, id, &almacen.Update{Unset: []string{almacen.RevField}}),
+	} {
+		if err != almacen.ErrInvalidFieldName {
+			t.Errorf("change %d: expected %v, got %v", i, almacen.ErrInvalidFieldName, err)
+		}
+	}
+	if err := s.Save(contextTest, Collection, map[string]interface{}{"_id": id, almacen.RevField: "mine"}); err != nil {
+		t.Fatal(err)
+	}
+	if rev := revision(s, t, id); rev == "mine" {
+		t.Errorf("expected revision set by the store, got %q", rev)
+	}
+}
+
+func testFindWithRevision(s almacen.Store, t *testing.T) {
+	finder, ok := s.(almacen.RevisionFinder)
+	if !ok {
+		t.Skip("not a RevisionFinder")
+	}
+	populateTest(s, t)
+	for _, e := range entitiesTest {
+		id := e["_id"].(string)
+		res, rev, err := finder.FindWithRevision(contextTest, Collection, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, e) {
+			t.Errorf("expected %v, got %v", e, res)
+		}
+		if expected := revision(s, t, id); rev != expected {
+			t.Errorf("expected revision %q, got %q", expected, rev)
+		}
+		value, fieldRev, err := finder.FindFieldWithRevision(contextTest, Collection, id, "_id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != id || fieldRev != rev {
+			t.Errorf("expected %q at %q, got %v at %q", id, rev, value, fieldRev)
+		}
+	}
+	if _, _, err := finder.FindWithRevision(contextTest, Collection, "missing"); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+	if _, _, err := finder.FindFieldWithRevision(contextTest, Collection, "missing", "_id"); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testReplaceCollection(s almacen.Store, t *testing.T) {
+	cw := collectionWriter(s, t)
+	populateTest(s, t)
+	other := map[string]interface{}{"_id": "other"}
+	if err := s.Save(contextTest, Collection+"Other", other); err != nil {
+		t.Fatal(err)
+	}
+	ents := []map[string]interface{}{
+		{"_id": "n2", "x": "b"},
+		{"_id": "n1", "x": "a"},
+	}
+	if err := cw.ReplaceCollection(contextTest, Collection, ents); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Find(contextTest, Collection, &almacen.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]interface{}{ents[1], ents[0]}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+	res, err = s.FindAll(contextTest, Collection+"Other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []map[string]interface{}{other}) {
+		t.Errorf("expected other collection untouched, got %v", res)
+	}
+}
+
+func testReplaceCollectionEmpty(s almacen.Store, t *testing.T) {
+	cw := collectionWriter(s, t)
+	populateTest(s, t)
+	if err := cw.ReplaceCollection(contextTest, Collection, nil); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindAll(contextTest, Collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Errorf("expected no entities, got %v", res)
+	}
+}
+
+func testReplaceCollectionDuplicated(s almacen.Store, t *testing.T) {
+	cw := collectionWriter(s, t)
+	populateTest(s, t)
+	ents := []map[string]interface{}{{"_id": "n1"}, {"_id": "n2"}, {"_id": "n1"}}
+	if err := cw.ReplaceCollection(contextTest, Collection, ents); err != almacen.ErrExisting {
+		t.Errorf("expected %v, got %v", almacen.ErrExisting, err)
+	}
+	checkUnchanged(s, t)
+}
+
+func testReplaceCollectionIDNotString(s almacen.Store, t *testing.T) {
+	cw := collectionWriter(s, t)
+	populateTest(s, t)
+	ents := []map[string]interface{}{{"_id": "n1"}, {"_id": 2}}
+	if err := cw.ReplaceCollection(contextTest, Collection, ents); err != almacen.ErrIdNotString {
+		t.Errorf("expected %v, got %v", almacen.ErrIdNotString, err)
+	}
+	checkUnchanged(s, t)
+}
+
+// checkUnchanged checks the collection still has the entities of populateTest
+func checkUnchanged(s almacen.Store, t *testing.T) {
+	res, err := s.FindAll(contextTest, Collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(sortableEntitySlice(res))
+	sort.Sort(sortableEntitySlice(entitiesTest))
+	if !reflect.DeepEqual(res, entitiesTest) {
+		t.Errorf("expected %v, got %v", entitiesTest, res)
+	}
+}
+
+func testDropCollection(s almacen.Store, t *testing.T) {
+	cw := collectionWriter(s, t)
+	populateTest(s, t)
+	if err := cw.DropCollection(contextTest, Collection); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindAll(contextTest, Collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Errorf("expected no entities, got %v", res)
+	}
+	if _, err = s.FindByID(contextTest, Collection, entitiesTest[0]["_id"].(string)); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+	if err = s.Save(contextTest, Collection, map[string]interface{}{"_id": "again"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.FindByID(contextTest, Collection, "again"); err != nil {
+		t.Errorf("expected entity after dropping, got %v", err)
+	}
+}
+
+func testDropCollectionNotFound(s almacen.Store, t *testing.T) {
+	if err := collectionWriter(s, t).DropCollection(contextTest, Collection); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+// collectionInfo returns the info of Collection among those of every collection, if any
+func collectionInfo(s almacen.Store, t *testing.T) (almacen.CollectionInfo, bool) {
+	infos, err := collectionLister(s, t).Collections(contextTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sort.SliceIsSorted(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name }) {
+		t.Errorf("expected collections sorted by name, got %v", infos)
+	}
+	for _, info := range infos {
+		if info.Name == Collection {
+			return info, true
+		}
+	}
+	return almacen.CollectionInfo{}, false
+}
+
+func testCollections(s almacen.Store, t *testing.T) {
+	cw := collectionWriter(s, t)
+	if info, found := collectionInfo(s, t); found {
+		t.Errorf("expected no collection, got %v", info)
+	}
+	populateTest(s, t)
+	info, found := collectionInfo(s, t)
+	if !found {
+		t.Fatalf("expected collection %q", Collection)
+	}
+	if info.Count != len(entitiesTest) || info.Size <= 0 {
+		t.Errorf("expected %d entities with some size, got %v", len(entitiesTest), info)
+	}
+	if err := cw.DropCollection(contextTest, Collection); err != nil {
+		t.Fatal(err)
+	}
+	if info, found := collectionInfo(s, t); found {
+		t.Errorf("expected no collection after dropping, got %v", info)
+	}
+}
+
+func testCount(s almacen.Store, t *testing.T) {
+	cl := collectionLister(s, t)
+	n, err := cl.Count(contextTest, Collection)
+	if err != nil || n != 0 {
+		t.Errorf("expected 0 entities, got %d %v", n, err)
+	}
+	populateTest(s, t)
+	n, err = cl.Count(contextTest, Collection)
+	if err != nil || n != len(entitiesTest) {
+		t.Errorf("expected %d entities, got %d %v", len(entitiesTest), n, err)
+	}
+}
+
+func testAggregate(s almacen.Store, t *testing.T) {
+	ag := aggregator(s, t)
+	for _, e := range []map[string]interface{}{
+		{"_id": "a", "city": "Madrid", "temperature": 20.0},
+		{"_id": "b", "city": "Madrid", "temperature": 30.0},
+		{"_id": "c", "city": "Oslo", "temperature": 5.0},
+		{"_id": "d", "city": "Oslo", "temperature": "unknown"},
+		{"_id": "e", "city": "Lima", "temperature": 18.0},
+		{"_id": "f", "temperature": 40.0},
+	} {
+		if err := s.Save(contextTest, Collection, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	match, err := almacen.ParseFilter("city!=Lima")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := []almacen.Stage{
+		{Match: match},
+		{Group: &almacen.Group{By: "city", Fields: map[string]almacen.Accumulator{
+			"n":   {Op: almacen.AccumulatorCount},
+			"sum": {Op: almacen.AccumulatorSum, Field: "temperature"},
+			"avg": {Op: almacen.AccumulatorAvg, Field: "temperature"},
+			"min": {Op: almacen.AccumulatorMin, Field: "temperature"},
+			"max": {Op: almacen.AccumulatorMax, Field: "temperature"},
+		}}},
+		{Sort: []string{"-n", "_id"}},
+		{Limit: 2},
+	}
+	res, err := ag.Aggregate(contextTest, Collection, pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]interface{}{
+		{"_id": "Madrid", "n": 2.0, "sum": 50.0, "avg": 25.0, "min": 20.0, "max": 30.0},
+		{"_id": "Oslo", "n": 2.0, "sum": 5.0, "avg": 5.0, "min": 5.0, "max": "unknown"},
+	}
+	// numbers may come as integers from a backend, compare them as JSON does
+	var normalized []map[string]interface{}
+	if b, err := json.Marshal(res); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(b, &normalized); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(normalized, expected) {
+		t.Errorf("expected %v, got %v", expected, normalized)
+	}
+
+	res, err = ag.Aggregate(contextTest, "missing", pipeline)
+	if err != nil || len(res) != 0 {
+		t.Errorf("expected no documents, got %v %v", res, err)
+	}
+}
+
+// searchIDs returns the IDs of the hits, checking they are ordered by score
+func searchIDs(s almacen.Searcher, text string, limit int, t *testing.T) []string {
+	hits, err := s.Search(contextTest, Collection, text, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for i, hit := range hits {
+		if i > 0 && hit.Score > hits[i-1].Score {
+			t.Errorf("%q: expected hits ordered by score, got %v", text, hits)
+		}
+		ids = append(ids, hit.Entity["_id"].(string))
+	}
+	return ids
+}
+
+func testSearch(s almacen.Store, t *testing.T) {
+	se, ix := searcher(s, t), indexer(s, t)
+	ents := []map[string]interface{}{
+		{"_id": "a", "label": "Very hot"},
+		{"_id": "b", "label": "hot, hot day", "tags": []interface{}{"summer"}},
+		{"_id": "c", "label": "cold", "notes": map[string]interface{}{"text": "no hot water"}},
+		{"_id": "d", "label": "warm", "temperature": 20.0, "code": "hot"},
+	}
+	for _, e := range ents {
+		if err := s.Save(contextTest, Collection, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := se.Search(contextTest, Collection, "hot", 0); err != almacen.ErrNoTextIndex {
+		t.Errorf("expected %v, got %v", almacen.ErrNoTextIndex, err)
+	}
+	spec := almacen.IndexSpec{Fields: []string{"tags", "label", "notes.text"}, Text: true}
+	if err := ix.EnsureIndex(contextTest, Collection, spec); err != nil {
+		t.Fatal(err)
+	}
+	other := almacen.IndexSpec{Fields: []string{"code"}, Text: true}
+	if err := ix.EnsureIndex(contextTest, Collection, other); err != almacen.ErrIndexConflict {
+		t.Errorf("expected %v for a second text index, got %v", almacen.ErrIndexConflict, err)
+	}
+	specs, err := ix.Indexes(contextTest, Collection)
+	expected := []almacen.IndexSpec{{
+		Name:   "label_text_notes.text_text_tags_text",
+		Fields: []string{"label", "notes.text", "tags"},
+		Text:   true,
+	}}
+	if err != nil || !reflect.DeepEqual(specs, expected) {
+		t.Errorf("expected %v, got %v %v", expected, specs, err)
+	}
+	// the code of d is not in the index
+	hits, err := se.Search(contextTest, Collection, "HOT", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 3 || hits[0].Score <= 0 || !reflect.DeepEqual(hits[0].Entity, ents[1]) {
+		t.Errorf("expected 3 hits, the first one %v, got %v", ents[1], hits)
+	}
+	for _, c := range []struct {
+		text     string
+		limit    int
+		expected []string
+	}{
+		{"hot", 1, []string{"b"}},
+		{"summer warm", 0, []string{"b", "d"}},
+		{"water", 0, []string{"c"}},
+		{"freezing", 0, []string{}},
+	} {
+		ids := searchIDs(se, c.text, c.limit, t)
+		sort.Strings(ids)
+		if !reflect.DeepEqual(ids, c.expected) {
+			t.Errorf("%q: expected %v, got %v", c.text, c.expected, ids)
+		}
+	}
+	if _, err := se.Search(contextTest, Collection, " -- ", 0); err != almacen.ErrInvalidSearch {
+		t.Errorf("expected %v, got %v", almacen.ErrInvalidSearch, err)
+	}
+	// a missing collection has no text index either
+	if _, err := se.Search(contextTest, "missing", "hot", 0); err != almacen.ErrNoTextIndex {
+		t.Errorf("expected %v, got %v", almacen.ErrNoTextIndex, err)
+	}
+}
+
+func testSearchChanges(s almacen.Store, t *testing.T) {
+	se, ix := searcher(s, t), indexer(s, t)
+	if err := ix.EnsureIndex(contextTest, Collection, almacen.IndexSpec{Fields: []string{"label"}, Text: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []map[string]interface{}{
+		{"_id": "a", "label": "very hot"},
+		{"_id": "b", "label": "hot day"},
+	} {
+		if err := s.Save(contextTest, Collection, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids := searchIDs(se, "hot", 0, t); len(ids) != 2 {
+		t.Errorf("expected 2 hits, got %v", ids)
+	}
+	if err := s.UpdateField(contextTest, Collection, "a", "label", "very cold"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(contextTest, Collection, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchIDs(se, "hot cold", 0, t); !reflect.DeepEqual(ids, []string{"a"}) {
+		t.Errorf("expected [a], got %v", ids)
+	}
+	err := collectionWriter(s, t).ReplaceCollection(contextTest, Collection, []map[string]interface{}{{"_id": "c", "label": "hot"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchIDs(se, "hot cold", 0, t); !reflect.DeepEqual(ids, []string{"c"}) {
+		t.Errorf("expected [c], got %v", ids)
+	}
+}
+
+func testIndexes(s almacen.Store, t *testing.T) {
+	ix := indexer(s, t)
+	populateTest(s, t)
+	specs := []almacen.IndexSpec{
+		{Fields: []string{"temperature"}},
+		{Name: "place", Fields: []string{"location.lat", "location.lon"}, Unique: true, Sparse: true},
+	}
+	for _, spec := range specs {
+		for i := 0; i < 2; i++ { // twice, the second one doing nothing
+			if err := ix.EnsureIndex(contextTest, Collection, spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	res, err := ix.Indexes(contextTest, Collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs[1], specs[0] = specs[0], specs[1]
+	specs[1].Name = "temperature_1"
+	if !reflect.DeepEqual(res, specs) {
+		t.Errorf("expected %v, got %v", specs, res)
+	}
+
+	for _, spec := range []almacen.IndexSpec{
+		{Name: "place", Fields: []string{"location.lat"}},
+		{Name: "other", Fields: []string{"temperature"}},
+		{Fields: []string{"temperature"}, Unique: true},
+	} {
+		if err := ix.EnsureIndex(contextTest, Collection, spec); err != almacen.ErrIndexConflict {
+			t.Errorf("%v: expected %v, got %v", spec, almacen.ErrIndexConflict, err)
+		}
+	}
+	if err := ix.EnsureIndex(contextTest, Collection, almacen.IndexSpec{}); err != almacen.ErrInvalidIndex {
+		t.Errorf("expected %v, got %v", almacen.ErrInvalidIndex, err)
+	}
+
+	if err := ix.DropIndex(contextTest, Collection, "place"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.DropIndex(contextTest, Collection, "place"); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+	if res, err = ix.Indexes(contextTest, Collection); err != nil || len(res) != 1 {
+		t.Errorf("expected an index, got %v %v", res, err)
+	}
+	if res, err = ix.Indexes(contextTest, "missing"); err != nil || len(res) != 0 {
+		t.Errorf("expected no indexes, got %v %v", res, err)
+	}
+}
+
+func testUniqueIndex(s almacen.Store, t *testing.T) {
+	ix := indexer(s, t)
+	err := ix.EnsureIndex(contextTest, Collection, almacen.IndexSpec{Fields: []string{"email"}, Unique: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []map[string]interface{}{
+		{"_id": "a", "email": "a@example.com"},
+		{"_id": "b", "email": "b@example.com", "tags": []interface{}{"x"}},
+	} {
+		if err := s.Save(contextTest, Collection, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		name string
+		op   func() error
+		err  error
+	}{
+		{"save same key", func() error {
+			return s.Save(contextTest, Collection, map[string]interface{}{"_id": "a", "email": "a@example.com", "n": 1.0})
+		}, nil},
+		{"save", func() error {
+			return s.Save(contextTest, Collection, map[string]interface{}{"_id": "c", "email": "a@example.com"})
+		}, almacen.ErrDuplicateKey},
+		{"insert", func() error {
+			return s.Insert(contextTest, Collection, map[string]interface{}{"_id": "c", "email": "b@example.com"})
+		}, almacen.ErrDuplicateKey},
+		{"insert missing", func() error {
+			return s.Insert(contextTest, Collection, map[string]interface{}{"_id": "c"})
+		}, nil},
+		{"insert missing again", func() error {
+			return s.Insert(contextTest, Collection, map[string]interface{}{"_id": "d"})
+		}, almacen.ErrDuplicateKey},
+		{"update field", func() error {
+			return s.UpdateField(contextTest, Collection, "b", "email", "a@example.com")
+		}, almacen.ErrDuplicateKey},
+		{"update field in array", func() error {
+			return s.UpdateField(contextTest, Collection, "b", "tags.0", "y")
+		}, nil},
+		{"update", func() error {
+			return s.Update(contextTest, Collection, "b", &almacen.Update{Unset: []string{"email"}})
+		}, almacen.ErrDuplicateKey},
+		{"replace", func() error {
+			return s.Replace(contextTest, Collection, map[string]interface{}{"_id": "a", "email": "b@example.com"})
+		}, almacen.ErrDuplicateKey},
+		{"free key", func() error { return s.Delete(contextTest, Collection, "b") }, nil},
+		{"reuse key", func() error {
+			return s.Replace(contextTest, Collection, map[string]interface{}{"_id": "a", "email": "b@example.com"})
+		}, nil},
+	} {
+		if err := c.op(); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+	res, err := s.FindByID(contextTest, Collection, "a")
+	if err != nil || res["email"] != "b@example.com" {
+		t.Errorf("expected the last email, got %v %v", res, err)
+	}
+}
+
+func testUniqueIndexExisting(s almacen.Store, t *testing.T) {
+	ix := indexer(s, t)
+	for _, id := range []string{"a", "b"} {
+		if err := s.Save(contextTest, Collection, map[string]interface{}{"_id": id, "n": 1.0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ix.EnsureIndex(contextTest, Collection, almacen.IndexSpec{Fields: []string{"n"}, Unique: true})
+	if err != almacen.ErrDuplicateKey {
+		t.Errorf("expected %v, got %v", almacen.ErrDuplicateKey, err)
+	}
+	if specs, err := ix.Indexes(contextTest, Collection); err != nil || len(specs) != 0 {
+		t.Errorf("expected no indexes, got %v %v", specs, err)
+	}
+}
+
+func testSparseIndex(s almacen.Store, t *testing.T) {
+	ix := indexer(s, t)
+	spec := almacen.IndexSpec{Fields: []string{"a", "b"}, Unique: true, Sparse: true}
+	if err := ix.EnsureIndex(contextTest, Collection, spec); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ent map[string]interface{}
+		err error
+	}{
+		{map[string]interface{}{"_id": "1"}, nil},
+		{map[string]interface{}{"_id": "2"}, nil},
+		{map[string]interface{}{"_id": "3", "a": 1.0}, nil},
+		{map[string]interface{}{"_id": "4", "a": 1.0, "b": nil}, almacen.ErrDuplicateKey},
+		{map[string]interface{}{"_id": "5", "a": 1.0, "b": 2.0}, nil},
+		{map[string]interface{}{"_id": "6", "b": 2.0}, nil},
+		{map[string]interface{}{"_id": "7", "a": 1.0, "b": 2.0}, almacen.ErrDuplicateKey},
+	} {
+		if err := s.Save(contextTest, Collection, c.ent); err != c.err {
+			t.Errorf("%v: expected %v, got %v", c.ent, c.err, err)
+		}
+	}
+}
+
+func testIndexFind(s almacen.Store, t *testing.T) {
+	ix := indexer(s, t)
+	ents := []map[string]interface{}{
+		{"_id": "a", "city": "Madrid", "tags": []interface{}{"x", "y"}, "n": 1.0},
+		{"_id": "b", "city": "Oslo", "tags": []interface{}{"y"}, "n": 2.0},
+		{"_id": "c", "city": "Madrid", "n": 2.0},
+		{"_id": "d", "tags": "x"},
+	}
+	for _, e := range ents {
+		if err := s.Save(contextTest, Collection, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, spec := range []almacen.IndexSpec{
+		{Fields: []string{"tags"}},
+		{Fields: []string{"city", "n"}},
+	} {
+		if err := ix.EnsureIndex(contextTest, Collection, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.UpdateField(contextTest, Collection, "b", "city", "Madrid"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(contextTest, Collection, "c"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		filter   string
+		expected []string
+	}{
+		{`tags=x`, []string{"a", "d"}},
+		{`tags in [y, z]`, []string{"a", "b"}},
+		{`city=Madrid and n=2`, []string{"b"}},
+		{`city in [Madrid, Oslo] and n in [1, 2] and tags=x`, []string{"a"}},
+		{`city=Oslo and n=2`, []string{}},
+		{`tags=null`, []string{}},
+		{`city=null`, []string{"d"}},
+	} {
+		f, err := almacen.ParseFilter(c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := s.Find(contextTest, Collection, &almacen.Query{Filter: f})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, e := range res {
+			ids = append(ids, e["_id"].(string))
+		}
+		if !reflect.DeepEqual(ids, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.filter, c.expected, ids)
+		}
+	}
+}
+
+func testIndexReplaceCollection(s almacen.Store, t *testing.T) {
+	ix, cw := indexer(s, t), collectionWriter(s, t)
+	populateTest(s, t)
+	spec := almacen.IndexSpec{Fields: []string{"label"}, Unique: true, Sparse: true}
+	if err := ix.EnsureIndex(contextTest, Collection, spec); err != nil {
+		t.Fatal(err)
+	}
+	err := cw.ReplaceCollection(contextTest, Collection, []map[string]interface{}{
+		{"_id": "a", "label": "L"},
+		{"_id": "b", "label": "L"},
+	})
+	if err != almacen.ErrDuplicateKey {
+		t.Errorf("expected %v, got %v", almacen.ErrDuplicateKey, err)
+	}
+	if res, err := s.FindAll(contextTest, Collection); err != nil || len(res) != len(entitiesTest) {
+		t.Errorf("expected the old entities, got %v %v", res, err)
+	}
+	err = cw.ReplaceCollection(contextTest, Collection, []map[string]interface{}{{"_id": "a", "label": "L"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if specs, err := ix.Indexes(contextTest, Collection); err != nil || len(specs) != 1 {
+		t.Errorf("expected the index kept, got %v %v", specs, err)
+	}
+	err = s.Save(contextTest, Collection, map[string]interface{}{"_id": "b", "label": "L"})
+	if err != almacen.ErrDuplicateKey {
+		t.Errorf("expected %v, got %v", almacen.ErrDuplicateKey, err)
+	}
+}
+
+var geoIndex = almacen.IndexSpec{Fields: []string{"location"}, Geo: true}
+
+func testGeoNear(s almacen.Store, t *testing.T) {
+	ix := indexer(s, t)
+	geo := geoQuerier(s, t)
+	madrid := almacen.GeoPoint{Lon: -3.7, Lat: 40.4}
+	if _, err := geo.Near(contextTest, Collection, "location", madrid, 1000, 0); err != almacen.ErrNoGeoIndex {
+		t.Errorf("expected %v, got %v", almacen.ErrNoGeoIndex, err)
+	}
+	for _, e := range filterEntities {
+		if err := s.Save(contextTest, Collection, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ix.EnsureIndex(contextTest, Collection, geoIndex); err != nil {
+		t.Fatal(err)
+	}
+	hits, err := geo.Near(contextTest, Collection, "location", madrid, 500e3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || hits[0].Entity["_id"] != "madrid" || hits[1].Entity["_id"] != "bilbao" {
+		t.Fatalf("expected madrid and bilbao, got %v", hits)
+	}
+	if hits[0].Distance > 1 || hits[1].Distance < 300e3 || hits[1].Distance > 340e3 {
+		t.Errorf("unexpected distances %v and %v", hits[0].Distance, hits[1].Distance)
+	}
+	if _, hasRev := hits[0].Entity[almacen.RevField]; hasRev {
+		t.Errorf("unexpected revision in %v", hits[0].Entity)
+	}
+	if hits, err = geo.Near(contextTest, Collection, "location", madrid, 500e3, 1); err != nil || len(hits) != 1 {
+		t.Errorf("expected 1 hit, got %v %v", hits, err)
+	}
+	u := &almacen.Update{Set: map[string]interface{}{"location": map[string]interface{}{"lat": 59.8, "lon": 10.7}}}
+	if err = s.Update(contextTest, Collection, "bilbao", u); err != nil {
+		t.Fatal(err)
+	}
+	oslo := almacen.GeoPoint{Lon: 10.7, Lat: 59.9}
+	if hits, err = geo.Near(contextTest, Collection, "location", oslo, 50e3, 0); err != nil || len(hits) != 2 || hits[0].Entity["_id"] != "oslo" {
+		t.Errorf("expected oslo and bilbao, got %v %v", hits, err)
+	}
+	if _, err = geo.Near(contextTest, Collection, "location", oslo, 0, 0); err == nil {
+		t.Error("expected an error for no radius")
+	}
+}
+
+func testGeoWithin(s almacen.Store, t *testing.T) {
+	ix := indexer(s, t)
+	geo := geoQuerier(s, t)
+	ents := append(filterEntities, map[string]interface{}{"_id": "porto", "location": []interface{}{-8.6, 41.15}},
+		map[string]interface{}{"_id": "lisbon", "location": map[string]interface{}{"type": "Point", "coordinates": []interface{}{-9.14, 38.72}}})
+	for _, e := range ents {
+		if err := s.Save(contextTest, Collection, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spain := &almacen.GeoArea{Box: []almacen.GeoPoint{{Lon: -9.5, Lat: 36}, {Lon: 3.3, Lat: 43.8}}}
+	for i := 0; i < 2; i++ {
+		for _, c := range []struct {
+			area     *almacen.GeoArea
+			limit    int
+			expected []string
+		}{
+			{spain, 0, []string{"bilbao", "lisbon", "madrid", "porto"}},
+			{spain, 1, []string{"bilbao"}},
+			{&almacen.GeoArea{Polygon: []almacen.GeoPoint{{Lon: -10, Lat: 41}, {Lon: -2, Lat: 41}, {Lon: -2, Lat: 44}, {Lon: -10, Lat: 42}}}, 0, []string{"bilbao", "porto"}},
+			{&almacen.GeoArea{Box: []almacen.GeoPoint{{Lon: 0, Lat: 0}, {Lon: 1, Lat: 1}}}, 0, []string{}},
+		} {
+			res, err := geo.Within(contextTest, Collection, "location", c.area, c.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, e := range res {
+				ids = append(ids, e["_id"].(string))
+			}
+			if !reflect.DeepEqual(ids, c.expected) {
+				t.Errorf("%+v: expected %v, got %v", c.area, c.expected, ids)
+			}
+		}
+		// the same with an index
+		if err := ix.EnsureIndex(contextTest, Collection, geoIndex); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testGeoInvalidLocation(s almacen.Store, t *testing.T) {
+	ix := indexer(s, t)
+	invalid := map[string]interface{}{"_id": "x", "location": "here"}
+	if err := s.Save(contextTest, Collection, invalid); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.EnsureIndex(contextTest, Collection, geoIndex); err != almacen.ErrInvalidLocation {
+		t.Errorf("expected %v, got %v", almacen.ErrInvalidLocation, err)
+	}
+	if err := s.Delete(contextTest, Collection, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.EnsureIndex(contextTest, Collection, geoIndex); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ent map[string]interface{}
+		err error
+	}{
+		{invalid, almacen.ErrInvalidLocation},
+		{map[string]interface{}{"_id": "y", "location": map[string]interface{}{"lon": 200.0, "lat": 0.0}}, almacen.ErrInvalidLocation},
+		{map[string]interface{}{"_id": "z", "location": map[string]interface{}{"type": "Point", "coordinates": []interface{}{1.0, 2.0}}}, nil},
+		{map[string]interface{}{"_id": "w"}, nil},
+	} {
+		if err := s.Save(contextTest, Collection, c.ent); err != c.err {
+			t.Errorf("%v: expected %v, got %v", c.ent, c.err, err)
+		}
+	}
+}
+
+func testFindByID(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	res, err := s.FindByID(contextTest, Collection, entitiesTest[0]["_id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, entitiesTest[0]) {
+		t.Errorf("expected %v, got %v", entitiesTest, res)
+	}
+}
+
+func testFindByIDNotFound(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	_, err := s.FindByID(contextTest, Collection, "shouldnotexist")
+	if err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testSaveIDNotString(s almacen.Store, t *testing.T) {
+	for _, id := range []interface{}{42, 4.2, nil, true, map[string]interface{}{"a": "b"}} {
+		initTest()
+		entitiesTest[0]["_id"] = id
+		err := s.Save(contextTest, Collection, entitiesTest[0])
+		if err != almacen.ErrIdNotString {
+			t.Errorf("expected %v, got %v", almacen.ErrIdNotString, err)
+		}
+	}
+	initTest()
+	delete(entitiesTest[0], "_id")
+	err := s.Save(contextTest, Collection, entitiesTest[0])
+	if err != almacen.ErrIdNotString {
+		t.Errorf("expected %v, got %v", almacen.ErrIdNotString, err)
+	}
+	res, err := s.FindAll(contextTest, Collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Errorf("expected no entities, got %v", res)
+	}
+}
+
+func testSaveReplaces(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "x": "X", "y": map[string]interface{}{"z": 1}}
+	replacement := map[string]interface{}{"_id": "ID", "a": "A"}
+
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(contextTest, Collection, replacement); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, replacement) {
+		t.Errorf("expected %v, got %v", replacement, res)
+	}
+}
+
+func testInsert(s almacen.Store, t *testing.T) {
+	initTest()
+	for _, e := range entitiesTest {
+		if err := s.Insert(contextTest, Collection, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := s.FindAll(contextTest, Collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(sortableEntitySlice(res))
+	sort.Sort(sortableEntitySlice(entitiesTest))
+	if !reflect.DeepEqual(res, entitiesTest) {
+		t.Errorf("expected %v, got %v", entitiesTest, res)
+	}
+}
+
+func testInsertExisting(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	err := s.Insert(contextTest, Collection, map[string]interface{}{"_id": entitiesTest[0]["_id"], "x": "X"})
+	if err != almacen.ErrExisting {
+		t.Errorf("expected %v, got %v", almacen.ErrExisting, err)
+	}
+	res, err := s.FindByID(contextTest, Collection, entitiesTest[0]["_id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, entitiesTest[0]) {
+		t.Errorf("expected %v, got %v", entitiesTest[0], res)
+	}
+}
+
+func testInsertIDNotString(s almacen.Store, t *testing.T) {
+	err := s.Insert(contextTest, Collection, map[string]interface{}{"_id": 42})
+	if err != almacen.ErrIdNotString {
+		t.Errorf("expected %v, got %v", almacen.ErrIdNotString, err)
+	}
+}
+
+func testReplace(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	replacement := map[string]interface{}{"_id": entitiesTest[0]["_id"], "x": "X"}
+	if err := s.Replace(contextTest, Collection, replacement); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindByID(contextTest, Collection, replacement["_id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, replacement) {
+		t.Errorf("expected %v, got %v", replacement, res)
+	}
+}
+
+func testReplaceNotFound(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	err := s.Replace(contextTest, Collection, map[string]interface{}{"_id": "shouldnotexist", "x": "X"})
+	if err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+	_, err = s.FindByID(contextTest, Collection, "shouldnotexist")
+	if err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testDelete(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	if err := s.Delete(contextTest, Collection, entitiesTest[1]["_id"].(string)); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindAll(contextTest, Collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entitiesTest = append(entitiesTest[0:1], entitiesTest[2:]...)
+	sort.Sort(sortableEntitySlice(res))
+	sort.Sort(sortableEntitySlice(entitiesTest))
+	if !reflect.DeepEqual(res, entitiesTest) {
+		t.Errorf("expected %v, got %v", entitiesTest, res)
+	}
+}
+
+func testDeleteNotFound(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	err := s.Delete(contextTest, Collection, "shouldnotexist")
+	if err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testFindField(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	for _, entity := range entitiesTest {
+		key := entity["_id"].(string)
+		for field, value := range entity {
+			if field != "_id" {
+				res, err := s.FindField(contextTest, Collection, key, field)
+				if err != nil {
+					t.Errorf("%#v value: %#v, id: %#v, field: %#v", err, value, key, field)
+				}
+
+				if !reflect.DeepEqual(res, value) {
+					t.Errorf("expected %v, got %v", value, res)
+				}
+			}
+		}
+	}
+}
+
+func testFindFieldNested(s almacen.Store, t *testing.T) {
+	id := "ID"
+	elZ := map[string]interface{}{"z": 12}
+	elY := map[string]interface{}{"y": elZ}
+	el := map[string]interface{}{"_id": "ID", "x": elY}
+	cases := map[string]interface{}{
+		"x":     elY,
+		"x.y":   elZ,
+		"x.y.z": 12,
+	}
+
+	if err := s.Save(contextTest, Collection, el); err != nil {
+		t.Fatal(err)
+	}
+
+	for field, value := range cases {
+		res, err := s.FindField(contextTest, Collection, id, field)
+		if err != nil {
+			t.Errorf("%#v value: %#v, id: %#v, field: %#v", err, value, id, field)
+		}
+		if !reflect.DeepEqual(res, value) {
+			t.Errorf("expected %v, got %v", value, res)
+		}
+	}
+
+	// Not found
+	cases["not.exist.i.hope"] = nil
+	for field := range cases {
+		field := field + "__xx"
+		res, err := s.FindField(contextTest, Collection, id, field)
+		if err != almacen.ErrNotFound {
+			t.Errorf("expected %v, got %v", almacen.ErrNotFound, res)
+		}
+	}
+}
+
+func testFindFieldNull(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "x": nil}
+
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindField(contextTest, Collection, "ID", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != nil {
+		t.Errorf("expected %v, got %v", nil, res)
+	}
+}
+
+func testFindFieldNotFoundEntity(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	for _, field := range []string{"temperature", "x.y.z"} {
+		_, err := s.FindField(contextTest, Collection, "shouldnotexist", field)
+		if err != almacen.ErrNotFound {
+			t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+		}
+	}
+}
+
+func testUpdateField(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{"y": map[string]interface{}{"z": 12}}}
+	expected := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{"y": map[string]interface{}{"z": "CHANGED"}}}
+
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateField(contextTest, Collection, "ID", "x.y.z", "CHANGED"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func testUpdateFieldTraversingErr(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{"y": map[string]interface{}{"z": 12}}}
+
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	err := s.UpdateField(contextTest, Collection, "ID", "x.y.z.t", "CHANGED")
+	expected := almacen.ErrTraversingObject
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("expected %#v, got %#v", expected, err)
+	}
+}
+
+func testUpdateFieldNotFoundEntity(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	for _, field := range []string{"temperature", "x.y.z"} {
+		err := s.UpdateField(contextTest, Collection, "shouldnotexist", field, "CHANGED")
+		if err != almacen.ErrNotFound {
+			t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+		}
+	}
+	_, err := s.FindByID(contextTest, Collection, "shouldnotexist")
+	if err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testUpdateFieldParentNotFound(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{}, "s": "S", "items": []interface{}{1.0}}
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		field string
+		err   error
+	}{
+		{"x.y.z", almacen.ErrParentNotFound},
+		{"a.b", almacen.ErrParentNotFound},
+		{"s.t", almacen.ErrTraversingObject},
+		{"s.t.u", almacen.ErrTraversingObject},
+		{"items.name.x", almacen.ErrTraversingObject},
+	} {
+		if err := s.UpdateField(contextTest, Collection, "ID", c.field, "CHANGED"); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.field, c.err, err)
+		}
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, original) {
+		t.Errorf("expected %v, got %v", original, res)
+	}
+}
+
+func testUpdateCreateParents(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{}, "s": "S"}
+	expected := map[string]interface{}{
+		"_id": "ID",
+		"x":   map[string]interface{}{"y": map[string]interface{}{"z": "Z"}},
+		"a":   map[string]interface{}{"b": "B"},
+		"s":   "S",
+	}
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	set := &almacen.Update{Set: map[string]interface{}{"x.y.z": "Z", "a.b": "B"}}
+	if err := s.Update(contextTest, Collection, "ID", set); err != nil {
+		t.Fatal(err)
+	}
+	err := s.Update(contextTest, Collection, "ID", &almacen.Update{Set: map[string]interface{}{"s.t": "T"}})
+	if err != almacen.ErrTraversingObject {
+		t.Errorf("expected %v, got %v", almacen.ErrTraversingObject, err)
+	}
+	if err = s.Update(contextTest, Collection, "shouldnotexist", set); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+	if _, err = s.FindByID(contextTest, Collection, "shouldnotexist"); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testDeleteField(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{"y": map[string]interface{}{"z": 12}}, "a": "A"}
+	expected := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{"y": map[string]interface{}{}}, "a": "A"}
+
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteField(contextTest, Collection, "ID", "x.y.z"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func testDeleteFieldNested(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{"y": map[string]interface{}{"z": 12}, "w": "W"}}
+	expected := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{"w": "W"}}
+
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteField(contextTest, Collection, "ID", "x.y"); err != nil {
+		t.Fatal(err)
+	}
+	// deleting what is not there is not an error
+	if err := s.DeleteField(contextTest, Collection, "ID", "x.q.r"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+	if _, err := s.FindField(contextTest, Collection, "ID", "x.y.z"); err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testDeleteFieldNotFoundEntity(s almacen.Store, t *testing.T) {
+	populateTest(s, t)
+	err := s.DeleteField(contextTest, Collection, "shouldnotexist", "temperature")
+	if err != almacen.ErrNotFound {
+		t.Errorf("expected %v, got %v", almacen.ErrNotFound, err)
+	}
+}
+
+func testDeleteFieldTraversingErr(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "x": map[string]interface{}{"y": map[string]interface{}{"z": 12}}}
+
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	err := s.DeleteField(contextTest, Collection, "ID", "x.y.z.t")
+	if !reflect.DeepEqual(err, nil) {
+		t.Errorf("expected %v, got %v", nil, err)
+	}
+}
+
+func testUpdateFieldRoot(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "x": "12", "y": 12}
+	expected := map[string]interface{}{"_id": "ID", "x": 21, "y": 12}
+
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateField(contextTest, Collection, "ID", "x", 21); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func testDeleteFieldRoot(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{"_id": "ID", "x": "X", "a": "A"}
+	expected := map[string]interface{}{"_id": "ID", "a": "A"}
+
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteField(contextTest, Collection, "ID", "x"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func testArrayFields(s almacen.Store, t *testing.T) {
+	original := map[string]interface{}{
+		"_id":   "ID",
+		"items": []interface{}{map[string]interface{}{"name": "a"}, map[string]interface{}{"name": "b"}},
+		"obj":   map[string]interface{}{"3": "three"},
+	}
+	if err := s.Save(contextTest, Collection, original); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		field    string
+		expected interface{}
+		err      error
+	}{
+		{"items.1.name", "b", nil},
+		{"items.0", map[string]interface{}{"name": "a"}, nil},
+		{"obj.3", "three", nil},
+		{"items.2", nil, almacen.ErrIndexOutOfRange},
+		{"items.-", nil, almacen.ErrIndexOutOfRange},
+		{"items.name", nil, almacen.ErrNotFound},
+		{"items.0.x", nil, almacen.ErrNotFound},
+	} {
+		value, err := s.FindField(contextTest, Collection, "ID", c.field)
+		if err != c.err || !reflect.DeepEqual(value, c.expected) {
+			t.Errorf("%s: expected %v %v, got %v %v", c.field, c.expected, c.err, value, err)
+		}
+	}
+
+	for _, c := range []struct {
+		field string
+		value interface{}
+		err   error
+	}{
+		{"items.0.name", "A", nil},
+		{"items.-", map[string]interface{}{"name": "c"}, nil},
+		{"items.3", "X", almacen.ErrIndexOutOfRange},
+		{"items.-.name", "X", almacen.ErrIndexOutOfRange},
+	} {
+		if err := s.UpdateField(contextTest, Collection, "ID", c.field, c.value); err != c.err {
+			t.Errorf("update %s: expected %v, got %v", c.field, c.err, err)
+		}
+	}
+	for _, c := range []struct {
+		field string
+		err   error
+	}{
+		{"items.1", nil},
+		{"items.2", almacen.ErrIndexOutOfRange},
+		{"obj.3", nil},
+	} {
+		if err := s.DeleteField(contextTest, Collection, "ID", c.field); err != c.err {
+			t.Errorf("delete %s: expected %v, got %v", c.field, c.err, err)
+		}
+	}
+
+	expected := map[string]interface{}{
+		"_id":   "ID",
+		"items": []interface{}{map[string]interface{}{"name": "A"}, map[string]interface{}{"name": "c"}},
+		"obj":   map[string]interface{}{},
+	}
+	res, err := s.FindByID(contextTest, Collection, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+const concurrentWriters = 8
+
+func testConcurrentSave(s almacen.Store, t *testing.T) {
+	var wg sync.WaitGroup
+	for w := 0; w < concurrentWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				id := strconv.Itoa(w*10 + i)
+				if err := s.Save(contextTest, Collection, map[string]interface{}{"_id": id, "w": w}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	res, err := s.FindAll(contextTest, Collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != concurrentWriters*10 {
+		t.Errorf("expected %d entities, got %d", concurrentWriters*10, len(res))
+	}
+}
+
+func testConcurrentUpdateField(s almacen.Store, t *testing.T) {
+	if err := s.Save(contextTest, Collection, map[string]interface{}{"_id": "ID", "x": map[string]interface{}{}}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{}
+	var wg sync.WaitGroup
+	for w := 0; w < concurrentWriters; w++ {
+		field := "f" + strconv.Itoa(w)
+		expected[field] = field
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if err := s.UpdateField(contextTest, Collection, "ID", "x."+field, field); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	res, err := s.FindField(contextTest, Collection, "ID", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func testConcurrentInc(s almacen.Store, t *testing.T) {
+	if err := s.Save(contextTest, Collection, map[string]interface{}{"_id": "ID", "n": 0.0}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < concurrentWriters; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if err := s.Update(contextTest, Collection, "ID", &almacen.Update{Inc: map[string]interface{}{"n": 1.0}}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	res, err := s.FindField(contextTest, Collection, "ID", "n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := float64(concurrentWriters * 10); res != expected {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
@@ -0,0 +1,346 @@
+package almacen
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Update is a set of changes to the fields of an entity, given by field paths, applied
+// all of them or none. Changing a field creates the missing objects on its path, any
+// other value on the way is an ErrTraversingObject, as in MongoDB. A path should not be
+// changed twice.
+//
+// Besides setting and removing fields, Update has the operators of MongoDB: Inc adds a
+// number, Min and Max keep the lowest or highest value, Push appends to an array,
+// AddToSet appends if the value is not in the array yet, and Pull removes the elements
+// equal to a value, or the objects matching the fields of an object. A missing field is
+// taken as 0 or an empty array, a field of another type is an ErrTypeMismatch.
+//
+// Merge is a JSON Merge Patch (RFC 7396), applied before the rest. Its objects are merged
+// field by field, into an empty object where the entity has something else, and its
+// nulls remove.
+type Update struct {
+	Set      map[string]interface{}
+	Unset    []string
+	Inc      map[string]interface{}
+	Min      map[string]interface{}
+	Max      map[string]interface{}
+	Push     map[string]interface{}
+	AddToSet map[string]interface{}
+	Pull     map[string]interface{}
+	Merge    map[string]interface{}
+}
+
+var (
+	ErrInvalidFieldName = &Error{statusCode: 400, message: "invalid field name"}
+	ErrChangingID       = &Error{statusCode: 400, message: "_id cannot change"}
+	ErrTypeMismatch     = &Error{statusCode: 409, message: "type mismatch"}
+)
+
+const mergePatchContentType = "application/merge-patch+json"
+
+// mergePatchUpdate translates a JSON Merge Patch for the entity id. A revision sent back
+// by the client is ignored, as in a PUT
+func mergePatchUpdate(id string, patch map[string]interface{}) (*Update, error) {
+	if v, found := patch["_id"]; found && v != id {
+		return nil, ErrChangingID
+	}
+	patch = copyEntity(patch)
+	delete(patch, "_id")
+	delete(patch, RevField)
+	if err := checkMergePatch(patch); err != nil {
+		return nil, err
+	}
+	return &Update{Merge: patch}, nil
+}
+
+// checkMergePatch rejects the field names which MongoDB would take as paths or operators
+func checkMergePatch(patch map[string]interface{}) error {
+	for k, v := range patch {
+		if k == "" || strings.Contains(k, ".") || strings.HasPrefix(k, "$") {
+			return ErrInvalidFieldName
+		}
+		if fields, isObject := v.(map[string]interface{}); isObject {
+			if err := checkMergePatch(fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeChanges returns the paths set and removed by the merge patch of u, for a backend
+// changing fields by path. It is not possible, flat is false, if an object of the patch
+// sets no field, as it could make an empty object or leave one
+func (u *Update) mergeChanges() (set map[string]interface{}, unset []string, flat bool) {
+	set = map[string]interface{}{}
+	flat = addMergeChanges("", u.Merge, set, &unset)
+	return set, unset, flat
+}
+
+func addMergeChanges(prefix string, patch map[string]interface{}, set map[string]interface{}, unset *[]string) bool {
+	for k, v := range patch {
+		path := prefix + k
+		switch v := v.(type) {
+		case nil:
+			*unset = append(*unset, path)
+		case map[string]interface{}:
+			n := len(set)
+			if !addMergeChanges(path+".", v, set, unset) || len(set) == n {
+				return false
+			}
+		default:
+			set[path] = v
+		}
+	}
+	return true
+}
+
+// mergePatch applies a JSON Merge Patch (RFC 7396) to a copy of target. An object in the
+// patch is merged field by field, into an empty object if target is not one, with nulls
+// deleting. Anything else replaces target
+func mergePatch(target, patch interface{}) interface{} {
+	fields, isObject := patch.(map[string]interface{})
+	if !isObject {
+		return copyValue(patch)
+	}
+	res, isObject := target.(map[string]interface{})
+	if isObject {
+		res = copyEntity(res)
+	} else {
+		res = map[string]interface{}{}
+	}
+	for k, v := range fields {
+		if v == nil {
+			delete(res, k)
+		} else {
+			res[k] = mergePatch(res[k], v)
+		}
+	}
+	return res
+}
+
+// paths returns every path changed by u
+func (u *Update) paths() []string {
+	set, unset, _ := u.mergeChanges()
+	paths := append(append([]string{}, u.Unset...), unset...)
+	for _, values := range []map[string]interface{}{set, u.Set, u.Inc, u.Min, u.Max, u.Push, u.AddToSet, u.Pull} {
+		for path := range values {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func (u *Update) changesRevision() bool {
+	for _, path := range u.paths() {
+		if isRevPath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *Update) hasIndexSegment() bool {
+	for _, path := range u.paths() {
+		if hasIndexSegment(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *Update) hasCoordinatePath() bool {
+	for _, path := range u.paths() {
+		if isCoordinatePath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply changes ent in place. On error, ent may be partially changed
+func (u *Update) apply(ent map[string]interface{}) error {
+	if u.Merge != nil {
+		merged := mergePatch(ent, u.Merge).(map[string]interface{})
+		if merged["_id"] != ent["_id"] {
+			return ErrChangingID
+		}
+		for k := range ent {
+			delete(ent, k)
+		}
+		for k, v := range merged {
+			ent[k] = v
+		}
+	}
+	for _, path := range u.Unset {
+		if err := deleteField(ent, path); err != nil {
+			return err
+		}
+	}
+	for path, value := range u.Pull {
+		// pulling from a missing field does nothing
+		if _, err := lookupField(ent, path); err == ErrNotFound {
+			continue
+		}
+		if err := changeField(ent, path, false, pullValue(value)); err != nil {
+			return err
+		}
+	}
+	for _, op := range []struct {
+		values map[string]interface{}
+		fn     func(value, old interface{}, found bool) (interface{}, error)
+	}{
+		{u.Set, setValue},
+		{u.Inc, incValue},
+		{u.Min, minValue},
+		{u.Max, maxValue},
+		{u.Push, pushValue},
+		{u.AddToSet, addToSetValue},
+	} {
+		for path, value := range op.values {
+			fn, value := op.fn, value
+			err := changeField(ent, path, true, func(old interface{}, found bool) (interface{}, error) {
+				return fn(value, old, found)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setValue(value, old interface{}, found bool) (interface{}, error) {
+	return copyValue(value), nil
+}
+
+func incValue(value, old interface{}, found bool) (interface{}, error) {
+	n, isNumber := toFloat(value)
+	if !isNumber {
+		return nil, ErrTypeMismatch
+	}
+	if !found {
+		return n, nil
+	}
+	m, isNumber := toFloat(old)
+	if !isNumber {
+		return nil, ErrTypeMismatch
+	}
+	return m + n, nil
+}
+
+func minValue(value, old interface{}, found bool) (interface{}, error) {
+	if !found || compareSortValues(value, old) < 0 {
+		return copyValue(value), nil
+	}
+	return old, nil
+}
+
+func maxValue(value, old interface{}, found bool) (interface{}, error) {
+	if !found || compareSortValues(value, old) > 0 {
+		return copyValue(value), nil
+	}
+	return old, nil
+}
+
+func pushValue(value, old interface{}, found bool) (interface{}, error) {
+	if !found {
+		return []interface{}{copyValue(value)}, nil
+	}
+	array, isArray := old.([]interface{})
+	if !isArray {
+		return nil, ErrTypeMismatch
+	}
+	return append(array[:len(array):len(array)], copyValue(value)), nil
+}
+
+func addToSetValue(value, old interface{}, found bool) (interface{}, error) {
+	if array, isArray := old.([]interface{}); isArray {
+		for _, elem := range array {
+			if jsonEqual(elem, value) {
+				return array, nil
+			}
+		}
+	}
+	return pushValue(value, old, found)
+}
+
+// pullValue removes from an array the elements equal to value, or matching its fields if it
+// is an object, as a query of MongoDB would
+func pullValue(value interface{}) func(old interface{}, found bool) (interface{}, error) {
+	match := func(elem interface{}) bool { return jsonEqual(elem, value) }
+	if cond, isObject := value.(map[string]interface{}); isObject {
+		f := &Filter{Op: FilterAnd}
+		for field, v := range cond {
+			f.Filters = append(f.Filters, &Filter{Op: FilterEq, Field: field, Value: v})
+		}
+		match = func(elem interface{}) bool {
+			obj, isObject := elem.(map[string]interface{})
+			return isObject && f.match(obj)
+		}
+	}
+	return func(old interface{}, found bool) (interface{}, error) {
+		array, isArray := old.([]interface{})
+		if !isArray {
+			return nil, ErrTypeMismatch
+		}
+		kept := []interface{}{}
+		for _, elem := range array {
+			if !match(elem) {
+				kept = append(kept, elem)
+			}
+		}
+		return kept, nil
+	}
+}
+
+// fieldOperatorUpdate translates the body of a POST to a field, as {"op": "inc", "value": 1}.
+// The operators are inc, dec, min, max, push, addToSet and pull
+func fieldOperatorUpdate(field string, input interface{}) (*Update, error) {
+	body, isObject := input.(map[string]interface{})
+	if !isObject {
+		return nil, ErrObjectExpected
+	}
+	value, found := body["value"]
+	if !found {
+		return nil, &Error{statusCode: http.StatusBadRequest, message: "missing value"}
+	}
+	op, _ := body["op"].(string)
+	if op == "inc" || op == "dec" {
+		n, isNumber := value.(float64)
+		if !isNumber {
+			return nil, &Error{statusCode: http.StatusBadRequest, message: "expected number"}
+		}
+		if op == "dec" {
+			n = -n
+		}
+		return &Update{Inc: map[string]interface{}{field: n}}, nil
+	}
+	if cond, isObject := value.(map[string]interface{}); isObject && op == "pull" {
+		for k := range cond {
+			if !validPath(k) {
+				return nil, ErrInvalidFieldName
+			}
+		}
+	}
+	values := map[string]interface{}{field: value}
+	switch op {
+	case "min":
+		return &Update{Min: values}, nil
+	case "max":
+		return &Update{Max: values}, nil
+	case "push":
+		return &Update{Push: values}, nil
+	case "addToSet":
+		return &Update{AddToSet: values}, nil
+	case "pull":
+		return &Update{Pull: values}, nil
+	}
+	return nil, &Error{statusCode: http.StatusBadRequest, message: "unknown operator " + strconv.Quote(op)}
+}
+
+func isContentType(req *http.Request, contentType string) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), contentType)
+}
@@ -0,0 +1,150 @@
+package almacen
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMergePatchUpdate(t *testing.T) {
+	patch := map[string]interface{}{
+		"_id":   "id",
+		"title": "Hello!",
+		"phone": nil,
+		"author": map[string]interface{}{
+			"familyName": nil,
+			"address":    map[string]interface{}{"city": "Bilbao"},
+		},
+		"tags": []interface{}{"example"},
+	}
+	u, err := mergePatchUpdate("id", patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := u.Merge["_id"]; found {
+		t.Errorf("wanted the ID out of the update, got %v", u.Merge)
+	}
+	if _, found := patch["_id"]; !found {
+		t.Errorf("patch modified")
+	}
+	set, unset, flat := u.mergeChanges()
+	sort.Strings(unset)
+	wantedSet := map[string]interface{}{
+		"title":               "Hello!",
+		"author.address.city": "Bilbao",
+		"tags":                []interface{}{"example"},
+	}
+	wantedUnset := []string{"author.familyName", "phone"}
+	if !flat || !reflect.DeepEqual(set, wantedSet) || !reflect.DeepEqual(unset, wantedUnset) {
+		t.Errorf("wanted %v and %v, got %v and %v, %v", wantedSet, wantedUnset, set, unset, flat)
+	}
+
+	// objects setting nothing could make an empty object, only the entity tells
+	for _, patch := range []map[string]interface{}{
+		{"a": map[string]interface{}{}},
+		{"a": map[string]interface{}{"b": nil}},
+		{"a": map[string]interface{}{"b": map[string]interface{}{"c": nil}, "d": 1}},
+	} {
+		if _, _, flat := (&Update{Merge: patch}).mergeChanges(); flat {
+			t.Errorf("%v: wanted it not flat", patch)
+		}
+	}
+}
+
+func TestMergePatchUpdateErr(t *testing.T) {
+	for _, c := range []struct {
+		patch map[string]interface{}
+		err   error
+	}{
+		{map[string]interface{}{"_id": "other"}, ErrChangingID},
+		{map[string]interface{}{"_id": nil}, ErrChangingID},
+		{map[string]interface{}{"a.b": 1}, ErrInvalidFieldName},
+		{map[string]interface{}{"a": map[string]interface{}{"$set": 1}}, ErrInvalidFieldName},
+		{map[string]interface{}{"": 1}, ErrInvalidFieldName},
+	} {
+		if _, err := mergePatchUpdate("id", c.patch); err != c.err {
+			t.Errorf("%v: wanted %v, got %v", c.patch, c.err, err)
+		}
+	}
+}
+
+// TestMergePatch has the examples of RFC 7396
+func TestMergePatch(t *testing.T) {
+	for _, c := range []struct {
+		target, patch, wanted string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{`{"a":5}`, `{"a":{"b":1}}`, `{"a":{"b":1}}`},
+		{`{"a":5}`, `{"a":{}}`, `{"a":{}}`},
+		{`{"a":[1,2]}`, `{"a":{"0":3}}`, `{"a":{"0":3}}`},
+	} {
+		var target, patch, wanted interface{}
+		for _, v := range []struct {
+			s   string
+			dst *interface{}
+		}{{c.target, &target}, {c.patch, &patch}, {c.wanted, &wanted}} {
+			if err := json.Unmarshal([]byte(v.s), v.dst); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := mergePatch(target, patch)
+		if !reflect.DeepEqual(got, wanted) {
+			t.Errorf("%s with %s: wanted %v, got %v", c.target, c.patch, wanted, got)
+		}
+		var original interface{}
+		json.Unmarshal([]byte(c.target), &original)
+		if !reflect.DeepEqual(target, original) {
+			t.Errorf("%s with %s: target modified to %v", c.target, c.patch, target)
+		}
+	}
+}
+
+func TestFieldOperatorUpdate(t *testing.T) {
+	cases := []struct {
+		input  string
+		wanted *Update
+		err    bool
+	}{
+		{`{"op": "inc", "value": 2}`, &Update{Inc: map[string]interface{}{"f": 2.0}}, false},
+		{`{"op": "dec", "value": 2}`, &Update{Inc: map[string]interface{}{"f": -2.0}}, false},
+		{`{"op": "min", "value": "a"}`, &Update{Min: map[string]interface{}{"f": "a"}}, false},
+		{`{"op": "max", "value": null}`, &Update{Max: map[string]interface{}{"f": nil}}, false},
+		{`{"op": "push", "value": [1]}`, &Update{Push: map[string]interface{}{"f": []interface{}{1.0}}}, false},
+		{`{"op": "addToSet", "value": 1}`, &Update{AddToSet: map[string]interface{}{"f": 1.0}}, false},
+		{`{"op": "pull", "value": {"a.b": 1}}`, &Update{Pull: map[string]interface{}{"f": map[string]interface{}{"a.b": 1.0}}}, false},
+		{`{"op": "pull", "value": {"$gt": 1}}`, nil, true},
+		{`{"op": "inc", "value": "1"}`, nil, true},
+		{`{"op": "inc"}`, nil, true},
+		{`{"op": "mul", "value": 2}`, nil, true},
+		{`[]`, nil, true},
+	}
+	for _, c := range cases {
+		var input interface{}
+		if err := json.Unmarshal([]byte(c.input), &input); err != nil {
+			t.Fatal(err)
+		}
+		u, err := fieldOperatorUpdate("f", input)
+		if (err != nil) != c.err {
+			t.Errorf("%s: unexpected error %v", c.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(u, c.wanted) {
+			t.Errorf("%s: wanted %#v, got %#v", c.input, c.wanted, u)
+		}
+	}
+}